@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
@@ -13,8 +14,11 @@ import (
 	"github.com/uptrace/bun/dialect/pgdialect"
 	"github.com/uptrace/bun/driver/pgdriver"
 
+	"gpu/events"
 	"gpu/model"
+	"gpu/notify"
 	"gpu/routes"
+	"gpu/util"
     "gpu/scan"
 )
 
@@ -22,9 +26,20 @@ type App struct {
 	Router        *mux.Router
 	DB            *bun.DB
 	JwtSecret     string
+	JwtAlg        string
+	KeyRotation   time.Duration
+	Keys          *util.KeySet
 	StripeSecret  string
 	StripeWebhook string
 	GCPComputeKey string
+	AppURL        string
+	APIURL        string
+	Registration  string
+	EncryptionKey []byte
+	ContainerBase string
+	Mailer        util.Mailer
+	Events        *events.Bus
+	OAuth         map[string]*util.OAuthProvider
 	DEV           bool
 }
 
@@ -55,10 +70,253 @@ func MakeTables(db *bun.DB) error {
 		return err
 	}
 	_, err = db.NewCreateTable().Model((*model.ServerConfig)(nil)).IfNotExists().Exec(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = db.NewCreateTable().Model((*model.APIKey)(nil)).IfNotExists().Exec(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = db.NewCreateTable().Model((*model.Organization)(nil)).IfNotExists().Exec(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = db.NewCreateTable().Model((*model.Membership)(nil)).IfNotExists().Exec(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = db.NewCreateTable().Model((*model.Invitation)(nil)).IfNotExists().Exec(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = db.NewCreateTable().Model((*model.UserToken)(nil)).IfNotExists().Exec(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = db.NewCreateTable().Model((*model.RecoveryCode)(nil)).IfNotExists().Exec(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = db.NewCreateTable().Model((*model.Identity)(nil)).IfNotExists().Exec(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = db.NewCreateTable().Model((*model.OAuthState)(nil)).IfNotExists().Exec(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = db.NewCreateTable().Model((*model.LoginAttempt)(nil)).IfNotExists().Exec(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = db.NewCreateTable().Model((*model.InviteCode)(nil)).IfNotExists().Exec(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = db.NewCreateTable().Model((*model.JWTKey)(nil)).IfNotExists().Exec(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = db.NewCreateTable().Model((*model.AuditLog)(nil)).IfNotExists().Exec(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = db.NewCreateTable().Model((*model.ConfigProposal)(nil)).IfNotExists().Exec(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = db.NewCreateTable().Model((*model.Quota)(nil)).IfNotExists().Exec(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = db.NewCreateTable().Model((*model.Reservation)(nil)).IfNotExists().Exec(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = db.NewCreateTable().Model((*model.Webhook)(nil)).IfNotExists().Exec(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = db.NewCreateTable().Model((*model.WebhookDelivery)(nil)).IfNotExists().Exec(ctx)
+	if err != nil {
+		return err
+	}
+	return AppendOnly(db, "audit_logs")
+}
+
+// AppendOnly makes the database refuse updates, deletes and truncates on table,
+// so rows can't be rewritten even through a bug or a stolen app login.
+func AppendOnly(db *bun.DB, table string) error {
+	ctx := context.Background()
+	rows := bun.Ident(table + "_append_only")
+	truncate := bun.Ident(table + "_no_truncate")
+
+	statements := []struct {
+		query string
+		args  []interface{}
+	}{
+		{`CREATE OR REPLACE FUNCTION reject_change() RETURNS trigger AS $$
+		BEGIN
+			RAISE EXCEPTION '% is append-only', TG_TABLE_NAME;
+		END;
+		$$ LANGUAGE plpgsql`, nil},
+		{"DROP TRIGGER IF EXISTS ? ON ?", []interface{}{rows, bun.Ident(table)}},
+		{"CREATE TRIGGER ? BEFORE UPDATE OR DELETE ON ? FOR EACH ROW EXECUTE PROCEDURE reject_change()", []interface{}{rows, bun.Ident(table)}},
+		{"DROP TRIGGER IF EXISTS ? ON ?", []interface{}{truncate, bun.Ident(table)}},
+		{"CREATE TRIGGER ? BEFORE TRUNCATE ON ? FOR EACH STATEMENT EXECUTE PROCEDURE reject_change()", []interface{}{truncate, bun.Ident(table)}},
+	}
+
+	for _, statement := range statements {
+		_, err := db.ExecContext(ctx, statement.query, statement.args...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddColumns brings tables created by an older MakeTables up to date, since
+// CREATE TABLE IF NOT EXISTS leaves existing tables alone.
+func AddColumns(db *bun.DB) error {
+	ctx := context.Background()
+	columns := []struct {
+		model  interface{}
+		column string
+	}{
+		{(*model.Deposit)(nil), "organization_id bigint"},
+		{(*model.Purchase)(nil), "organization_id bigint"},
+		{(*model.Product)(nil), "organization_id bigint"},
+		{(*model.User)(nil), "email varchar UNIQUE"},
+		{(*model.User)(nil), "email_verified boolean DEFAULT false"},
+		{(*model.User)(nil), "totp_secret varchar"},
+		{(*model.User)(nil), "totp_enabled boolean DEFAULT false"},
+		{(*model.User)(nil), "totp_last_step bigint DEFAULT 0"},
+		{(*model.User)(nil), "locked_until timestamptz"},
+		{(*model.User)(nil), "invite_code_id bigint"},
+		{(*model.OAuthState)(nil), "invite_code varchar"},
+		{(*model.ServerConfig)(nil), "availability varchar NOT NULL DEFAULT 'unknown'"},
+		{(*model.ServerConfig)(nil), "availability_checked_at timestamptz"},
+		{(*model.Template)(nil), "params jsonb"},
+		{(*model.Product)(nil), "params jsonb"},
+		{(*model.Template)(nil), "kind varchar NOT NULL DEFAULT 'machine_image'"},
+		{(*model.Template)(nil), "owner_id bigint"},
+		{(*model.Template)(nil), "organization_id bigint"},
+		{(*model.Template)(nil), "registry_username varchar"},
+		{(*model.Template)(nil), "registry_password varchar"},
+		{(*model.ServerConfig)(nil), "gpu_memory integer"},
+		{(*model.ServerConfig)(nil), "cpus integer"},
+		{(*model.ServerConfig)(nil), "memory integer"},
+		{(*model.ServerConfig)(nil), "max_storage integer"},
+		{(*model.Template)(nil), "min_storage integer NOT NULL DEFAULT 100"}, // every template needed 100GB before
+		{(*model.Template)(nil), "min_gpu_memory integer"},
+		{(*model.Template)(nil), "min_gpu_count integer"},
+		{(*model.Template)(nil), "gpu_types varchar[]"},
+		{(*model.ConfigProposal)(nil), "gpu_memory integer"},
+		{(*model.ConfigProposal)(nil), "cpus integer"},
+		{(*model.ConfigProposal)(nil), "memory integer"},
+		{(*model.Product)(nil), "expires_at timestamptz"},
+		{(*model.Product)(nil), "idle_minutes integer"},
+		{(*model.Product)(nil), "expiry_action varchar NOT NULL DEFAULT 'destroy'"},
+		{(*model.Product)(nil), "last_active_at timestamptz"},
+		{(*model.Product)(nil), "heartbeat_hash varchar"},
+		{(*model.Product)(nil), "expiry_warned_at timestamptz"},
+		{(*model.Product)(nil), "idle_warned_at timestamptz"},
+		{(*model.Reservation)(nil), "claimed_at timestamptz"},
+		{(*model.Notification)(nil), "kind varchar"},
+		{(*model.Notification)(nil), "dedup_key varchar"},
+		{(*model.Notification)(nil), "archived_at timestamptz"},
+	}
+
+	for _, c := range columns {
+		_, err := db.NewAddColumn().Model(c.model).ColumnExpr(c.column).IfNotExists().Exec(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Configs from before gpu_memory get it from their GPU type, or templates
+	// needing any would never fit them.
+	var gpuTypes []string
+	err := db.NewSelect().Model((*model.ServerConfig)(nil)).Distinct().Column("gpu_type").
+		Where("gpu_memory IS NULL").Scan(ctx, &gpuTypes)
+	if err != nil {
+		return err
+	}
+	for _, gpuType := range gpuTypes {
+		_, err := db.NewUpdate().Model((*model.ServerConfig)(nil)).Set("gpu_memory = ?", util.GPUMemory(gpuType)).
+			Where("gpu_memory IS NULL").Where("gpu_type = ?", gpuType).Exec(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Notifications are deduplicated with ON CONFLICT on this index.
+	_, err = db.NewCreateIndex().Model((*model.Notification)(nil)).Index("notifications_dedup").Unique().
+		Column("user_id", "dedup_key").IfNotExists().Exec(ctx)
+	if err != nil {
+		return err
+	}
+	// Keeps the unread count cheap however large the inbox grows.
+	_, err = db.NewCreateIndex().Model((*model.Notification)(nil)).Index("notifications_unread").
+		Column("user_id").Where("read = false AND archived_at IS NULL").IfNotExists().Exec(ctx)
+	if err != nil {
+		return err
+	}
+	// The webhook scanner only ever looks at pending deliveries.
+	_, err = db.NewCreateIndex().Model((*model.WebhookDelivery)(nil)).Index("webhook_deliveries_pending").
+		Column("next_attempt_at").Where("status = 'pending'").IfNotExists().Exec(ctx)
 	return err
 }
 
-func (a *App) Initialize(user, password, dbname, jwtSecret, stripeSecret, stripeWebhook, gcpComputeKey string, dev bool) {
+// PublishChanges makes the database NOTIFY the events channel whenever a
+// product changes status, or a notification, purchase or deposit is added.
+// The payload is an events.Event.
+func PublishChanges(db *bun.DB) error {
+	ctx := context.Background()
+
+	statements := []string{
+		`CREATE OR REPLACE FUNCTION publish_event() RETURNS trigger AS $$
+		DECLARE
+			org bigint;
+			data json;
+		BEGIN
+			IF TG_TABLE_NAME = 'products' THEN
+				IF TG_OP = 'UPDATE' AND NEW.status IS NOT DISTINCT FROM OLD.status THEN
+					RETURN NULL;
+				END IF;
+				org := NEW.organization_id;
+				data := json_build_object('id', NEW.id, 'gcp_id', NEW.gcp_id, 'status', NEW.status, 'dns_link', NEW.dns_link);
+			ELSIF TG_TABLE_NAME = 'notifications' THEN
+				data := json_build_object('id', NEW.id, 'kind', NEW.kind, 'title', NEW.title);
+			ELSE
+				org := NEW.organization_id;
+				data := json_build_object('id', NEW.id, 'amount', NEW.amount, 'product_id', to_jsonb(NEW) -> 'product_id');
+			END IF;
+			PERFORM pg_notify('` + events.Channel + `', json_build_object('type', TG_ARGV[0], 'user_id', NEW.user_id,
+				'organization_id', COALESCE(org, 0), 'data', data)::text);
+			RETURN NULL;
+		END;
+		$$ LANGUAGE plpgsql`,
+		"DROP TRIGGER IF EXISTS products_publish ON products",
+		"CREATE TRIGGER products_publish AFTER INSERT OR UPDATE OF status ON products FOR EACH ROW EXECUTE PROCEDURE publish_event('product')",
+		"DROP TRIGGER IF EXISTS notifications_publish ON notifications",
+		"CREATE TRIGGER notifications_publish AFTER INSERT ON notifications FOR EACH ROW EXECUTE PROCEDURE publish_event('notification')",
+		"DROP TRIGGER IF EXISTS purchases_publish ON purchases",
+		"CREATE TRIGGER purchases_publish AFTER INSERT ON purchases FOR EACH ROW EXECUTE PROCEDURE publish_event('purchase')",
+		"DROP TRIGGER IF EXISTS deposits_publish ON deposits",
+		"CREATE TRIGGER deposits_publish AFTER INSERT ON deposits FOR EACH ROW EXECUTE PROCEDURE publish_event('deposit')",
+	}
+
+	for _, statement := range statements {
+		_, err := db.ExecContext(ctx, statement)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *App) Initialize(user, password, dbname, jwtSecret string, jwtLegacyUntil time.Time, jwtAlg string, keyRotation time.Duration, stripeSecret, stripeWebhook, gcpComputeKey, appURL, apiURL, registration string, encryptionKey []byte, containerBase string, mailer util.Mailer, oauth map[string]*util.OAuthProvider, dev bool) {
 	connectionString := fmt.Sprintf("postgres://%s:%s@localhost:5432/%s?sslmode=disable", user, password, dbname)
 
 	sqldb := sql.OpenDB(pgdriver.NewConnector(pgdriver.WithDSN(connectionString)))
@@ -68,14 +326,47 @@ func (a *App) Initialize(user, password, dbname, jwtSecret, stripeSecret, stripe
 	if err != nil {
 		log.Fatal(err)
 	}
+	err = AddColumns(a.DB)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = PublishChanges(a.DB)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	a.Keys, err = util.NewKeySet(a.DB, jwtAlg, jwtSecret, jwtLegacyUntil, encryptionKey)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-    go scan.ScanBalance(a.DB)
+	notifier := notify.New(a.DB, mailer)
+    go scan.ScanBalance(a.DB, notifier)
+	go scan.RotateKeys(a.Keys, keyRotation)
+	go scan.ProbeAvailability(a.DB, !dev)
+	go scan.RunReservations(a.DB, notifier, containerBase, encryptionKey)
+	go scan.EnforceLifetimes(a.DB, notifier)
+	go scan.DeliverWebhooks(a.DB, encryptionKey)
+	a.Events = events.New(a.DB)
+	go a.Events.Run()
+	if !dev {
+		go scan.CatalogSync(a.DB)
+	}
 
 	a.Router = mux.NewRouter()
 	a.JwtSecret = jwtSecret
+	a.JwtAlg = jwtAlg
+	a.KeyRotation = keyRotation
 	a.StripeSecret = stripeSecret
 	a.StripeWebhook = stripeWebhook
 	a.GCPComputeKey = gcpComputeKey
+	a.AppURL = appURL
+	a.APIURL = apiURL
+	a.Registration = registration
+	a.EncryptionKey = encryptionKey
+	a.ContainerBase = containerBase
+	a.Mailer = mailer
+	a.OAuth = oauth
 	a.DEV = dev
 
 	a.initializeRoutes()
@@ -104,18 +395,103 @@ func (a *App) initializeRoutes() {
 		},
 	}).Handler
 
-	router := routes.NewRouter(a.DB, a.JwtSecret, a.StripeSecret, a.StripeWebhook, a.GCPComputeKey, a.DEV)
+	router := routes.NewRouter(a.DB, a.Keys, a.StripeSecret, a.StripeWebhook, a.GCPComputeKey, a.AppURL, a.APIURL, a.Registration, a.EncryptionKey, a.ContainerBase, a.Mailer, a.Events, a.OAuth, a.DEV)
 
 	a.Router.Handle("/register", cor(http.HandlerFunc(router.Register))).Methods("OPTIONS", "POST")
 	a.Router.Handle("/login", cor(http.HandlerFunc(router.Login))).Methods("OPTIONS", "POST")
+	a.Router.Handle("/login/2fa", cor(http.HandlerFunc(router.LoginTwoFactor))).Methods("OPTIONS", "POST")
 	a.Router.Handle("/refresh", cor(http.HandlerFunc(router.RefreshToken))).Methods("OPTIONS", "POST")
-	a.Router.Handle("/profile", cor(router.AuthMiddleware(http.HandlerFunc(router.Profile)))).Methods("OPTIONS", "GET")
-	a.Router.Handle("/transactions", cor(router.AuthMiddleware(http.HandlerFunc(router.Transactions)))).Methods("OPTIONS", "GET")
-	a.Router.Handle("/products", cor(router.AuthMiddleware(http.HandlerFunc(router.Products)))).Methods("OPTIONS", "GET")
-	a.Router.Handle("/templates", cor(router.AuthMiddleware(http.HandlerFunc(router.Templates)))).Methods("OPTIONS", "GET")
-	a.Router.Handle("/search", cor(router.AuthMiddleware(http.HandlerFunc(router.Search)))).Methods("OPTIONS", "GET")
-	a.Router.Handle("/data", cor(router.AuthMiddleware(http.HandlerFunc(router.Data)))).Methods("OPTIONS", "GET")
-
-	a.Router.Handle("/servers/start", cor(router.AuthMiddleware(http.HandlerFunc(router.SpinServer)))).Methods("OPTIONS", "POST")
-	a.Router.Handle("/servers/destroy", cor(router.AuthMiddleware(http.HandlerFunc(router.KillServer)))).Methods("OPTIONS", "POST")
+	a.Router.Handle("/.well-known/jwks.json", cor(http.HandlerFunc(router.JWKS))).Methods("OPTIONS", "GET")
+	a.Router.Handle("/oauth/{provider}/start", cor(http.HandlerFunc(router.OAuthStart))).Methods("OPTIONS", "GET")
+	a.Router.Handle("/oauth/{provider}/callback", http.HandlerFunc(router.OAuthCallback)).Methods("GET")
+	a.Router.Handle("/oauth/{provider}/link", cor(router.AuthMiddleware(router.RequireScope("account", http.HandlerFunc(router.OAuthLink))))).Methods("OPTIONS", "POST")
+	a.Router.Handle("/identities", cor(router.AuthMiddleware(router.RequireScope("account", http.HandlerFunc(router.Identities))))).Methods("OPTIONS", "GET")
+	a.Router.Handle("/email/verify", cor(http.HandlerFunc(router.VerifyEmail))).Methods("OPTIONS", "POST")
+	a.Router.Handle("/password/forgot", cor(http.HandlerFunc(router.ForgotPassword))).Methods("OPTIONS", "POST")
+	a.Router.Handle("/password/reset", cor(http.HandlerFunc(router.ResetPassword))).Methods("OPTIONS", "POST")
+	a.Router.Handle("/email", cor(router.AuthMiddleware(router.RequireScope("account", http.HandlerFunc(router.SetEmail))))).Methods("OPTIONS", "POST")
+	a.Router.Handle("/email/resend", cor(router.AuthMiddleware(router.RequireScope("account", http.HandlerFunc(router.ResendVerification))))).Methods("OPTIONS", "POST")
+	a.Router.Handle("/2fa/enroll", cor(router.AuthMiddleware(router.RequireScope("account", http.HandlerFunc(router.EnrollTwoFactor))))).Methods("OPTIONS", "POST")
+	a.Router.Handle("/2fa/confirm", cor(router.AuthMiddleware(router.RequireScope("account", http.HandlerFunc(router.ConfirmTwoFactor))))).Methods("OPTIONS", "POST")
+	a.Router.Handle("/2fa/disable", cor(router.AuthMiddleware(router.RequireScope("account", http.HandlerFunc(router.DisableTwoFactor))))).Methods("OPTIONS", "POST")
+	a.Router.Handle("/audit", cor(router.AuthMiddleware(router.RequireScope("account", http.HandlerFunc(router.Audit))))).Methods("OPTIONS", "GET")
+	a.Router.Handle("/profile", cor(router.AuthMiddleware(router.RequireScope("profile:read", http.HandlerFunc(router.Profile))))).Methods("OPTIONS", "GET")
+	a.Router.Handle("/notifications", cor(router.AuthMiddleware(router.RequireScope("profile:read", http.HandlerFunc(router.Notifications))))).Methods("OPTIONS", "GET")
+	a.Router.Handle("/notifications/unread", cor(router.AuthMiddleware(router.RequireScope("profile:read", http.HandlerFunc(router.UnreadNotifications))))).Methods("OPTIONS", "GET")
+	a.Router.Handle("/notifications/read", cor(router.AuthMiddleware(router.RequireScope("profile:write", http.HandlerFunc(router.ReadNotifications))))).Methods("OPTIONS", "POST")
+	a.Router.Handle("/notifications/archive", cor(router.AuthMiddleware(router.RequireScope("profile:write", http.HandlerFunc(router.ArchiveNotifications))))).Methods("OPTIONS", "POST")
+	a.Router.Handle("/notifications/delete", cor(router.AuthMiddleware(router.RequireScope("profile:write", http.HandlerFunc(router.DeleteNotifications))))).Methods("OPTIONS", "POST")
+	a.Router.Handle("/webhooks", cor(router.AuthMiddleware(router.RequireScope("webhooks:read", http.HandlerFunc(router.Webhooks))))).Methods("OPTIONS", "GET")
+	a.Router.Handle("/webhooks/create", cor(router.AuthMiddleware(router.RequireScope("webhooks:write", http.HandlerFunc(router.CreateWebhook))))).Methods("OPTIONS", "POST")
+	a.Router.Handle("/webhooks/update", cor(router.AuthMiddleware(router.RequireScope("webhooks:write", http.HandlerFunc(router.UpdateWebhook))))).Methods("OPTIONS", "POST")
+	a.Router.Handle("/webhooks/delete", cor(router.AuthMiddleware(router.RequireScope("webhooks:write", http.HandlerFunc(router.DeleteWebhook))))).Methods("OPTIONS", "POST")
+	a.Router.Handle("/webhooks/deliveries", cor(router.AuthMiddleware(router.RequireScope("webhooks:read", http.HandlerFunc(router.WebhookDeliveries))))).Methods("OPTIONS", "GET")
+	a.Router.Handle("/webhooks/test", cor(router.AuthMiddleware(router.RequireScope("webhooks:write", http.HandlerFunc(router.TestWebhook))))).Methods("OPTIONS", "POST")
+	a.Router.Handle("/events", cor(router.QueryToken(router.AuthMiddleware(router.RequireScope("servers:read", http.HandlerFunc(router.Events)))))).Methods("OPTIONS", "GET")
+	a.Router.Handle("/transactions", cor(router.AuthMiddleware(router.RequireScope("billing:read", http.HandlerFunc(router.Transactions))))).Methods("OPTIONS", "GET")
+	a.Router.Handle("/products", cor(router.AuthMiddleware(router.RequireScope("servers:read", http.HandlerFunc(router.Products))))).Methods("OPTIONS", "GET")
+	a.Router.Handle("/templates", cor(router.AuthMiddleware(router.RequireScope("servers:read", http.HandlerFunc(router.Templates))))).Methods("OPTIONS", "GET")
+	a.Router.Handle("/templates/create", cor(router.AuthMiddleware(router.RequireScope("servers:write", http.HandlerFunc(router.CreateTemplate))))).Methods("OPTIONS", "POST")
+	a.Router.Handle("/templates/update", cor(router.AuthMiddleware(router.RequireScope("servers:write", http.HandlerFunc(router.UpdateTemplate))))).Methods("OPTIONS", "POST")
+	a.Router.Handle("/templates/delete", cor(router.AuthMiddleware(router.RequireScope("servers:write", http.HandlerFunc(router.DeleteTemplate))))).Methods("OPTIONS", "POST")
+	a.Router.Handle("/search", cor(router.AuthMiddleware(router.RequireScope("servers:read", http.HandlerFunc(router.Search))))).Methods("OPTIONS", "GET")
+	a.Router.Handle("/quotas", cor(router.AuthMiddleware(router.RequireScope("servers:read", http.HandlerFunc(router.Quotas))))).Methods("OPTIONS", "GET")
+	a.Router.Handle("/reservations", cor(router.AuthMiddleware(router.RequireScope("servers:read", http.HandlerFunc(router.Reservations))))).Methods("OPTIONS", "GET")
+	a.Router.Handle("/reservations/create", cor(router.AuthMiddleware(router.RequireScope("servers:write", http.HandlerFunc(router.CreateReservation))))).Methods("OPTIONS", "POST")
+	a.Router.Handle("/reservations/cancel", cor(router.AuthMiddleware(router.RequireScope("servers:write", http.HandlerFunc(router.CancelReservation))))).Methods("OPTIONS", "POST")
+	a.Router.Handle("/data", cor(router.AuthMiddleware(router.RequireScope("billing:read", http.HandlerFunc(router.Data))))).Methods("OPTIONS", "GET")
+
+	a.Router.Handle("/servers/start", cor(router.AuthMiddleware(router.RequireScope("servers:write", http.HandlerFunc(router.SpinServer))))).Methods("OPTIONS", "POST")
+	a.Router.Handle("/servers/destroy", cor(router.AuthMiddleware(router.RequireScope("servers:write", http.HandlerFunc(router.KillServer))))).Methods("OPTIONS", "POST")
+	a.Router.Handle("/servers/resume", cor(router.AuthMiddleware(router.RequireScope("servers:write", http.HandlerFunc(router.ResumeServer))))).Methods("OPTIONS", "POST")
+	a.Router.Handle("/servers/ttl", cor(router.AuthMiddleware(router.RequireScope("servers:write", http.HandlerFunc(router.SetServerTTL))))).Methods("OPTIONS", "POST")
+	// Called by instances with their heartbeat token, not by users.
+	a.Router.Handle("/servers/heartbeat", http.HandlerFunc(router.Heartbeat)).Methods("POST")
+
+	a.Router.Handle("/orgs", cor(router.AuthMiddleware(router.RequireScope("orgs:read", http.HandlerFunc(router.Orgs))))).Methods("OPTIONS", "GET")
+	a.Router.Handle("/orgs/create", cor(router.AuthMiddleware(router.RequireScope("orgs:write", http.HandlerFunc(router.CreateOrg))))).Methods("OPTIONS", "POST")
+	a.Router.Handle("/orgs/members", cor(router.AuthMiddleware(router.RequireScope("orgs:read", http.HandlerFunc(router.OrgMembers))))).Methods("OPTIONS", "GET")
+	a.Router.Handle("/orgs/members/update", cor(router.AuthMiddleware(router.RequireScope("orgs:write", http.HandlerFunc(router.UpdateOrgMember))))).Methods("OPTIONS", "POST")
+	a.Router.Handle("/orgs/members/remove", cor(router.AuthMiddleware(router.RequireScope("orgs:write", http.HandlerFunc(router.RemoveOrgMember))))).Methods("OPTIONS", "POST")
+	a.Router.Handle("/orgs/invite", cor(router.AuthMiddleware(router.RequireScope("orgs:write", http.HandlerFunc(router.InviteOrgMember))))).Methods("OPTIONS", "POST")
+	a.Router.Handle("/orgs/invitations", cor(router.AuthMiddleware(router.RequireScope("orgs:read", http.HandlerFunc(router.Invitations))))).Methods("OPTIONS", "GET")
+	a.Router.Handle("/orgs/invitations/respond", cor(router.AuthMiddleware(router.RequireScope("orgs:write", http.HandlerFunc(router.RespondInvitation))))).Methods("OPTIONS", "POST")
+
+	a.Router.Handle("/keys", cor(router.AuthMiddleware(router.RequireScope("keys:write", http.HandlerFunc(router.Keys))))).Methods("OPTIONS", "GET")
+	a.Router.Handle("/keys/create", cor(router.AuthMiddleware(router.RequireScope("keys:write", http.HandlerFunc(router.CreateKey))))).Methods("OPTIONS", "POST")
+	a.Router.Handle("/keys/revoke", cor(router.AuthMiddleware(router.RequireScope("keys:write", http.HandlerFunc(router.RevokeKey))))).Methods("OPTIONS", "POST")
+
+	// Admin routes check the admin flag in the database, and never accept API keys.
+	admin := a.Router.PathPrefix("/admin").Subrouter()
+	adminOnly := func(handler http.HandlerFunc) http.Handler {
+		return cor(router.AuthMiddleware(router.RequireScope("admin", router.AdminMiddleware(handler))))
+	}
+	admin.Handle("/users", adminOnly(router.AdminUsers)).Methods("OPTIONS", "GET")
+	admin.Handle("/users/products", adminOnly(router.AdminUserProducts)).Methods("OPTIONS", "GET")
+	admin.Handle("/users/ledger", adminOnly(router.AdminUserLedger)).Methods("OPTIONS", "GET")
+	admin.Handle("/users/active", adminOnly(router.AdminSetActive)).Methods("OPTIONS", "POST")
+	admin.Handle("/users/unlock", adminOnly(router.AdminUnlock)).Methods("OPTIONS", "POST")
+	admin.Handle("/login-attempts", adminOnly(router.AdminLoginAttempts)).Methods("OPTIONS", "GET")
+	admin.Handle("/audit", adminOnly(router.AdminAudit)).Methods("OPTIONS", "GET")
+	admin.Handle("/configs", adminOnly(router.AdminConfigs)).Methods("OPTIONS", "GET")
+	admin.Handle("/configs/create", adminOnly(router.AdminCreateConfig)).Methods("OPTIONS", "POST")
+	admin.Handle("/configs/update", adminOnly(router.AdminUpdateConfig)).Methods("OPTIONS", "POST")
+	admin.Handle("/configs/active", adminOnly(router.AdminSetConfigActive)).Methods("OPTIONS", "POST")
+	admin.Handle("/configs/delete", adminOnly(router.AdminDeleteConfig)).Methods("OPTIONS", "POST")
+	admin.Handle("/templates", adminOnly(router.AdminTemplates)).Methods("OPTIONS", "GET")
+	admin.Handle("/templates/create", adminOnly(router.AdminCreateTemplate)).Methods("OPTIONS", "POST")
+	admin.Handle("/templates/update", adminOnly(router.AdminUpdateTemplate)).Methods("OPTIONS", "POST")
+	admin.Handle("/templates/active", adminOnly(router.AdminSetTemplateActive)).Methods("OPTIONS", "POST")
+	admin.Handle("/templates/delete", adminOnly(router.AdminDeleteTemplate)).Methods("OPTIONS", "POST")
+	admin.Handle("/catalog/proposals", adminOnly(router.AdminProposals)).Methods("OPTIONS", "GET")
+	admin.Handle("/catalog/proposals/review", adminOnly(router.AdminReviewProposal)).Methods("OPTIONS", "POST")
+	admin.Handle("/catalog/sync", adminOnly(router.AdminSyncCatalog)).Methods("OPTIONS", "POST")
+	admin.Handle("/quotas", adminOnly(router.AdminQuota)).Methods("OPTIONS", "GET")
+	admin.Handle("/quotas/update", adminOnly(router.AdminSetQuota)).Methods("OPTIONS", "POST")
+	admin.Handle("/quotas/reset", adminOnly(router.AdminResetQuota)).Methods("OPTIONS", "POST")
+	admin.Handle("/invites", adminOnly(router.AdminInvites)).Methods("OPTIONS", "GET")
+	admin.Handle("/invites/create", adminOnly(router.AdminCreateInvite)).Methods("OPTIONS", "POST")
+	admin.Handle("/invites/deactivate", adminOnly(router.AdminDeactivateInvite)).Methods("OPTIONS", "POST")
+	admin.Handle("/credit", adminOnly(router.AdminCredit)).Methods("OPTIONS", "POST")
+	admin.Handle("/servers/destroy", adminOnly(router.AdminDestroyServer)).Methods("OPTIONS", "POST")
 }
@@ -0,0 +1,135 @@
+// Package events streams changes to the users they concern. Postgres triggers
+// publish them with NOTIFY, so every replica's Bus sees changes made by any
+// replica or scanner, and hands them to its local subscribers.
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+
+	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/driver/pgdriver"
+)
+
+// Channel is the Postgres channel the triggers notify on.
+const Channel = "events"
+
+// Event is one change. Type is product, notification, purchase or deposit,
+// and Data holds the fields of the row that changed.
+type Event struct {
+	Type           string          `json:"type"`
+	UserID         int64           `json:"user_id"`
+	OrganizationID int64           `json:"organization_id,omitempty"`
+	Data           json.RawMessage `json:"data"`
+}
+
+// Subscription receives the events of a user and of the organizations they
+// are a member of, as last set by Subscribe or SetOrgs.
+type Subscription struct {
+	C <-chan Event
+
+	c      chan Event
+	userID int64
+	orgs   map[int64]bool
+}
+
+func (s *Subscription) wants(event Event) bool {
+	if event.OrganizationID != 0 {
+		return s.orgs[event.OrganizationID]
+	}
+	return event.UserID == s.userID
+}
+
+type Bus struct {
+	DB *bun.DB
+
+	mu          sync.Mutex
+	subscribers map[*Subscription]struct{}
+}
+
+func New(db *bun.DB) *Bus {
+	return &Bus{
+		DB:          db,
+		subscribers: map[*Subscription]struct{}{},
+	}
+}
+
+// Run listens for events and dispatches them until the process exits. The
+// listener reconnects by itself when the connection drops.
+func (b *Bus) Run() {
+	ctx := context.Background()
+	ln := pgdriver.NewListener(b.DB)
+	defer ln.Close()
+
+	err := ln.Listen(ctx, Channel)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for notification := range ln.Channel(pgdriver.WithChannelSize(1000)) {
+		var event Event
+		err := json.Unmarshal([]byte(notification.Payload), &event)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		b.dispatch(event)
+	}
+}
+
+// dispatch never blocks, a subscriber too slow to keep up misses events and
+// has to refetch.
+func (b *Bus) dispatch(event Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for s := range b.subscribers {
+		if !s.wants(event) {
+			continue
+		}
+		select {
+		case s.c <- event:
+		default:
+		}
+	}
+}
+
+func (b *Bus) Subscribe(userID int64, orgIDs []int64) *Subscription {
+	c := make(chan Event, 64)
+	s := &Subscription{
+		C:      c,
+		c:      c,
+		userID: userID,
+		orgs:   map[int64]bool{},
+	}
+	for _, orgID := range orgIDs {
+		s.orgs[orgID] = true
+	}
+
+	b.mu.Lock()
+	b.subscribers[s] = struct{}{}
+	b.mu.Unlock()
+	return s
+}
+
+// SetOrgs replaces the organizations s receives the events of, after the
+// user's memberships changed.
+func (b *Bus) SetOrgs(s *Subscription, orgIDs []int64) {
+	orgs := map[int64]bool{}
+	for _, orgID := range orgIDs {
+		orgs[orgID] = true
+	}
+
+	b.mu.Lock()
+	s.orgs = orgs
+	b.mu.Unlock()
+}
+
+func (b *Bus) Unsubscribe(s *Subscription) {
+	b.mu.Lock()
+	delete(b.subscribers, s)
+	b.mu.Unlock()
+}
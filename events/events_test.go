@@ -0,0 +1,35 @@
+package events
+
+import "testing"
+
+func TestSetOrgs(t *testing.T) {
+	b := New(nil)
+	s := b.Subscribe(1, []int64{10})
+	defer b.Unsubscribe(s)
+
+	received := func(event Event) bool {
+		b.dispatch(event)
+		select {
+		case <-s.C:
+			return true
+		default:
+			return false
+		}
+	}
+
+	if !received(Event{Type: "product", UserID: 2, OrganizationID: 10}) {
+		t.Error("missed an event of a member organization")
+	}
+
+	// Removed from 10, added to 20.
+	b.SetOrgs(s, []int64{20})
+	if received(Event{Type: "product", UserID: 2, OrganizationID: 10}) {
+		t.Error("received an event of a former organization")
+	}
+	if !received(Event{Type: "product", UserID: 2, OrganizationID: 20}) {
+		t.Error("missed an event of a new organization")
+	}
+	if !received(Event{Type: "notification", UserID: 1}) {
+		t.Error("missed a personal event")
+	}
+}
@@ -1,26 +1,85 @@
 package main
 
 import (
+	"log"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/joho/godotenv"
 
 	"gpu/app"
+	"gpu/util"
 )
 
 func main() {
 	godotenv.Load()
 
+	dev := os.Getenv("DEV") == "true"
+
+	// Without an SMTP server mail is only kept in memory, which is enough for
+	// development but would lose every verification and reset mail otherwise.
+	var mailer util.Mailer = &util.CaptureMailer{}
+	if host := os.Getenv("SMTP_HOST"); host != "" {
+		mailer = &util.SMTPMailer{
+			Host:     host,
+			Port:     os.Getenv("SMTP_PORT"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     os.Getenv("SMTP_FROM"),
+		}
+	} else if !dev {
+		log.Fatal("SMTP_HOST is required unless DEV=true")
+	}
+
+	// Signing keys rotate every JWT_ROTATION_DAYS, 30 by default.
+	keyRotation := 30 * 24 * time.Hour
+	if days, err := strconv.Atoi(os.Getenv("JWT_ROTATION_DAYS")); err == nil && days > 0 {
+		keyRotation = time.Duration(days) * 24 * time.Hour
+	}
+
+	encryptionKey, err := util.ParseEncryptionKey(os.Getenv("ENCRYPTION_KEY"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Tokens signed with JWT_SECRET before signing keys rotated are accepted
+	// until JWT_LEGACY_UNTIL (RFC 3339), by default until the first key is as
+	// old as the longest token lifetime.
+	var jwtLegacyUntil time.Time
+	if until := os.Getenv("JWT_LEGACY_UNTIL"); until != "" {
+		jwtLegacyUntil, err = time.Parse(time.RFC3339, until)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Client IPs are only taken from X-Forwarded-For set by these.
+	util.TrustedProxies, err = util.ParseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	a := app.App{}
 	a.Initialize(
 		os.Getenv("APP_DB_USERNAME"),
 		os.Getenv("APP_DB_PASSWORD"),
 		os.Getenv("APP_DB_NAME"),
 		os.Getenv("JWT_SECRET"),
+		jwtLegacyUntil,
+		os.Getenv("JWT_ALG"),
+		keyRotation,
 		os.Getenv("STRIPE_SECRET"),
 		os.Getenv("STRIPE_WEBHOOK"),
 		os.Getenv("GCP_COMPUTE_API_KEY"),
-		os.Getenv("DEV") == "true")
+		os.Getenv("APP_URL"),
+		os.Getenv("API_URL"),
+		os.Getenv("REGISTRATION_MODE"),
+		encryptionKey,
+		os.Getenv("CONTAINER_BASE_IMAGE"),
+		mailer,
+		util.LoadOAuthProviders(),
+		dev)
 
 	a.Run(":8080")
 }
@@ -0,0 +1,24 @@
+package model
+
+import (
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+type APIKey struct {
+	bun.BaseModel `bun:"table:api_keys"`
+
+	ID         int64     `bun:"id,pk,autoincrement" json:"id"`
+	Name       string    `bun:",notnull" json:"name"`
+	Prefix     string    `bun:",notnull,unique" json:"prefix"`
+	KeyHash    string    `bun:",notnull" json:"-"`
+	Scopes     []string  `bun:",array" json:"scopes"`
+	ExpiresAt  time.Time `bun:",nullzero" json:"expiresAt"`
+	LastUsedAt time.Time `bun:",nullzero" json:"lastUsedAt"`
+	Revoked    bool      `bun:"default:false" json:"revoked"`
+	CreatedAt  time.Time `bun:",nullzero,notnull,default:current_timestamp" json:"createdAt"`
+
+	UserID int64 `bun:",notnull" json:"-"`
+	User   *User `bun:"rel:belongs-to,join:user_id=id" json:"-"`
+}
@@ -0,0 +1,24 @@
+package model
+
+import (
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// AuditLog records security relevant actions. Rows are only ever inserted, a
+// trigger rejects updates and deletes.
+type AuditLog struct {
+	bun.BaseModel `bun:"table:audit_logs"`
+
+	ID        int64     `bun:"id,pk,autoincrement" json:"id"`
+	ActorID   int64     `bun:",nullzero" json:"actor_id,omitempty"` // empty for anonymous requests
+	KeyID     int64     `bun:",nullzero" json:"key_id,omitempty"`   // set when the actor used an API key
+	UserID    int64     `bun:",nullzero" json:"user_id,omitempty"`  // account the action concerns
+	Action    string    `bun:",notnull" json:"action"`
+	Target    string    `bun:"target" json:"target"` // e.g. product:<gcp_id>, key:<id>
+	IP        string    `bun:"ip" json:"ip"`
+	UserAgent string    `bun:"user_agent" json:"user_agent"`
+	Outcome   string    `bun:",notnull" json:"outcome"` // success or failure
+	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp" json:"createdAt"`
+}
@@ -0,0 +1,32 @@
+package model
+
+import (
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// ConfigProposal is a catalog change found by the provider sync. Nothing
+// changes until an admin approves it.
+type ConfigProposal struct {
+	bun.BaseModel `bun:"table:config_proposals"`
+
+	ID          int64     `bun:"id,pk,autoincrement" json:"id"`
+	Kind        string    `bun:",notnull" json:"kind"` // add or deactivate
+	Region      string    `bun:",notnull" json:"region"`
+	Zone        string    `bun:",notnull" json:"zone"`
+	MachineType string    `bun:",notnull" json:"machine_type"`
+	GPUType     string    `bun:"gpu_type" json:"gpu_type"`
+	GPUCount    int       `bun:"gpu_count" json:"gpu_count"`
+	GPUMemory   int       `bun:"gpu_memory" json:"gpu_memory"`
+	CPUs        int       `bun:"cpus" json:"cpus"`
+	Memory      int       `bun:"memory" json:"memory"`
+	Price       float64   `bun:",notnull" json:"price"`          // suggested, 0 when the GPU has no known cost
+	Status      string    `bun:",notnull" json:"status"`         // pending, approved or rejected
+	Reason      string    `bun:"reason" json:"reason,omitempty"` // why a config should be deactivated
+	CreatedAt   time.Time `bun:",nullzero,notnull,default:current_timestamp" json:"createdAt"`
+	ReviewedAt  time.Time `bun:",nullzero" json:"reviewed_at"`
+
+	ServerConfigID int64 `bun:",nullzero" json:"server_config_id,omitempty"` // config to deactivate, or the one an approved add created
+	ReviewedByID   int64 `bun:",nullzero" json:"reviewed_by_id,omitempty"`
+}
@@ -0,0 +1,25 @@
+package model
+
+import (
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// InviteCode admits new users while registration is invite-only. Event codes
+// are the same thing with a higher MaxUses.
+type InviteCode struct {
+	bun.BaseModel `bun:"table:invite_codes"`
+
+	ID        int64     `bun:"id,pk,autoincrement" json:"id"`
+	Code      string    `bun:",notnull,unique" json:"code"`
+	Note      string    `bun:"note" json:"note"`
+	Credit    float64   `bun:",notnull,default:0" json:"credit"`
+	MaxUses   int       `bun:",notnull,default:1" json:"max_uses"` // 0 is unlimited
+	Uses      int       `bun:",notnull,default:0" json:"uses"`
+	ExpiresAt time.Time `bun:",nullzero" json:"expiresAt"`
+	Active    bool      `bun:"default:true" json:"active"`
+	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp" json:"createdAt"`
+
+	CreatedByID int64 `bun:",notnull" json:"created_by_id"`
+}
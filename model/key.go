@@ -0,0 +1,22 @@
+package model
+
+import (
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// JWTKey is a token signing key pair. The newest unretired key signs, every
+// unexpired key still verifies, so tokens outlive a rotation.
+type JWTKey struct {
+	bun.BaseModel `bun:"table:jwt_keys"`
+
+	ID         int64     `bun:"id,pk,autoincrement"`
+	KID        string    `bun:"kid,notnull,unique"`
+	Alg        string    `bun:",notnull"`
+	PrivateKey string    `bun:",notnull"` // PKCS #8 PEM, AES-GCM encrypted when ENCRYPTION_KEY is set
+	PublicKey  string    `bun:",notnull"` // PKIX PEM
+	RetiredAt  time.Time `bun:",nullzero"`
+	ExpiresAt  time.Time `bun:",nullzero"`
+	CreatedAt  time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+}
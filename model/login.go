@@ -0,0 +1,21 @@
+package model
+
+import (
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+type LoginAttempt struct {
+	bun.BaseModel `bun:"table:login_attempts"`
+
+	ID        int64     `bun:"id,pk,autoincrement" json:"id"`
+	Username  string    `bun:",notnull" json:"username"`
+	IP        string    `bun:"ip,notnull" json:"ip"`
+	Success   bool      `bun:",notnull" json:"success"`
+	Reason    string    `bun:"reason" json:"reason"` // password, totp, locked, throttled, disabled, password_reset
+	UserAgent string    `bun:"user_agent" json:"user_agent"`
+	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp" json:"createdAt"`
+
+	UserID int64 `bun:",nullzero" json:"user_id,omitempty"`
+}
@@ -0,0 +1,36 @@
+package model
+
+import (
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// Identity links an account at an external OAuth/OIDC provider to a user.
+type Identity struct {
+	bun.BaseModel `bun:"table:identities"`
+
+	ID        int64     `bun:"id,pk,autoincrement" json:"id"`
+	Provider  string    `bun:",notnull,unique:provider_subject" json:"provider"`
+	Subject   string    `bun:",notnull,unique:provider_subject" json:"subject"`
+	Email     string    `bun:"email" json:"email"`
+	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp" json:"createdAt"`
+
+	UserID int64 `bun:",notnull" json:"-"`
+	User   *User `bun:"rel:belongs-to,join:user_id=id" json:"-"`
+}
+
+// OAuthState tracks a sign-in between redirecting to a provider and its
+// callback. LinkUserID is set when a signed in user is linking a provider.
+type OAuthState struct {
+	bun.BaseModel `bun:"table:oauth_states"`
+
+	ID         int64     `bun:"id,pk,autoincrement"`
+	StateHash  string    `bun:",notnull,unique"`
+	Verifier   string    `bun:",notnull"`
+	Provider   string    `bun:",notnull"`
+	LinkUserID int64     `bun:",nullzero"`
+	InviteCode string    `bun:"invite_code"`
+	ExpiresAt  time.Time `bun:",notnull"`
+	CreatedAt  time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+}
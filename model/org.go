@@ -0,0 +1,47 @@
+package model
+
+import (
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+type Organization struct {
+	bun.BaseModel `bun:"table:organizations"`
+
+	ID        int64     `bun:"id,pk,autoincrement" json:"id"`
+	Name      string    `bun:",notnull" json:"name"`
+	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp" json:"createdAt"`
+
+	Memberships []*Membership `bun:"rel:has-many,join:id=organization_id" json:"-"`
+}
+
+type Membership struct {
+	bun.BaseModel `bun:"table:memberships"`
+
+	ID            int64     `bun:"id,pk,autoincrement" json:"id"`
+	Role          string    `bun:",notnull" json:"role"`                     // owner, admin, member, billing
+	SpendingLimit float64   `bun:",notnull,default:0" json:"spending_limit"` // per calendar month, 0 is unlimited
+	CreatedAt     time.Time `bun:",nullzero,notnull,default:current_timestamp" json:"createdAt"`
+
+	OrganizationID int64         `bun:",notnull,unique:membership" json:"organization_id"`
+	Organization   *Organization `bun:"rel:belongs-to,join:organization_id=id" json:"organization,omitempty"`
+	UserID         int64         `bun:",notnull,unique:membership" json:"user_id"`
+	User           *User         `bun:"rel:belongs-to,join:user_id=id" json:"-"`
+}
+
+type Invitation struct {
+	bun.BaseModel `bun:"table:invitations"`
+
+	ID            int64     `bun:"id,pk,autoincrement" json:"id"`
+	Role          string    `bun:",notnull" json:"role"`
+	SpendingLimit float64   `bun:",notnull,default:0" json:"spending_limit"`
+	Status        string    `bun:",notnull" json:"status"` // pending, accepted, declined
+	ExpiresAt     time.Time `bun:",notnull" json:"expiresAt"`
+	CreatedAt     time.Time `bun:",nullzero,notnull,default:current_timestamp" json:"createdAt"`
+
+	OrganizationID int64         `bun:",notnull" json:"organization_id"`
+	Organization   *Organization `bun:"rel:belongs-to,join:organization_id=id" json:"organization,omitempty"`
+	UserID         int64         `bun:",notnull" json:"user_id"`
+	InvitedByID    int64         `bun:",notnull" json:"invited_by_id"`
+}
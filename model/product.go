@@ -11,7 +11,7 @@ type Product struct {
 
 	ID          int64     `bun:"id,pk,autoincrement" json:"id"`
 	Price       float64   `bun:",notnull" json:"price"`
-	Status      string    `bun:",notnull" json:"status"` // active, stopped, destroyed
+	Status      string    `bun:",notnull" json:"status"` // reserved, spinning, building, active, stopping, stopped, starting, destroying, destroyed, failed
 	DNSLink     string    `bun:"dns_link" json:"dns_link"`
 	GCPID       string    `bun:"gcp_id" json:"gcp_id"`
 	Credentials string    `bun:"credentials" json:"credentials"`
@@ -24,6 +24,19 @@ type Product struct {
 	ServerConfig   *ServerConfig `bun:"rel:belongs-to,join:server_config_id=id"`
 	TemplateID     int64         `bun:",notnull"`
 	Template       *Template     `bun:"rel:belongs-to,join:template_id=id"`
+	OrganizationID int64         `bun:",nullzero" json:"organization_id,omitempty"`
+
+	Params map[string]string `bun:"params,type:jsonb" json:"params,omitempty"` // launch params, secrets left out
+
+	// Lifetime policy. Past ExpiresAt, or IdleMinutes after the last busy
+	// heartbeat, the server is stopped or destroyed per ExpiryAction.
+	ExpiresAt      time.Time `bun:",nullzero" json:"expiresAt"`
+	IdleMinutes    int       `bun:"idle_minutes" json:"idle_minutes"` // 0 never
+	ExpiryAction   string    `bun:",notnull,default:'destroy'" json:"expiry_action"` // destroy or stop
+	LastActiveAt   time.Time `bun:",nullzero" json:"lastActiveAt"`
+	HeartbeatHash  string    `bun:"heartbeat_hash" json:"-"`
+	ExpiryWarnedAt time.Time `bun:",nullzero" json:"-"`
+	IdleWarnedAt   time.Time `bun:",nullzero" json:"-"`
 }
 
 type ServerConfig struct {
@@ -37,6 +50,14 @@ type ServerConfig struct {
 	Price    float64 `bun:",notnull" json:"price"`
     MachineType string `bun:",notnull" json:"machine_type"`
     Active bool `bun:"default:true" json:"active"`
+
+	GPUMemory  int `bun:"gpu_memory" json:"gpu_memory"`   // GB of VRAM per GPU
+	CPUs       int `bun:"cpus" json:"cpus"`               // vCPUs
+	Memory     int `bun:"memory" json:"memory"`           // GB of RAM
+	MaxStorage int `bun:"max_storage" json:"max_storage"` // GB of disk, 0 for no limit
+
+	Availability          string    `bun:",notnull,default:'unknown'" json:"availability"` // available, limited, unavailable or unknown
+	AvailabilityCheckedAt time.Time `bun:",nullzero" json:"availability_checked_at"`
 }
 
 type Template struct {
@@ -48,4 +69,34 @@ type Template struct {
 	Description string `json:"description"`
 	Type        string `json:"type"` // image generation, text generation
     Active bool `bun:"default:true" json:"active"`
+
+	Params []TemplateParam `bun:"params,type:jsonb" json:"params"`
+
+	// Hardware a launch needs. Configs that don't meet it are rejected.
+	MinStorage   int      `bun:",notnull,default:100" json:"min_storage"` // GB of disk
+	MinGPUMemory int      `bun:"min_gpu_memory" json:"min_gpu_memory"`    // GB of VRAM per GPU
+	MinGPUCount  int      `bun:"min_gpu_count" json:"min_gpu_count"`
+	GPUTypes     []string `bun:"gpu_types,array" json:"gpu_types"` // empty allows any
+
+	// Templates without an owner are the public catalog. Owned ones are only
+	// visible to their owner, and to the organization's members when shared.
+	Kind             string `bun:",notnull,default:'machine_image'" json:"kind"` // machine_image or container
+	OwnerID          int64  `bun:",nullzero" json:"owner_id,omitempty"`
+	OrganizationID   int64  `bun:",nullzero" json:"organization_id,omitempty"`
+	RegistryUsername string `bun:"registry_username" json:"registry_username,omitempty"`
+	RegistryPassword string `bun:"registry_password" json:"-"` // AES-GCM encrypted
+}
+
+// TemplateParam is a setting chosen at launch. It reaches the instance as a
+// metadata entry named after the param, which the image exports as an env var.
+type TemplateParam struct {
+	Name        string   `json:"name"` // e.g. MODEL_NAME
+	Description string   `json:"description,omitempty"`
+	Type        string   `json:"type"` // string, int, bool, port, enum or secret
+	Default     string   `json:"default,omitempty"`
+	Required    bool     `json:"required,omitempty"`
+	Pattern     string   `json:"pattern,omitempty"` // regexp string and secret values must match
+	Min         *int     `json:"min,omitempty"`
+	Max         *int     `json:"max,omitempty"`
+	Options     []string `json:"options,omitempty"` // allowed enum values
 }
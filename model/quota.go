@@ -0,0 +1,37 @@
+package model
+
+import (
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// Unlimited is the limit that caps nothing. 0 is a real limit, it refuses
+// every launch it applies to.
+const Unlimited = -1
+
+// QuotaLimits caps what one account, a user's personal account or an
+// organization, may hold at once.
+type QuotaLimits struct {
+	MaxProducts       int            `json:"max_products"`         // servers that aren't destroyed
+	MaxGPUs           map[string]int `json:"max_gpus"`             // by GPU type, "*" caps all types together
+	MaxStorage        int            `json:"max_storage"`          // GB across servers
+	MaxLaunchesPerDay int            `json:"max_launches_per_day"` // in the last 24 hours
+}
+
+// Quota is an admin override of the default limits for one account. Null
+// fields, and GPU types missing from MaxGPUs, keep the default. Limits are
+// Unlimited or at least 0.
+type Quota struct {
+	bun.BaseModel `bun:"table:quotas"`
+
+	ID                int64          `bun:"id,pk,autoincrement" json:"id"`
+	UserID            int64          `bun:",nullzero,unique" json:"user_id,omitempty"`
+	OrganizationID    int64          `bun:",nullzero,unique" json:"organization_id,omitempty"`
+	MaxProducts       *int           `bun:"max_products" json:"max_products"`
+	MaxGPUs           map[string]int `bun:"max_gpus,type:jsonb" json:"max_gpus"`
+	MaxStorage        *int           `bun:"max_storage" json:"max_storage"`
+	MaxLaunchesPerDay *int           `bun:"max_launches_per_day" json:"max_launches_per_day"`
+	UpdatedAt         time.Time      `bun:",nullzero,notnull,default:current_timestamp" json:"updatedAt"`
+	UpdatedByID       int64          `bun:",notnull" json:"updated_by_id"`
+}
@@ -0,0 +1,29 @@
+package model
+
+import (
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// Reservation books a server for a future window. Its product is created when
+// booking with status reserved, and the whole window is charged up front
+// instead of by the hour.
+type Reservation struct {
+	bun.BaseModel `bun:"table:reservations"`
+
+	ID        int64     `bun:"id,pk,autoincrement" json:"id"`
+	StartsAt  time.Time `bun:",notnull" json:"startsAt"`
+	EndsAt    time.Time `bun:",notnull" json:"endsAt"`
+	EndAction string    `bun:",notnull" json:"end_action"` // destroy or stop
+	Status    string    `bun:",notnull" json:"status"`     // scheduled, provisioning, active, ended, cancelled, failed
+	Amount    float64   `bun:",notnull" json:"amount"`     // charged for the window
+	Secrets   string    `bun:"secrets" json:"-"`           // AES-GCM encrypted JSON of secret params
+	ClaimedAt time.Time `bun:",nullzero" json:"-"`         // when the scheduler started provisioning it
+	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp" json:"createdAt"`
+
+	UserID         int64    `bun:",notnull" json:"user_id"`
+	OrganizationID int64    `bun:",nullzero" json:"organization_id,omitempty"`
+	ProductID      int64    `bun:",notnull" json:"product_id"`
+	Product        *Product `bun:"rel:belongs-to,join:product_id=id" json:"product,omitempty"`
+}
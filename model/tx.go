@@ -14,8 +14,9 @@ type Deposit struct {
 	Status    string    `bun:",notnull" json:"status"`
 	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp" json:"createdAt"`
 
-	UserID int64 `bun:",notnull"`
-	User   *User `bun:"rel:belongs-to,join:user_id=id"`
+	UserID         int64 `bun:",notnull"`
+	User           *User `bun:"rel:belongs-to,join:user_id=id"`
+	OrganizationID int64 `bun:",nullzero" json:"organization_id,omitempty"`
 }
 
 type Purchase struct {
@@ -26,8 +27,9 @@ type Purchase struct {
     Status    string    `bun:"default:'complete',notnull" json:"status"`
 	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp" json:"createdAt"`
 
-	UserID    int64    `bun:",notnull"`
-	User      *User    `bun:"rel:belongs-to,join:user_id=id"`
-	ProductID int64    `bun:",notnull"`
-	Product   *Product `bun:"rel:belongs-to,join:product_id=id"`
+	UserID         int64    `bun:",notnull"`
+	User           *User    `bun:"rel:belongs-to,join:user_id=id"`
+	ProductID      int64    `bun:",notnull"`
+	Product        *Product `bun:"rel:belongs-to,join:product_id=id"`
+	OrganizationID int64    `bun:",nullzero" json:"organization_id,omitempty"`
 }
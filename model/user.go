@@ -9,13 +9,20 @@ import (
 type User struct {
 	bun.BaseModel `bun:"table:users"`
 
-	ID           int64     `bun:"id,pk,autoincrement"`
-	Username     string    `bun:",notnull"`
-	PasswordHash string    `bun:",notnull"`
-	Active       bool      `bun:"default:true"`
-	Admin        bool      `bun:"default:false"`
-	SSHKey       string    `bun:"ssh_key"`
-	CreatedAt    time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+	ID            int64     `bun:"id,pk,autoincrement"`
+	Username      string    `bun:",notnull"`
+	PasswordHash  string    `bun:",notnull"`
+	Email         string    `bun:",unique,nullzero"`
+	EmailVerified bool      `bun:"default:false"`
+	TOTPSecret    string    `bun:"totp_secret"`
+	TOTPEnabled   bool      `bun:"totp_enabled,default:false"`
+	TOTPLastStep  int64     `bun:"totp_last_step,default:0"`
+	LockedUntil   time.Time `bun:",nullzero"`
+	InviteCodeID  int64     `bun:",nullzero"`
+	Active        bool      `bun:"default:true"`
+	Admin         bool      `bun:"default:false"`
+	SSHKey        string    `bun:"ssh_key"`
+	CreatedAt     time.Time `bun:",nullzero,notnull,default:current_timestamp"`
 
 	Deposits      []*Deposit      `bun:"rel:has-many,join:id=user_id"`
 	Purchases     []*Purchase     `bun:"rel:has-many,join:id=user_id"`
@@ -26,11 +33,43 @@ type User struct {
 type Notification struct {
 	bun.BaseModel `bun:"table:notifications"`
 
-	ID        int64     `bun:"id,pk,autoincrement" json:"id"`
-	Title     string    `json:"title"`
-	Body      string    `json:"body"`
-	Read      bool      `bun:"default:false" json:"read"`
-	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp" json:"createdAt"`
+	ID         int64     `bun:"id,pk,autoincrement" json:"id"`
+	Kind       string    `json:"kind"` // e.g. server.ready, see the notify package
+	Title      string    `json:"title"`
+	Body       string    `json:"body"`
+	Read       bool      `bun:"default:false" json:"read"`
+	DedupKey   string    `bun:",nullzero" json:"-"` // unique per user, repeats of an event are dropped
+	CreatedAt  time.Time `bun:",nullzero,notnull,default:current_timestamp" json:"createdAt"`
+	ArchivedAt time.Time `bun:",nullzero" json:"archivedAt"` // hidden from the inbox and unread count
+
+	UserID int64 `bun:",notnull"`
+	User   *User `bun:"rel:belongs-to,join:user_id=id"`
+}
+
+// UserToken is a single-use token mailed to a user, such as an email
+// verification or password reset link. Only its hash is stored.
+type UserToken struct {
+	bun.BaseModel `bun:"table:user_tokens"`
+
+	ID        int64     `bun:"id,pk,autoincrement"`
+	Kind      string    `bun:",notnull"` // verify_email, reset_password
+	TokenHash string    `bun:",notnull,unique"`
+	Email     string    `bun:",notnull"`
+	ExpiresAt time.Time `bun:",notnull"`
+	UsedAt    time.Time `bun:",nullzero"`
+	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+
+	UserID int64 `bun:",notnull"`
+	User   *User `bun:"rel:belongs-to,join:user_id=id"`
+}
+
+type RecoveryCode struct {
+	bun.BaseModel `bun:"table:recovery_codes"`
+
+	ID        int64     `bun:"id,pk,autoincrement"`
+	CodeHash  string    `bun:",notnull"`
+	UsedAt    time.Time `bun:",nullzero"`
+	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
 
 	UserID int64 `bun:",notnull"`
 	User   *User `bun:"rel:belongs-to,join:user_id=id"`
@@ -0,0 +1,43 @@
+package model
+
+import (
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// Webhook is an endpoint a user registered to be sent their notifications as
+// signed JSON, for the kinds listed in Events.
+type Webhook struct {
+	bun.BaseModel `bun:"table:webhooks"`
+
+	ID        int64     `bun:"id,pk,autoincrement" json:"id"`
+	URL       string    `bun:"url,notnull" json:"url"`
+	Events    []string  `bun:",array" json:"events"` // notification kinds, e.g. server.ready
+	Secret    string    `bun:",notnull" json:"-"`    // AES-GCM encrypted signing secret
+	Active    bool      `bun:"default:true" json:"active"`
+	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp" json:"createdAt"`
+
+	UserID int64 `bun:",notnull" json:"-"`
+	User   *User `bun:"rel:belongs-to,join:user_id=id" json:"-"`
+}
+
+// WebhookDelivery is one event sent to a webhook, retried with backoff until
+// the endpoint answers 2xx or it runs out of attempts.
+type WebhookDelivery struct {
+	bun.BaseModel `bun:"table:webhook_deliveries"`
+
+	ID            int64     `bun:"id,pk,autoincrement" json:"id"`
+	Event         string    `bun:",notnull" json:"event"`
+	Payload       string    `bun:",notnull" json:"payload"` // the exact JSON body that was signed
+	Status        string    `bun:",notnull" json:"status"`  // pending, delivered or failed
+	Attempts      int       `bun:",notnull" json:"attempts"`
+	NextAttemptAt time.Time `bun:",nullzero" json:"nextAttemptAt"`
+	ResponseCode  int       `bun:"response_code" json:"response_code"` // of the last attempt, 0 when there was no response
+	Error         string    `bun:"error" json:"error"`
+	CreatedAt     time.Time `bun:",nullzero,notnull,default:current_timestamp" json:"createdAt"`
+	DeliveredAt   time.Time `bun:",nullzero" json:"deliveredAt"`
+
+	WebhookID int64    `bun:",notnull" json:"webhook_id"`
+	Webhook   *Webhook `bun:"rel:belongs-to,join:webhook_id=id" json:"-"`
+}
@@ -0,0 +1,232 @@
+// Package notify leaves users notifications about their servers, billing and
+// admin actions, and emails the ones worth an email.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"text/template"
+	"time"
+
+	"github.com/uptrace/bun"
+
+	"gpu/model"
+	"gpu/util"
+)
+
+// kind is the message for one kind of event. Events with the same subject are
+// only delivered once every window, or once ever when window is 0.
+type kind struct {
+	title  *template.Template
+	body   *template.Template
+	email  bool
+	window time.Duration
+}
+
+func newKind(title, body string, email bool, window time.Duration) kind {
+	return kind{
+		title:  template.Must(template.New("title").Parse(title)),
+		body:   template.Must(template.New("body").Parse(body)),
+		email:  email,
+		window: window,
+	}
+}
+
+var kinds = map[string]kind{
+	"server.ready":         newKind("Server ready", "Your server {{.server}} is running at {{.link}}.", true, 0),
+	"server.failed":        newKind("Server failed to launch", "Your server {{.server}} could not be launched on {{.config}}, try another config.", true, 0),
+	"server.resume_failed": newKind("Server failed to start", "Your server {{.server}} could not be started again and is still stopped. Try again later.", true, 0),
+	"server.destroyed":     newKind("Server destroyed", "Your server {{.server}} was destroyed.", false, 0),
+	"server.expiring":      newKind("Server expiring soon", "Your server {{.server}} reaches its time limit at {{.at}} and will be {{.action}}. Extend its TTL to keep it.", true, 0),
+	"server.idle":          newKind("Idle server", "Your server {{.server}} has been idle and will be {{.action}} in {{.minutes}} minutes unless its GPUs get busy.", true, 0),
+	"server.ended":         newKind("Server {{.action}}", "Your server {{.server}} {{.reason}} and was {{.action}}.", true, 0),
+
+	"reservation.failed": newKind("Reservation failed", "Your reservation for {{.server}} could not be launched. The {{.amount}} it cost was refunded.", true, 0),
+
+	"balance.low":      newKind("Low balance", "Your {{.account}} balance is down to {{.balance}}, less than a day of your running servers.", true, 24*time.Hour),
+	"charge.failed":    newKind("Charge failed", "Your {{.account}} balance of {{.balance}} could not cover the hourly charge for {{.server}}. Add funds to keep it running.", true, 24*time.Hour),
+	"deposit.received": newKind("Funds added", "{{.amount}} was added to your {{.account}} balance.", true, 0),
+
+	"admin.server.destroyed": newKind("Server destroyed by an admin", "An admin destroyed your server {{.server}}.", true, 0),
+	"admin.disabled":         newKind("Account disabled", "Your account was disabled by an admin.", true, 0),
+	"admin.enabled":          newKind("Account enabled", "Your account was enabled again by an admin.", true, 0),
+	"admin.quota":            newKind("Quota changed", "An admin changed the quota of your {{.account}} account.", false, 0),
+}
+
+// Known reports whether kindName is a kind of notification, and so an event
+// webhooks can subscribe to.
+func Known(kindName string) bool {
+	_, ok := kinds[kindName]
+	return ok
+}
+
+// Kinds lists every kind of notification.
+func Kinds() []string {
+	names := []string{}
+	for name := range kinds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Notifier delivers notifications. Failures are only logged, they never fail
+// whatever caused the event.
+type Notifier struct {
+	DB     *bun.DB
+	Mailer util.Mailer
+}
+
+func New(db *bun.DB, mailer util.Mailer) *Notifier {
+	return &Notifier{
+		DB:     db,
+		Mailer: mailer,
+	}
+}
+
+// Money formats an amount the way notifications show it.
+func Money(amount float64) string {
+	return fmt.Sprintf("$%.2f", amount)
+}
+
+// User notifies uid of an event of kindName about subject, such as
+// "product:<gcp_id>". data fills in the message.
+func (n *Notifier) User(ctx context.Context, uid int64, kindName, subject string, data map[string]interface{}) {
+	k, ok := kinds[kindName]
+	if !ok {
+		log.Printf("Unknown notification %s\n", kindName)
+		return
+	}
+
+	var title, body bytes.Buffer
+	err := k.title.Execute(&title, data)
+	if err == nil {
+		err = k.body.Execute(&body, data)
+	}
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	notification := model.Notification{
+		UserID: uid,
+		Kind:   kindName,
+		Title:  title.String(),
+		Body:   body.String(),
+	}
+	if subject != "" {
+		notification.DedupKey = kindName + "|" + subject
+		if k.window > 0 {
+			notification.DedupKey += fmt.Sprintf("|%d", time.Now().Unix()/int64(k.window.Seconds()))
+		}
+	}
+	result, err := n.DB.NewInsert().Model(&notification).On("CONFLICT (user_id, dedup_key) DO NOTHING").Exec(ctx)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return
+	}
+	n.webhooks(ctx, &notification, data)
+	if !k.email {
+		return
+	}
+
+	user := model.User{
+		ID: uid,
+	}
+	err = n.DB.NewSelect().Model(&user).WherePK().Scan(ctx)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if user.Email != "" && user.EmailVerified {
+		err = n.Mailer.Send(user.Email, notification.Title, fmt.Sprintf("Hi %s,\n\n%s\n", user.Username, notification.Body))
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// Account notifies whoever looks after an account: uid for a personal one, or
+// the owners, admins and billing members of an organization. data gets the
+// account's name as "account".
+func (n *Notifier) Account(ctx context.Context, uid, orgID int64, kindName, subject string, data map[string]interface{}) {
+	if orgID == 0 {
+		data["account"] = "personal"
+		n.User(ctx, uid, kindName, subject, data)
+		return
+	}
+
+	var memberships []*model.Membership
+	err := n.DB.NewSelect().Model(&memberships).Where("membership.organization_id = ?", orgID).
+		Where("membership.role IN ('owner', 'admin', 'billing')").Relation("Organization").Scan(ctx)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, membership := range memberships {
+		data["account"] = membership.Organization.Name
+		n.User(ctx, membership.UserID, kindName, subject, data)
+	}
+}
+
+// Event is the JSON body webhooks are sent.
+type Event struct {
+	Event          string                 `json:"event"`
+	NotificationID int64                  `json:"notification_id,omitempty"`
+	Title          string                 `json:"title"`
+	Body           string                 `json:"body"`
+	Data           map[string]interface{} `json:"data"`
+	CreatedAt      time.Time              `json:"created_at"`
+}
+
+// webhooks queues a delivery of notification to each active webhook of its
+// user subscribed to its kind. The webhook scanner sends them.
+func (n *Notifier) webhooks(ctx context.Context, notification *model.Notification, data map[string]interface{}) {
+	var webhooks []*model.Webhook
+	err := n.DB.NewSelect().Model(&webhooks).Where("user_id = ?", notification.UserID).
+		Where("active = true").Where("? = ANY(events)", notification.Kind).Scan(ctx)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	event := Event{
+		Event:          notification.Kind,
+		NotificationID: notification.ID,
+		Title:          notification.Title,
+		Body:           notification.Body,
+		Data:           data,
+		CreatedAt:      time.Now().UTC(),
+	}
+	for _, webhook := range webhooks {
+		_, err := Enqueue(ctx, n.DB, webhook, event)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// Enqueue queues event for webhook, to be sent as soon as the scanner runs.
+func Enqueue(ctx context.Context, db bun.IDB, webhook *model.Webhook, event Event) (*model.WebhookDelivery, error) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+
+	delivery := &model.WebhookDelivery{
+		Event:         event.Event,
+		Payload:       string(payload),
+		Status:        "pending",
+		NextAttemptAt: time.Now(),
+		WebhookID:     webhook.ID,
+	}
+	_, err = db.NewInsert().Model(delivery).Exec(ctx)
+	return delivery, err
+}
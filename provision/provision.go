@@ -0,0 +1,245 @@
+// Package provision boots and tears down the instances behind products. Both
+// the API and the reservation scheduler launch servers through it.
+package provision
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/uptrace/bun"
+
+	"gpu/model"
+	"gpu/notify"
+	"gpu/util"
+)
+
+// BootSpec returns the machine image an instance of template boots from, its
+// startup script and metadata. Containers run on containerBase, with registry
+// credentials decrypted with encryptionKey.
+func BootSpec(template *model.Template, params map[string]string, containerBase string, encryptionKey []byte) (string, string, map[string]string, error) {
+	if template.Kind != "container" {
+		return template.Container, "", params, nil
+	}
+	if containerBase == "" {
+		return "", "", nil, fmt.Errorf("No CONTAINER_BASE_IMAGE for template %d", template.ID)
+	}
+
+	metadata := map[string]string{}
+	names := []string{}
+	for name, value := range params {
+		metadata[name] = value
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	login := template.RegistryPassword != ""
+	if login {
+		password, err := util.Decrypt(encryptionKey, template.RegistryPassword)
+		if err != nil {
+			return "", "", nil, err
+		}
+		metadata["registry-username"] = template.RegistryUsername
+		metadata["registry-password"] = password
+	}
+
+	return containerBase, util.ContainerStartupScript(template.Container, login, names), metadata, nil
+}
+
+// Heartbeat adds where and with which token the instance reports heartbeats
+// to metadata, and returns the hash of the token to store on the product.
+func Heartbeat(metadata map[string]string, apiURL string) (map[string]string, string, error) {
+	token, hash, err := util.GenerateToken()
+	if err != nil {
+		return nil, "", err
+	}
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+	metadata["heartbeat-url"] = strings.TrimSuffix(apiURL, "/") + "/servers/heartbeat"
+	metadata["heartbeat-token"] = token
+	return metadata, hash, nil
+}
+
+// Launch creates the instance of a product that is already saved and moves it
+// to active, or failed when the provider refuses. It blocks until then, and
+// notifies the launcher either way.
+func Launch(db *bun.DB, notifier *notify.Notifier, product *model.Product, config *model.ServerConfig, sourceImage, script string, metadata map[string]string) {
+	ctx := context.Background()
+
+	err := util.CreateInstance("siggpu", config.Zone, product.GCPID, config.MachineType, sourceImage, config.Region, script,
+		config.GPUType, int32(config.GPUCount), int64(product.Storage), metadata)
+	if err != nil {
+		// Saved so the availability prober sees the zone is out of capacity.
+		log.Println(err)
+		product.Status = "failed"
+	} else {
+		product.Status = "building"
+		ip, err := util.GetInstanceIP("siggpu", config.Zone, product.GCPID)
+		if err != nil {
+			log.Println(err)
+		}
+		product.DNSLink = fmt.Sprintf("http://%s", ip)
+	}
+
+	_, err = db.NewUpdate().Model(product).Where("gcp_id = ?", product.GCPID).Exec(ctx)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if product.Status == "building" {
+		time.Sleep(10)
+		product.Status = "active"
+		_, err = db.NewUpdate().Model(product).Where("gcp_id = ?", product.GCPID).Exec(ctx)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+	}
+
+	subject := "product:" + product.GCPID
+	if product.Status == "failed" {
+		notifier.User(ctx, product.UserID, "server.failed", subject, map[string]interface{}{
+			"server": product.GCPID,
+			"config": fmt.Sprintf("%dx %s in %s", config.GPUCount, config.GPUType, config.Zone),
+		})
+	} else {
+		notifier.User(ctx, product.UserID, "server.ready", subject, map[string]interface{}{
+			"server": product.GCPID,
+			"link":   product.DNSLink,
+		})
+	}
+}
+
+// ErrInvalidStatus is returned when a product can't make a transition from
+// its current status, such as destroying it twice.
+var ErrInvalidStatus = errors.New("Invalid server status")
+
+// Transition moves product to status if it is in one of from, in a single
+// UPDATE so concurrent requests can't both make it.
+func Transition(ctx context.Context, db bun.IDB, product *model.Product, status string, from ...string) error {
+	result, err := db.NewUpdate().Model((*model.Product)(nil)).Set("status = ?", status).
+		Where("id = ?", product.ID).Where("status IN (?)", bun.In(from)).Exec(ctx)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrInvalidStatus
+	}
+	product.Status = status
+	return nil
+}
+
+// Destroy marks a running or stopped product as destroying and tears down its
+// instance in the background, notifying the launcher once it is gone, or
+// marking it failed if the provider refuses. notifier is nil when the caller
+// tells the launcher itself. product must be loaded with its ServerConfig.
+func Destroy(db *bun.DB, notifier *notify.Notifier, product *model.Product) error {
+	ctx := context.Background()
+
+	err := Transition(ctx, db, product, "destroying", "spinning", "building", "active", "stopped")
+	if err != nil {
+		return err
+	}
+
+	zone, gcpID, userID := product.ServerConfig.Zone, product.GCPID, product.UserID
+	go func() {
+		status := "destroyed"
+		err := util.DeleteInstance("siggpu", zone, gcpID)
+		if err != nil {
+			log.Println(err)
+			status = "failed"
+		}
+
+		_, err = db.NewUpdate().Model((*model.Product)(nil)).Set("status = ?", status).Where("gcp_id = ?", gcpID).Exec(ctx)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		if status == "destroyed" && notifier != nil {
+			notifier.User(ctx, userID, "server.destroyed", "product:"+gcpID, map[string]interface{}{
+				"server": gcpID,
+			})
+		}
+	}()
+	return nil
+}
+
+// Stop marks an active product as stopping and shuts down its instance in the
+// background, keeping its disk. It is active again if the provider refuses.
+// product must be loaded with its ServerConfig.
+func Stop(db *bun.DB, product *model.Product) error {
+	ctx := context.Background()
+
+	err := Transition(ctx, db, product, "stopping", "active")
+	if err != nil {
+		return err
+	}
+
+	zone, gcpID := product.ServerConfig.Zone, product.GCPID
+	go func() {
+		status := "stopped"
+		err := util.StopInstance("siggpu", zone, gcpID)
+		if err != nil {
+			log.Println(err)
+			status = "active"
+		}
+
+		// Unless it was destroyed meanwhile.
+		_, err = db.NewUpdate().Model((*model.Product)(nil)).Set("status = ?", status).
+			Where("gcp_id = ?", gcpID).Where("status = 'stopping'").Exec(ctx)
+		if err != nil {
+			log.Println(err)
+		}
+	}()
+	return nil
+}
+
+// Start boots the instance of a product already moved to starting, and blocks
+// until it is active with its new address, or stopped again when the provider
+// refuses. It resets the idle timer, and notifies the launcher either way.
+// product must be loaded with its ServerConfig.
+func Start(db *bun.DB, notifier *notify.Notifier, product *model.Product) {
+	ctx := context.Background()
+	config := product.ServerConfig
+	// Every start is notified, not just the first launch.
+	subject := fmt.Sprintf("product:%s|%d", product.GCPID, time.Now().Unix())
+
+	err := util.StartInstance("siggpu", config.Zone, product.GCPID)
+	if err != nil {
+		log.Println(err)
+		_, err = db.NewUpdate().Model((*model.Product)(nil)).Set("status = 'stopped'").
+			Where("id = ?", product.ID).Where("status = 'starting'").Exec(ctx)
+		if err != nil {
+			log.Println(err)
+		}
+		notifier.User(ctx, product.UserID, "server.resume_failed", subject, map[string]interface{}{
+			"server": product.GCPID,
+		})
+		return
+	}
+
+	// A stopped instance comes back with a new ephemeral address.
+	ip, err := util.GetInstanceIP("siggpu", config.Zone, product.GCPID)
+	if err != nil {
+		log.Println(err)
+	}
+	product.DNSLink = fmt.Sprintf("http://%s", ip)
+	_, err = db.NewUpdate().Model((*model.Product)(nil)).Set("status = 'active'").Set("dns_link = ?", product.DNSLink).
+		Set("last_active_at = current_timestamp").Set("idle_warned_at = NULL").
+		Where("id = ?", product.ID).Where("status = 'starting'").Exec(ctx)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	notifier.User(ctx, product.UserID, "server.ready", subject, map[string]interface{}{
+		"server": product.GCPID,
+		"link":   product.DNSLink,
+	})
+}
@@ -0,0 +1,484 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gpu/model"
+	"gpu/notify"
+	"gpu/provision"
+	"gpu/util"
+)
+
+type AdminUser struct {
+	ID        int64     `json:"id"`
+	Username  string    `json:"username"`
+	Active    bool      `json:"active"`
+	Admin     bool      `json:"admin"`
+	Balance   float64   `json:"balance"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type AdminUsersRes struct {
+	Success bool         `json:"success"`
+	Users   []*AdminUser `json:"users"`
+	Total   int          `json:"total"`
+}
+
+func (router *Router) AdminUsers(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	limit, offset := pageParams(r)
+
+	users := []model.User{}
+	query := router.DB.NewSelect().Model(&users).OrderExpr("id ASC").Limit(limit).Offset(offset)
+	if q := r.URL.Query().Get("q"); q != "" {
+		query = query.Where("username ILIKE ?", "%"+likeEscaper.Replace(q)+"%")
+	}
+	total, err := query.ScanAndCount(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+
+	res := AdminUsersRes{
+		Users:   []*AdminUser{},
+		Total:   total,
+		Success: true,
+	}
+	for _, u := range users {
+		balance, err := util.Balance(ctx, router.DB, u.ID, 0)
+		if err != nil {
+			util.ResError(err, w, http.StatusBadRequest, "Database error.")
+			return
+		}
+
+		res.Users = append(res.Users, &AdminUser{
+			ID:        u.ID,
+			Username:  u.Username,
+			Active:    u.Active,
+			Admin:     u.Admin,
+			Balance:   balance,
+			CreatedAt: u.CreatedAt,
+		})
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+func userParam(r *http.Request) (int64, error) {
+	return strconv.ParseInt(r.URL.Query().Get("user_id"), 10, 64)
+}
+
+func (router *Router) AdminUserProducts(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	uid, err := userParam(r)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid user.")
+		return
+	}
+
+	products := []*model.Product{}
+	err = router.DB.NewSelect().Model(&products).Where("product.user_id = ?", uid).Relation("ServerConfig").OrderExpr("product.created_at DESC").Scan(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+
+	res := ProductsRes{
+		Products: products,
+		Success:  true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+func (router *Router) AdminUserLedger(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	uid, err := userParam(r)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid user.")
+		return
+	}
+
+	deposits := []*model.Deposit{}
+	err = router.DB.NewSelect().Model(&deposits).Where("user_id = ?", uid).OrderExpr("created_at DESC").Scan(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+	purchases := []*model.Purchase{}
+	err = router.DB.NewSelect().Model(&purchases).Where("user_id = ?", uid).OrderExpr("created_at DESC").Scan(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+
+	res := TransactionsRes{
+		Deposits:  deposits,
+		Purchases: purchases,
+		Success:   true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+type AdminSetActiveReq struct {
+	UserID int64 `json:"user_id"`
+	Active bool  `json:"active"`
+}
+
+type AdminRes struct {
+	Success bool `json:"success"`
+}
+
+func (router *Router) AdminSetActive(w http.ResponseWriter, r *http.Request) {
+	var req AdminSetActiveReq
+	ctx := context.Background()
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to decode input.")
+		return
+	}
+
+	result, err := router.DB.NewUpdate().Model((*model.User)(nil)).Set("active = ?", req.Active).Where("id = ?", req.UserID).Exec(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid user.")
+		return
+	}
+	if req.Active {
+		router.audit(r, req.UserID, "admin.enable", auditTarget("user", req.UserID), true)
+		router.Notifier.User(ctx, req.UserID, "admin.enabled", "", nil)
+	} else {
+		router.audit(r, req.UserID, "admin.disable", auditTarget("user", req.UserID), true)
+		router.Notifier.User(ctx, req.UserID, "admin.disabled", "", nil)
+	}
+
+	res := AdminRes{
+		Success: true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+type AdminUnlockReq struct {
+	UserID int64 `json:"user_id"`
+}
+
+func (router *Router) AdminUnlock(w http.ResponseWriter, r *http.Request) {
+	var req AdminUnlockReq
+	ctx := context.Background()
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to decode input.")
+		return
+	}
+
+	result, err := router.DB.NewUpdate().Model((*model.User)(nil)).Set("locked_until = NULL").Where("id = ?", req.UserID).Exec(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid user.")
+		return
+	}
+	router.audit(r, req.UserID, "admin.unlock", auditTarget("user", req.UserID), true)
+
+	res := AdminRes{
+		Success: true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+type AdminLoginAttemptsRes struct {
+	Success  bool                  `json:"success"`
+	Attempts []*model.LoginAttempt `json:"attempts"`
+	Total    int                   `json:"total"`
+}
+
+func (router *Router) AdminLoginAttempts(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	limit, offset := pageParams(r)
+	query := r.URL.Query()
+
+	attempts := []*model.LoginAttempt{}
+	q := router.DB.NewSelect().Model(&attempts).OrderExpr("created_at DESC").Limit(limit).Offset(offset)
+	if username := query.Get("username"); username != "" {
+		q = q.Where("username = ?", username)
+	}
+	if ip := query.Get("ip"); ip != "" {
+		q = q.Where("ip = ?", ip)
+	}
+	if query.Get("failed") == "true" {
+		q = q.Where("success = false")
+	}
+	total, err := q.ScanAndCount(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+
+	res := AdminLoginAttemptsRes{
+		Attempts: attempts,
+		Total:    total,
+		Success:  true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+type AdminCreditReq struct {
+	UserID         int64   `json:"user_id"`
+	OrganizationID int64   `json:"organization_id"` // credits the organization instead, user_id is recorded as recipient
+	Amount         float64 `json:"amount"`
+}
+
+func (router *Router) AdminCredit(w http.ResponseWriter, r *http.Request) {
+	var req AdminCreditReq
+	ctx := context.Background()
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to decode input.")
+		return
+	}
+
+	if req.Amount <= 0 {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid amount.")
+		return
+	}
+
+	exists, err := router.DB.NewSelect().Model((*model.User)(nil)).Where("id = ?", req.UserID).Exists(ctx)
+	if err != nil || !exists {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid user.")
+		return
+	}
+	if req.OrganizationID != 0 {
+		// The user is recorded as who received the credit, so they must belong
+		// to the organization.
+		exists, err := router.DB.NewSelect().Model((*model.Membership)(nil)).
+			Where("organization_id = ?", req.OrganizationID).Where("user_id = ?", req.UserID).Exists(ctx)
+		if err != nil || !exists {
+			util.ResError(err, w, http.StatusBadRequest, "Invalid organization.")
+			return
+		}
+	}
+
+	deposit := model.Deposit{
+		Amount:         req.Amount,
+		Status:         "credit",
+		UserID:         req.UserID,
+		OrganizationID: req.OrganizationID,
+	}
+	_, err = router.DB.NewInsert().Model(&deposit).Exec(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+	router.audit(r, req.UserID, "credit", auditTarget("deposit", deposit.ID), true)
+	router.Notifier.Account(ctx, req.UserID, req.OrganizationID, "deposit.received", auditTarget("deposit", deposit.ID), map[string]interface{}{
+		"amount": notify.Money(req.Amount),
+	})
+
+	res := AdminRes{
+		Success: true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+func (router *Router) AdminDestroyServer(w http.ResponseWriter, r *http.Request) {
+	var req KillServerReq
+	ctx := context.Background()
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to decode input.")
+		return
+	}
+
+	product := new(model.Product)
+	err = router.DB.NewSelect().Model(product).Where("gcp_id = ?", req.GCPId).Relation("ServerConfig").Scan(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid product.")
+		return
+	}
+	if product.Status == "reserved" {
+		util.ResError(nil, w, http.StatusBadRequest, "Cancel the reservation instead.")
+		return
+	}
+
+	err = provision.Destroy(router.DB, router.Notifier, product)
+	if errors.Is(err, provision.ErrInvalidStatus) {
+		util.ResError(err, w, http.StatusBadRequest, "Server can't be destroyed now.")
+		return
+	}
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+	router.audit(r, product.UserID, "admin.server.destroy", "product:"+product.GCPID, true)
+	router.Notifier.User(ctx, product.UserID, "admin.server.destroyed", "product:"+product.GCPID, map[string]interface{}{
+		"server": product.GCPID,
+	})
+
+	res := AdminRes{
+		Success: true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+type AdminInvitesRes struct {
+	Success bool                `json:"success"`
+	Invites []*model.InviteCode `json:"invites"`
+	Total   int                 `json:"total"`
+}
+
+func (router *Router) AdminInvites(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	limit, offset := pageParams(r)
+
+	invites := []*model.InviteCode{}
+	total, err := router.DB.NewSelect().Model(&invites).OrderExpr("created_at DESC").Limit(limit).Offset(offset).ScanAndCount(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+
+	res := AdminInvitesRes{
+		Invites: invites,
+		Total:   total,
+		Success: true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+type AdminCreateInviteReq struct {
+	Code      string  `json:"code"` // generated when empty
+	Note      string  `json:"note"`
+	Credit    float64 `json:"credit"`
+	MaxUses   *int    `json:"max_uses"`        // 1 when absent, an explicit 0 is unlimited
+	ExpiresIn int     `json:"expires_in_days"` // 0 never expires
+}
+
+type AdminCreateInviteRes struct {
+	Success bool              `json:"success"`
+	Invite  *model.InviteCode `json:"invite"`
+}
+
+var inviteCodePattern = regexp.MustCompile(`^[A-Z0-9-]{4,32}$`)
+
+func (router *Router) AdminCreateInvite(w http.ResponseWriter, r *http.Request) {
+	var req AdminCreateInviteReq
+	ctx := context.Background()
+	uid := principal(r).UserID
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to decode input.")
+		return
+	}
+
+	maxUses := 1
+	if req.MaxUses != nil {
+		maxUses = *req.MaxUses
+	}
+	if req.Credit < 0 || maxUses < 0 || req.ExpiresIn < 0 {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid invite.")
+		return
+	}
+
+	code := strings.ToUpper(strings.TrimSpace(req.Code))
+	if code == "" {
+		code, err = util.GenerateInviteCode()
+		if err != nil {
+			util.ResError(err, w, http.StatusBadRequest, "Failed to generate code.")
+			return
+		}
+	}
+	if !inviteCodePattern.MatchString(code) {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid code.")
+		return
+	}
+
+	invite := model.InviteCode{
+		Code:        code,
+		Note:        req.Note,
+		Credit:      req.Credit,
+		MaxUses:     maxUses,
+		Active:      true,
+		CreatedByID: uid,
+	}
+	if req.ExpiresIn > 0 {
+		invite.ExpiresAt = time.Now().Add(time.Duration(req.ExpiresIn) * 24 * time.Hour)
+	}
+	// bun would write the column's DEFAULT of 1 for an explicit 0.
+	_, err = router.DB.NewInsert().Model(&invite).Value("max_uses", "?", maxUses).Exec(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Code already exists.")
+		return
+	}
+	router.audit(r, uid, "invite.create", auditTarget("invite", invite.ID), true)
+
+	res := AdminCreateInviteRes{
+		Invite:  &invite,
+		Success: true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+type AdminDeactivateInviteReq struct {
+	ID int64 `json:"id"`
+}
+
+func (router *Router) AdminDeactivateInvite(w http.ResponseWriter, r *http.Request) {
+	var req AdminDeactivateInviteReq
+	ctx := context.Background()
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to decode input.")
+		return
+	}
+
+	result, err := router.DB.NewUpdate().Model((*model.InviteCode)(nil)).Set("active = false").Where("id = ?", req.ID).Exec(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid invite.")
+		return
+	}
+	router.audit(r, principal(r).UserID, "invite.deactivate", auditTarget("invite", req.ID), true)
+
+	res := AdminRes{
+		Success: true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
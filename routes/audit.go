@@ -0,0 +1,122 @@
+package routes
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/uptrace/bun"
+
+	"gpu/model"
+	"gpu/util"
+)
+
+// audit appends an entry for an action on uid's account. The actor is the
+// authenticated caller, or uid itself on public endpoints such as /login.
+// Failing to write is logged rather than failing the action.
+func (router *Router) audit(r *http.Request, uid int64, action, target string, success bool) {
+	entry := model.AuditLog{
+		ActorID:   uid,
+		UserID:    uid,
+		Action:    action,
+		Target:    target,
+		IP:        util.ClientIP(r),
+		UserAgent: r.UserAgent(),
+		Outcome:   "failure",
+	}
+	if p := principal(r); p != nil {
+		entry.ActorID = p.UserID
+		entry.KeyID = p.KeyID
+	}
+	if success {
+		entry.Outcome = "success"
+	}
+
+	_, err := router.DB.NewInsert().Model(&entry).Exec(context.Background())
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func auditTarget(kind string, id int64) string {
+	return kind + ":" + strconv.FormatInt(id, 10)
+}
+
+type AuditRes struct {
+	Success bool              `json:"success"`
+	Entries []*model.AuditLog `json:"entries"`
+	Total   int               `json:"total"`
+}
+
+// Audit lists what happened on the caller's account, and what they did elsewhere.
+func (router *Router) Audit(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	uid := principal(r).UserID
+	limit, offset := pageParams(r)
+
+	entries := []*model.AuditLog{}
+	q := router.DB.NewSelect().Model(&entries).Where("user_id = ? OR actor_id = ?", uid, uid).OrderExpr("created_at DESC").Limit(limit).Offset(offset)
+	if action := r.URL.Query().Get("action"); action != "" {
+		q = q.Where("action = ?", action)
+	}
+	total, err := q.ScanAndCount(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+
+	// Where others, such as admins, acted on the account, where they acted
+	// from is theirs.
+	for _, entry := range entries {
+		if entry.ActorID != uid {
+			entry.IP = ""
+			entry.UserAgent = ""
+		}
+	}
+
+	res := AuditRes{
+		Entries: entries,
+		Total:   total,
+		Success: true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+func (router *Router) AdminAudit(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	limit, offset := pageParams(r)
+	query := r.URL.Query()
+
+	entries := []*model.AuditLog{}
+	q := router.DB.NewSelect().Model(&entries).OrderExpr("created_at DESC").Limit(limit).Offset(offset)
+	for _, column := range []string{"user_id", "actor_id", "key_id"} {
+		if value := query.Get(column); value != "" {
+			id, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				util.ResError(err, w, http.StatusBadRequest, "Invalid "+column+".")
+				return
+			}
+			q = q.Where("? = ?", bun.Ident(column), id)
+		}
+	}
+	for _, column := range []string{"action", "target", "ip", "outcome"} {
+		if value := query.Get(column); value != "" {
+			q = q.Where("? = ?", bun.Ident(column), value)
+		}
+	}
+	total, err := q.ScanAndCount(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+
+	res := AuditRes{
+		Entries: entries,
+		Total:   total,
+		Success: true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
@@ -3,16 +3,24 @@ package routes
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
 	"regexp"
+	"strings"
+	"time"
+
+	"github.com/uptrace/bun"
 
 	"gpu/model"
 	"gpu/util"
 )
 
 type RegisterReq struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	Email      string `json:"email"`
+	InviteCode string `json:"invite_code"`
 }
 
 type RegisterRes struct {
@@ -29,10 +37,55 @@ func validUsername(username string) bool {
 	return len(username) > 3 && len(username) < 20 && regexp.MustCompile(`^[a-zA-Z0-9]*$`).MatchString(username)
 }
 
-func (router *Router) Register(w http.ResponseWriter, r *http.Request) {
-    util.ResError(nil, w, http.StatusBadRequest, "Registration disabled for BrickHack")
-    return
+var (
+	errRegistrationClosed = errors.New("Registration is closed.")
+	errInvalidInvite      = errors.New("Invalid invite code.")
+)
+
+// registerUser inserts a new user. Depending on the registration mode (open,
+// invite or closed) an invite code may be required; when one is given it is
+// redeemed and any credit it carries is deposited.
+func (router *Router) registerUser(ctx context.Context, tx bun.Tx, user *model.User, inviteCode string) error {
+	switch router.RegistrationMode {
+	case "open":
+	case "invite":
+		if inviteCode == "" {
+			return errInvalidInvite
+		}
+	default:
+		return errRegistrationClosed
+	}
 
+	invite := new(model.InviteCode)
+	if inviteCode != "" {
+		err := tx.NewUpdate().Model(invite).Set("uses = uses + 1").
+			Where("code = ?", strings.ToUpper(strings.TrimSpace(inviteCode))).Where("active = true").
+			Where("max_uses = 0 OR uses < max_uses").Where("expires_at IS NULL OR expires_at > current_timestamp").
+			Returning("*").Scan(ctx)
+		if err != nil {
+			log.Println(err)
+			return errInvalidInvite
+		}
+		user.InviteCodeID = invite.ID
+	}
+
+	_, err := tx.NewInsert().Model(user).Exec(ctx)
+	if err != nil {
+		return err
+	}
+
+	if invite.Credit > 0 {
+		deposit := model.Deposit{
+			Amount: invite.Credit,
+			Status: "credit",
+			UserID: user.ID,
+		}
+		_, err = tx.NewInsert().Model(&deposit).Exec(ctx)
+	}
+	return err
+}
+
+func (router *Router) Register(w http.ResponseWriter, r *http.Request) {
 	var req RegisterReq
 	ctx := context.Background()
 
@@ -43,6 +96,11 @@ func (router *Router) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if router.RegistrationMode != "open" && router.RegistrationMode != "invite" {
+		util.ResError(errRegistrationClosed, w, http.StatusBadRequest, errRegistrationClosed.Error())
+		return
+	}
+
 	if !validPassword(req.Password) {
 		util.ResError(err, w, http.StatusBadRequest, "Invalid password.")
 		return
@@ -53,6 +111,12 @@ func (router *Router) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	req.Email = normalizeEmail(req.Email)
+	if !validEmail(req.Email) {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid email.")
+		return
+	}
+
 	exists, err := router.DB.NewSelect().Model((*model.User)(nil)).Where("username = ?", req.Username).Exists(ctx)
 	if err != nil {
 		util.ResError(err, w, http.StatusBadRequest, "Database error.")
@@ -63,6 +127,16 @@ func (router *Router) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	exists, err = router.DB.NewSelect().Model((*model.User)(nil)).Where("email = ?", req.Email).Exists(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+	if exists {
+		util.ResError(err, w, http.StatusBadRequest, "Email already in use.")
+		return
+	}
+
 	hashed, err := util.HashPassword(req.Password)
 	if err != nil {
 		util.ResError(err, w, http.StatusBadRequest, "Invalid password.")
@@ -71,15 +145,31 @@ func (router *Router) Register(w http.ResponseWriter, r *http.Request) {
 	user := model.User{
 		Username:     req.Username,
 		PasswordHash: hashed,
+		Email:        req.Email,
+	}
+	err = router.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		return router.registerUser(ctx, tx, &user, req.InviteCode)
+	})
+	if errors.Is(err, errInvalidInvite) || errors.Is(err, errRegistrationClosed) {
+		util.ResError(err, w, http.StatusBadRequest, err.Error())
+		return
 	}
-	var id int64
-	err = router.DB.NewInsert().Model(&user).Returning("id").Scan(ctx, &id)
 	if err != nil {
 		util.ResError(err, w, http.StatusBadRequest, "Failed to register user.")
 		return
 	}
+	if user.InviteCodeID != 0 {
+		router.audit(r, user.ID, "register", auditTarget("invite", user.InviteCodeID), true)
+	} else {
+		router.audit(r, user.ID, "register", auditTarget("user", user.ID), true)
+	}
 
-	token, refresh, err := util.GenerateJWT(user.Username, id, false, router.JwtSecret)
+	err = router.sendVerification(ctx, &user)
+	if err != nil {
+		log.Println(err)
+	}
+
+	token, refresh, err := util.GenerateJWT(user.Username, user.ID, false, router.KeySet)
 	if err != nil {
 		util.ResError(err, w, http.StatusBadRequest, "Failed to generate token.")
 		return
@@ -102,6 +192,8 @@ type LoginReq struct {
 type LoginRes struct {
 	RefreshToken string `json:"refreshToken"`
 	Token        string `json:"token"`
+	Challenge    string `json:"challenge,omitempty"` // set instead of tokens when a 2FA code is needed
+	TwoFactor    bool   `json:"twoFactor,omitempty"`
 	Success      bool   `json:"success"`
 }
 
@@ -116,28 +208,66 @@ func (router *Router) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	retry, err := router.loginThrottled(ctx, req.Username, util.ClientIP(r))
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+	if retry > 0 {
+		router.recordLogin(ctx, r, req.Username, 0, false, "throttled")
+		tooManyAttempts(w, req.Username, retry)
+		return
+	}
+
 	u := new(model.User)
 	err = router.DB.NewSelect().Model(u).Where("username = ?", req.Username).Scan(ctx)
 	if err != nil {
-		util.ResError(err, w, http.StatusBadRequest, "Failed to get user.")
+		util.CheckPasswordHash(req.Password, dummyHash)
+		router.recordLogin(ctx, r, req.Username, 0, false, "password")
+		util.ResError(err, w, http.StatusBadRequest, "Invalid username or password.")
+		return
+	}
+
+	if u.LockedUntil.After(time.Now()) {
+		router.recordLogin(ctx, r, req.Username, u.ID, false, "locked")
+		tooManyAttempts(w, req.Username, time.Until(u.LockedUntil))
 		return
 	}
 
 	if !util.CheckPasswordHash(req.Password, u.PasswordHash) {
-		util.ResError(err, w, http.StatusBadRequest, "Invalid password.")
+		router.recordLogin(ctx, r, req.Username, u.ID, false, "password")
+		util.ResError(err, w, http.StatusBadRequest, "Invalid username or password.")
 		return
 	}
 
 	if !u.Active {
+		router.recordLogin(ctx, r, req.Username, u.ID, false, "disabled")
 		util.ResError(err, w, http.StatusBadRequest, "Disabled.")
 		return
 	}
 
-	token, refresh, err := util.GenerateJWT(u.Username, u.ID, u.Admin, router.JwtSecret)
+	// With 2FA the attempt is only recorded, and counters reset, once the code is checked.
+	if u.TOTPEnabled {
+		challenge, err := util.GenerateChallengeJWT(u.ID, router.KeySet)
+		if err != nil {
+			util.ResError(err, w, http.StatusBadRequest, "Failed to generate token.")
+			return
+		}
+
+		util.ResJSON(w, http.StatusOK, LoginRes{
+			Challenge: challenge,
+			TwoFactor: true,
+			Success:   true,
+		})
+		return
+	}
+
+	token, refresh, err := util.GenerateJWT(u.Username, u.ID, u.Admin, router.KeySet)
 	if err != nil {
 		util.ResError(err, w, http.StatusBadRequest, "Failed to generate token.")
 		return
 	}
+	router.recordLogin(ctx, r, req.Username, u.ID, true, "password")
 
 	res := LoginRes{
 		Token:        token,
@@ -167,7 +297,7 @@ func (router *Router) RefreshToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token, err := util.GenerateJWTFromRefreshToken(router.DB, router.JwtSecret, req.Token, context.Background())
+	token, err := util.GenerateJWTFromRefreshToken(router.DB, router.KeySet, req.Token, context.Background())
 	if err != nil {
 		util.ResError(err, w, http.StatusBadRequest, err.Error())
 		return
@@ -180,3 +310,10 @@ func (router *Router) RefreshToken(w http.ResponseWriter, r *http.Request) {
 
 	util.ResJSON(w, http.StatusOK, res)
 }
+
+// JWKS publishes the public keys tokens are verified with, so other services
+// can check our tokens without sharing a secret.
+func (router *Router) JWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	util.ResJSON(w, http.StatusOK, router.KeySet.JWKS())
+}
@@ -0,0 +1,679 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/uptrace/bun"
+
+	"gpu/model"
+	"gpu/scan"
+	"gpu/util"
+)
+
+var (
+	errInvalidProposal = errors.New("Invalid proposal.")
+	errProposalPrice   = errors.New("Set a price, this GPU has no known cost.")
+)
+
+// liveProducts reports whether any product that isn't destroyed uses the
+// config or template. Those still need their config to find and tear down
+// their instance, so its hardware can't change under them.
+func (router *Router) liveProducts(ctx context.Context, column string, id int64) (bool, error) {
+	return router.DB.NewSelect().Model((*model.Product)(nil)).Where("? = ?", bun.Ident(column), id).Where("status != 'destroyed'").Exists(ctx)
+}
+
+// anyProducts reports whether anything was ever launched from the config or template.
+func (router *Router) anyProducts(ctx context.Context, column string, id int64) (bool, error) {
+	return router.DB.NewSelect().Model((*model.Product)(nil)).Where("? = ?", bun.Ident(column), id).Exists(ctx)
+}
+
+type AdminConfigsRes struct {
+	Success       bool                  `json:"success"`
+	ServerConfigs []*model.ServerConfig `json:"server_configs"`
+}
+
+// AdminConfigs lists every config, including inactive ones hidden from /search.
+func (router *Router) AdminConfigs(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	configs := []*model.ServerConfig{}
+	err := router.DB.NewSelect().Model(&configs).OrderExpr("id ASC").Scan(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+
+	res := AdminConfigsRes{
+		ServerConfigs: configs,
+		Success:       true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+type AdminConfigReq struct {
+	ID          int64   `json:"id"` // ignored on create
+	Region      string  `json:"region"`
+	Zone        string  `json:"zone"`
+	MachineType string  `json:"machine_type"`
+	GPUType     string  `json:"gpu_type"`
+	GPUCount    int     `json:"gpu_count"`
+	Price       float64 `json:"price"`
+
+	// Specs templates are matched against, they can always change.
+	GPUMemory  int `json:"gpu_memory"` // GB per GPU, known GPUs are filled in when 0
+	CPUs       int `json:"cpus"`
+	Memory     int `json:"memory"`      // GB
+	MaxStorage int `json:"max_storage"` // GB, 0 for no limit
+}
+
+type AdminConfigRes struct {
+	Success      bool                `json:"success"`
+	ServerConfig *model.ServerConfig `json:"server_config"`
+}
+
+// validateConfig returns the message for an invalid config, or "" if it is
+// offered by the provider.
+func (router *Router) validateConfig(req *AdminConfigReq) (string, error) {
+	req.Region = strings.TrimSpace(req.Region)
+	req.Zone = strings.TrimSpace(req.Zone)
+	req.MachineType = strings.TrimSpace(req.MachineType)
+	req.GPUType = strings.TrimSpace(req.GPUType)
+
+	if req.Region == "" || !strings.HasPrefix(req.Zone, req.Region+"-") {
+		return "Invalid region or zone.", nil
+	}
+	if req.MachineType == "" {
+		return "Invalid machine type.", nil
+	}
+	if req.GPUCount < 0 || (req.GPUCount > 0) != (req.GPUType != "") {
+		return "Invalid GPU.", nil
+	}
+	if req.Price <= 0 {
+		return "Invalid price.", nil
+	}
+	if req.GPUMemory == 0 {
+		req.GPUMemory = util.GPUMemory(req.GPUType)
+	}
+	if req.GPUMemory < 0 || req.CPUs < 0 || req.Memory < 0 || req.MaxStorage < 0 {
+		return "Invalid specs.", nil
+	}
+	if req.MaxStorage > 0 && req.MaxStorage < minStorage {
+		return fmt.Sprintf("Configs must allow at least %dGB.", minStorage), nil
+	}
+
+	// Dev setups usually have no GCP credentials.
+	if router.Dev {
+		return "", nil
+	}
+	err := util.ValidateServerConfig("siggpu", req.Region, req.Zone, req.MachineType, req.GPUType, int32(req.GPUCount))
+	if err != nil {
+		return "Not offered by the provider: " + err.Error(), err
+	}
+	return "", nil
+}
+
+func (router *Router) AdminCreateConfig(w http.ResponseWriter, r *http.Request) {
+	var req AdminConfigReq
+	ctx := context.Background()
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to decode input.")
+		return
+	}
+
+	if msg, err := router.validateConfig(&req); msg != "" {
+		util.ResError(err, w, http.StatusBadRequest, msg)
+		return
+	}
+
+	config := model.ServerConfig{
+		Region:      req.Region,
+		Zone:        req.Zone,
+		MachineType: req.MachineType,
+		GPUType:     req.GPUType,
+		GPUCount:    req.GPUCount,
+		GPUMemory:   req.GPUMemory,
+		CPUs:        req.CPUs,
+		Memory:      req.Memory,
+		MaxStorage:  req.MaxStorage,
+		Price:       req.Price,
+		Active:      true,
+	}
+	_, err = router.DB.NewInsert().Model(&config).Exec(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+	router.audit(r, principal(r).UserID, "config.create", auditTarget("config", config.ID), true)
+
+	res := AdminConfigRes{
+		ServerConfig: &config,
+		Success:      true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+// AdminUpdateConfig can always change the price and specs, which only apply to
+// new launches. The hardware can only change while no product is running on it.
+func (router *Router) AdminUpdateConfig(w http.ResponseWriter, r *http.Request) {
+	var req AdminConfigReq
+	ctx := context.Background()
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to decode input.")
+		return
+	}
+
+	config := &model.ServerConfig{
+		ID: req.ID,
+	}
+	err = router.DB.NewSelect().Model(config).WherePK().Scan(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid config.")
+		return
+	}
+
+	if msg, err := router.validateConfig(&req); msg != "" {
+		util.ResError(err, w, http.StatusBadRequest, msg)
+		return
+	}
+
+	if req.Region != config.Region || req.Zone != config.Zone || req.MachineType != config.MachineType || req.GPUType != config.GPUType || req.GPUCount != config.GPUCount {
+		live, err := router.liveProducts(ctx, "server_config_id", config.ID)
+		if err != nil {
+			util.ResError(err, w, http.StatusBadRequest, "Database error.")
+			return
+		}
+		if live {
+			util.ResError(err, w, http.StatusBadRequest, "Servers are running on this config, only the price can change.")
+			return
+		}
+	}
+
+	config.Region = req.Region
+	config.Zone = req.Zone
+	config.MachineType = req.MachineType
+	config.GPUType = req.GPUType
+	config.GPUCount = req.GPUCount
+	config.GPUMemory = req.GPUMemory
+	config.CPUs = req.CPUs
+	config.Memory = req.Memory
+	config.MaxStorage = req.MaxStorage
+	config.Price = req.Price
+	_, err = router.DB.NewUpdate().Model(config).
+		Column("region", "zone", "machine_type", "gpu_type", "gpu_count", "gpu_memory", "cpus", "memory", "max_storage", "price").
+		WherePK().Exec(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+	router.audit(r, principal(r).UserID, "config.update", auditTarget("config", config.ID), true)
+
+	res := AdminConfigRes{
+		ServerConfig: config,
+		Success:      true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+type AdminCatalogActiveReq struct {
+	ID     int64 `json:"id"`
+	Active bool  `json:"active"`
+}
+
+// AdminSetConfigActive hides a config from new launches, or brings it back.
+// Running products are left alone.
+func (router *Router) AdminSetConfigActive(w http.ResponseWriter, r *http.Request) {
+	var req AdminCatalogActiveReq
+	ctx := context.Background()
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to decode input.")
+		return
+	}
+
+	result, err := router.DB.NewUpdate().Model((*model.ServerConfig)(nil)).Set("active = ?", req.Active).Where("id = ?", req.ID).Exec(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid config.")
+		return
+	}
+	if req.Active {
+		router.audit(r, principal(r).UserID, "config.activate", auditTarget("config", req.ID), true)
+	} else {
+		router.audit(r, principal(r).UserID, "config.deactivate", auditTarget("config", req.ID), true)
+	}
+
+	res := AdminRes{
+		Success: true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+type AdminCatalogDeleteReq struct {
+	ID int64 `json:"id"`
+}
+
+// AdminDeleteConfig only removes configs nothing was ever launched on, since
+// products and their purchases keep pointing at it. Deactivate it instead.
+func (router *Router) AdminDeleteConfig(w http.ResponseWriter, r *http.Request) {
+	var req AdminCatalogDeleteReq
+	ctx := context.Background()
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to decode input.")
+		return
+	}
+
+	used, err := router.anyProducts(ctx, "server_config_id", req.ID)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+	if used {
+		util.ResError(err, w, http.StatusBadRequest, "Config has been used, deactivate it instead.")
+		return
+	}
+
+	result, err := router.DB.NewDelete().Model((*model.ServerConfig)(nil)).Where("id = ?", req.ID).Exec(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid config.")
+		return
+	}
+	router.audit(r, principal(r).UserID, "config.delete", auditTarget("config", req.ID), true)
+
+	res := AdminRes{
+		Success: true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+type AdminTemplatesRes struct {
+	Success   bool              `json:"success"`
+	Templates []*model.Template `json:"templates"`
+}
+
+func (router *Router) AdminTemplates(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	templates := []*model.Template{}
+	err := router.DB.NewSelect().Model(&templates).OrderExpr("id ASC").Scan(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+
+	res := AdminTemplatesRes{
+		Templates: templates,
+		Success:   true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+type AdminTemplateReq struct {
+	ID          int64  `json:"id"` // ignored on create
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Type        string `json:"type"`
+	Container   string `json:"container"` // machine image instances boot from
+
+	Params []model.TemplateParam `json:"params"`
+	TemplateHardware
+}
+
+type AdminTemplateRes struct {
+	Success  bool            `json:"success"`
+	Template *model.Template `json:"template"`
+}
+
+func validTemplate(req *AdminTemplateReq) bool {
+	req.Name = strings.TrimSpace(req.Name)
+	req.Container = strings.TrimSpace(req.Container)
+	return req.Name != "" && len(req.Name) <= 64 && req.Container != ""
+}
+
+func (router *Router) AdminCreateTemplate(w http.ResponseWriter, r *http.Request) {
+	var req AdminTemplateReq
+	ctx := context.Background()
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to decode input.")
+		return
+	}
+
+	if !validTemplate(&req) {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid template.")
+		return
+	}
+	if err := util.ValidateParamSchema(req.Params); err != nil {
+		util.ResError(err, w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if msg := req.TemplateHardware.validate(); msg != "" {
+		util.ResError(nil, w, http.StatusBadRequest, msg)
+		return
+	}
+
+	template := model.Template{
+		Name:        req.Name,
+		Description: req.Description,
+		Type:        req.Type,
+		Container:   req.Container,
+		Params:      req.Params,
+		Active:      true,
+	}
+	req.TemplateHardware.apply(&template)
+	_, err = router.DB.NewInsert().Model(&template).Exec(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+	router.audit(r, principal(r).UserID, "template.create", auditTarget("template", template.ID), true)
+
+	res := AdminTemplateRes{
+		Template: &template,
+		Success:  true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+// AdminUpdateTemplate only affects new launches, running servers keep the
+// image they booted from.
+func (router *Router) AdminUpdateTemplate(w http.ResponseWriter, r *http.Request) {
+	var req AdminTemplateReq
+	ctx := context.Background()
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to decode input.")
+		return
+	}
+
+	if !validTemplate(&req) {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid template.")
+		return
+	}
+	if err := util.ValidateParamSchema(req.Params); err != nil {
+		util.ResError(err, w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if msg := req.TemplateHardware.validate(); msg != "" {
+		util.ResError(nil, w, http.StatusBadRequest, msg)
+		return
+	}
+
+	template := &model.Template{
+		ID:          req.ID,
+		Name:        req.Name,
+		Description: req.Description,
+		Type:        req.Type,
+		Container:   req.Container,
+		Params:      req.Params,
+	}
+	req.TemplateHardware.apply(template)
+	err = router.DB.NewUpdate().Model(template).
+		Column("name", "description", "type", "container", "params", "min_storage", "min_gpu_memory", "min_gpu_count", "gpu_types").
+		WherePK().Returning("*").Scan(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid template.")
+		return
+	}
+	router.audit(r, principal(r).UserID, "template.update", auditTarget("template", template.ID), true)
+
+	res := AdminTemplateRes{
+		Template: template,
+		Success:  true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+func (router *Router) AdminSetTemplateActive(w http.ResponseWriter, r *http.Request) {
+	var req AdminCatalogActiveReq
+	ctx := context.Background()
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to decode input.")
+		return
+	}
+
+	result, err := router.DB.NewUpdate().Model((*model.Template)(nil)).Set("active = ?", req.Active).Where("id = ?", req.ID).Exec(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid template.")
+		return
+	}
+	if req.Active {
+		router.audit(r, principal(r).UserID, "template.activate", auditTarget("template", req.ID), true)
+	} else {
+		router.audit(r, principal(r).UserID, "template.deactivate", auditTarget("template", req.ID), true)
+	}
+
+	res := AdminRes{
+		Success: true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+func (router *Router) AdminDeleteTemplate(w http.ResponseWriter, r *http.Request) {
+	var req AdminCatalogDeleteReq
+	ctx := context.Background()
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to decode input.")
+		return
+	}
+
+	used, err := router.anyProducts(ctx, "template_id", req.ID)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+	if used {
+		util.ResError(err, w, http.StatusBadRequest, "Template has been used, deactivate it instead.")
+		return
+	}
+
+	result, err := router.DB.NewDelete().Model((*model.Template)(nil)).Where("id = ?", req.ID).Exec(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid template.")
+		return
+	}
+	router.audit(r, principal(r).UserID, "template.delete", auditTarget("template", req.ID), true)
+
+	res := AdminRes{
+		Success: true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+type AdminProposalsRes struct {
+	Success   bool                    `json:"success"`
+	Proposals []*model.ConfigProposal `json:"proposals"`
+	Total     int                     `json:"total"`
+}
+
+// AdminProposals lists catalog sync proposals, pending ones unless status is given.
+func (router *Router) AdminProposals(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	limit, offset := pageParams(r)
+
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = "pending"
+	}
+
+	proposals := []*model.ConfigProposal{}
+	total, err := router.DB.NewSelect().Model(&proposals).Where("status = ?", status).OrderExpr("created_at DESC").Limit(limit).Offset(offset).ScanAndCount(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+
+	res := AdminProposalsRes{
+		Proposals: proposals,
+		Total:     total,
+		Success:   true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+type AdminSyncCatalogRes struct {
+	Success bool `json:"success"`
+	Filed   int  `json:"filed"`
+}
+
+// AdminSyncCatalog runs the daily provider sync now.
+func (router *Router) AdminSyncCatalog(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	filed, err := scan.SyncCatalog(ctx, router.DB)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Sync failed.")
+		return
+	}
+
+	res := AdminSyncCatalogRes{
+		Filed:   filed,
+		Success: true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+type AdminReviewProposalReq struct {
+	ID      int64   `json:"id"`
+	Approve bool    `json:"approve"`
+	Price   float64 `json:"price"` // overrides the suggested price of an add
+}
+
+type AdminReviewProposalRes struct {
+	Success  bool                  `json:"success"`
+	Proposal *model.ConfigProposal `json:"proposal"`
+}
+
+// AdminReviewProposal approves or rejects a pending proposal. Approving an
+// add creates an active config, approving a deactivate hides the config from
+// new launches like AdminSetConfigActive.
+func (router *Router) AdminReviewProposal(w http.ResponseWriter, r *http.Request) {
+	var req AdminReviewProposalReq
+	ctx := context.Background()
+	uid := principal(r).UserID
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to decode input.")
+		return
+	}
+
+	proposal := new(model.ConfigProposal)
+	err = router.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		err := tx.NewSelect().Model(proposal).Where("id = ?", req.ID).Where("status = 'pending'").For("UPDATE").Scan(ctx)
+		if err != nil {
+			return errInvalidProposal
+		}
+
+		proposal.Status = "rejected"
+		if req.Approve {
+			proposal.Status = "approved"
+			switch proposal.Kind {
+			case "add":
+				if req.Price > 0 {
+					proposal.Price = req.Price
+				}
+				if proposal.Price <= 0 {
+					return errProposalPrice
+				}
+				config := model.ServerConfig{
+					Region:      proposal.Region,
+					Zone:        proposal.Zone,
+					MachineType: proposal.MachineType,
+					GPUType:     proposal.GPUType,
+					GPUCount:    proposal.GPUCount,
+					GPUMemory:   proposal.GPUMemory,
+					CPUs:        proposal.CPUs,
+					Memory:      proposal.Memory,
+					Price:       proposal.Price,
+					Active:      true,
+				}
+				_, err = tx.NewInsert().Model(&config).Exec(ctx)
+				if err != nil {
+					return err
+				}
+				proposal.ServerConfigID = config.ID
+			case "deactivate":
+				_, err = tx.NewUpdate().Model((*model.ServerConfig)(nil)).Set("active = false").Where("id = ?", proposal.ServerConfigID).Exec(ctx)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		proposal.ReviewedAt = time.Now()
+		proposal.ReviewedByID = uid
+		_, err = tx.NewUpdate().Model(proposal).Column("status", "price", "server_config_id", "reviewed_at", "reviewed_by_id").WherePK().Exec(ctx)
+		return err
+	})
+	if errors.Is(err, errInvalidProposal) || errors.Is(err, errProposalPrice) {
+		util.ResError(err, w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+	router.audit(r, uid, "proposal."+proposal.Status, auditTarget("proposal", proposal.ID), true)
+
+	res := AdminReviewProposalRes{
+		Proposal: proposal,
+		Success:  true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
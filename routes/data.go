@@ -3,8 +3,10 @@ package routes
 import (
     "context"
     "net/http"
+    "strconv"
+    "strings"
 
-	"github.com/golang-jwt/jwt"
+    "github.com/uptrace/bun"
 
     "gpu/model"
     "gpu/util"
@@ -15,11 +17,18 @@ type TemplatesRes struct {
 	Templates []model.Template `json:"templates"`
 }
 
+// Templates lists the catalog along with the caller's own templates and those
+// shared with organizations they can launch servers in.
 func (router *Router) Templates(w http.ResponseWriter, r *http.Request) {
 	ctx := context.Background()
+	uid := principal(r).UserID
+
+	shared := router.DB.NewSelect().Model((*model.Membership)(nil)).Column("organization_id").
+		Where("user_id = ?", uid).Where("role IN (?)", bun.In([]string{"owner", "admin", "member"}))
 
 	templates := []model.Template{}
-	err := router.DB.NewSelect().Model(&templates).OrderExpr("active DESC").Scan(ctx)
+	err := router.DB.NewSelect().Model(&templates).Where("owner_id IS NULL OR owner_id = ? OR organization_id IN (?)", uid, shared).
+		OrderExpr("active DESC").OrderExpr("owner_id IS NULL").OrderExpr("id ASC").Scan(ctx)
 	if err != nil {
 		util.ResError(err, w, http.StatusBadRequest, "Database error.")
 		return
@@ -34,15 +43,120 @@ func (router *Router) Templates(w http.ResponseWriter, r *http.Request) {
 }
 
 type SearchRes struct {
-	Success   bool             `json:"success"`
-	ServerConfigs []model.ServerConfig`json:"server_configs"`
+	Success       bool                 `json:"success"`
+	ServerConfigs []model.ServerConfig `json:"server_configs"`
+	Total         int                  `json:"total"`
+}
+
+// searchSorts maps the sort parameter to an ORDER BY, a leading - sorts descending.
+var searchSorts = map[string]string{
+	"price":      "price ASC",
+	"-price":     "price DESC",
+	"gpu_count":  "gpu_count ASC",
+	"-gpu_count": "gpu_count DESC",
 }
 
+// searchCompatible narrows q to the configs template can launch on with its
+// minimum storage, like hardwareFits.
+func searchCompatible(q *bun.SelectQuery, template *model.Template) *bun.SelectQuery {
+	q = q.Where("gpu_count >= ?", template.MinGPUCount).
+		Where("COALESCE(gpu_memory, 0) >= ?", template.MinGPUMemory).
+		Where("COALESCE(max_storage, 0) = 0 OR max_storage >= ?", template.MinStorage)
+	if len(template.GPUTypes) > 0 {
+		q = q.Where("gpu_type IN (?)", bun.In(template.GPUTypes))
+	}
+	return q
+}
+
+// likeEscaper escapes the LIKE wildcards in user input, which is then
+// matched literally.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// Search filters the catalog by gpu_type, min_gpus, max_gpus, region, zone,
+// max_price and active=true, and sorts by sort. It returns the whole catalog
+// unless paged with limit and offset, as it did before paging existed. With
+// template_id it only returns configs that template can launch on.
 func (router *Router) Search(w http.ResponseWriter, r *http.Request) {
 	ctx := context.Background()
+	limit, offset := pageParams(r)
+	query := r.URL.Query()
 
 	serverConfigs := []model.ServerConfig{}
-	err := router.DB.NewSelect().Model(&serverConfigs).OrderExpr("active DESC").Scan(ctx)
+	q := router.DB.NewSelect().Model(&serverConfigs).Offset(offset)
+	if query.Get("limit") != "" {
+		q = q.Limit(limit)
+	}
+
+	if value := query.Get("template_id"); value != "" {
+		id, err := strconv.ParseInt(value, 10, 64)
+		template := &model.Template{
+			ID: id,
+		}
+		if err == nil {
+			err = router.DB.NewSelect().Model(template).WherePK().Scan(ctx)
+		}
+		if err == nil {
+			err = router.authorizeTemplate(ctx, principal(r), template, actionRead)
+		}
+		if err != nil {
+			util.ResError(err, w, http.StatusBadRequest, "Invalid template.")
+			return
+		}
+		q = searchCompatible(q, template)
+	}
+
+	if gpuType := query.Get("gpu_type"); gpuType != "" {
+		// Matches loosely, so a100 finds nvidia-tesla-a100 and nvidia-a100-80gb.
+		q = q.Where("gpu_type ILIKE ?", "%"+likeEscaper.Replace(gpuType)+"%")
+	}
+	if region := query.Get("region"); region != "" {
+		q = q.Where("region = ?", region)
+	}
+	if zone := query.Get("zone"); zone != "" {
+		q = q.Where("zone = ?", zone)
+	}
+	if query.Get("active") == "true" {
+		q = q.Where("active = true")
+	}
+	for _, filter := range []struct {
+		param string
+		where string
+	}{
+		{"min_gpus", "gpu_count >= ?"},
+		{"max_gpus", "gpu_count <= ?"},
+	} {
+		if value := query.Get(filter.param); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				util.ResError(err, w, http.StatusBadRequest, "Invalid "+filter.param+".")
+				return
+			}
+			q = q.Where(filter.where, n)
+		}
+	}
+	if value := query.Get("max_price"); value != "" {
+		maxPrice, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			util.ResError(err, w, http.StatusBadRequest, "Invalid max_price.")
+			return
+		}
+		q = q.Where("price <= ?", maxPrice)
+	}
+
+	if sort := query.Get("sort"); sort != "" {
+		order, ok := searchSorts[sort]
+		if !ok {
+			util.ResError(nil, w, http.StatusBadRequest, "Invalid sort.")
+			return
+		}
+		q = q.OrderExpr(order)
+	} else {
+		q = q.OrderExpr("active DESC")
+	}
+	// Keeps pages stable when the sort column ties.
+	q = q.OrderExpr("id ASC")
+
+	total, err := q.ScanAndCount(ctx)
 	if err != nil {
 		util.ResError(err, w, http.StatusBadRequest, "Database error.")
 		return
@@ -50,7 +164,8 @@ func (router *Router) Search(w http.ResponseWriter, r *http.Request) {
 
 	res := SearchRes{
 		ServerConfigs: serverConfigs,
-		Success:   true,
+		Total:         total,
+		Success:       true,
 	}
 
 	util.ResJSON(w, http.StatusOK, res)
@@ -66,10 +181,27 @@ type DataRes struct {
 
 func (router *Router) Data(w http.ResponseWriter, r *http.Request) {
 	ctx := context.Background()
-	props, _ := r.Context().Value("props").(jwt.MapClaims)
-	uid := int64(props["sub"].(float64))
+	p := principal(r)
+	uid := p.UserID
+
+	orgID, err := orgParam(r)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid organization.")
+		return
+	}
+	if orgID != 0 {
+		if _, err := router.authorizeOrg(ctx, p, orgID, validRole); err != nil {
+			util.ResError(err, w, http.StatusBadRequest, "Invalid organization.")
+			return
+		}
+	}
 
-	diskQuery := router.DB.NewSelect().Model((*model.Product)(nil)).ColumnExpr("COUNT(*) AS active").ColumnExpr("SUM(price) AS costs").ColumnExpr("SUM(storage) AS disk").Where("status = 'active'").Where("user_id = ?", uid)
+	diskQuery := router.DB.NewSelect().Model((*model.Product)(nil)).ColumnExpr("COUNT(*) AS active").ColumnExpr("COALESCE(SUM(price), 0) AS costs").ColumnExpr("COALESCE(SUM(storage), 0) AS disk").Where("status = 'active'")
+	if orgID != 0 {
+		diskQuery = diskQuery.Where("organization_id = ?", orgID)
+	} else {
+		diskQuery = diskQuery.Where("user_id = ?", uid).Where("organization_id IS NULL")
+	}
 	var costs float64
 	var disk int64
     var active int64
@@ -78,15 +210,8 @@ func (router *Router) Data(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	depositQuery := router.DB.NewSelect().Model((*model.Deposit)(nil)).ColumnExpr("SUM(amount) AS deposit_sum").Where("user_id = ?", uid)
-	var depositSum float64
-	if err := depositQuery.Scan(ctx, &depositSum); err != nil {
-		util.ResError(err, w, http.StatusBadRequest, "Database error.")
-		return
-	}
-	purchaseQuery := router.DB.NewSelect().Model((*model.Purchase)(nil)).ColumnExpr("SUM(amount) AS purchase_sum").Where("user_id = ?", uid)
-	var purchaseSum float64
-	if err := purchaseQuery.Scan(ctx, &purchaseSum); err != nil {
+	balance, err := util.Balance(ctx, router.DB, uid, orgID)
+	if err != nil {
 		util.ResError(err, w, http.StatusBadRequest, "Database error.")
 		return
 	}
@@ -96,7 +221,7 @@ func (router *Router) Data(w http.ResponseWriter, r *http.Request) {
         Disk: disk,
         Costs: costs,
         Active: active,
-        Balance: depositSum - purchaseSum,
+        Balance: balance,
 	}
 
 	util.ResJSON(w, http.StatusOK, res)
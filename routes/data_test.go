@@ -0,0 +1,17 @@
+package routes
+
+import "testing"
+
+func TestLikeEscaper(t *testing.T) {
+	tests := map[string]string{
+		"a100":    "a100",
+		"a100%":   `a100\%`,
+		"nvidia_": `nvidia\_`,
+		`a\b`:     `a\\b`,
+	}
+	for in, want := range tests {
+		if got := likeEscaper.Replace(in); got != want {
+			t.Errorf("likeEscaper.Replace(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
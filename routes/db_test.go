@@ -0,0 +1,80 @@
+package routes
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/dialect/pgdialect"
+	"github.com/uptrace/bun/driver/pgdriver"
+
+	"gpu/model"
+)
+
+// testDB returns a database in a schema of its own, dropped when the test
+// ends, on the Postgres at TEST_DATABASE_URL. Tests that need one are skipped
+// without it.
+func testDB(t *testing.T) *bun.DB {
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	ctx := context.Background()
+
+	schema := fmt.Sprintf("test_%d", time.Now().UnixNano())
+	admin := bun.NewDB(sql.OpenDB(pgdriver.NewConnector(pgdriver.WithDSN(dsn))), pgdialect.New())
+	_, err := admin.ExecContext(ctx, "CREATE SCHEMA ?", bun.Ident(schema))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := bun.NewDB(sql.OpenDB(pgdriver.NewConnector(pgdriver.WithDSN(dsn),
+		pgdriver.WithConnParams(map[string]interface{}{"search_path": schema}))), pgdialect.New())
+	t.Cleanup(func() {
+		db.Close()
+		admin.ExecContext(ctx, "DROP SCHEMA ? CASCADE", bun.Ident(schema))
+		admin.Close()
+	})
+
+	tables := []interface{}{
+		(*model.User)(nil),
+		(*model.Deposit)(nil),
+		(*model.Purchase)(nil),
+		(*model.Notification)(nil),
+		(*model.Product)(nil),
+		(*model.ServerConfig)(nil),
+		(*model.Template)(nil),
+		(*model.Organization)(nil),
+		(*model.Membership)(nil),
+		(*model.Reservation)(nil),
+		(*model.Identity)(nil),
+		(*model.OAuthState)(nil),
+		(*model.AuditLog)(nil),
+		(*model.APIKey)(nil),
+	}
+	for _, table := range tables {
+		_, err := db.NewCreateTable().Model(table).Exec(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+// testUser inserts an active user.
+func testUser(t *testing.T, db *bun.DB, username string) *model.User {
+	user := &model.User{
+		Username:     username,
+		PasswordHash: "x",
+		Active:       true,
+	}
+	_, err := db.NewInsert().Model(user).Exec(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
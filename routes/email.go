@@ -0,0 +1,347 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/uptrace/bun"
+
+	"gpu/model"
+	"gpu/util"
+)
+
+const (
+	verifyEmailTTL   = 48 * time.Hour
+	resetPasswordTTL = time.Hour
+	// resetPasswordGap is how long after a reset link no other is sent to the
+	// same account, so the endpoint can't be used to flood an inbox.
+	resetPasswordGap = 5 * time.Minute
+)
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func validEmail(email string) bool {
+	addr, err := mail.ParseAddress(email)
+	return err == nil && addr.Address == email && len(email) <= 254
+}
+
+// issueToken stores a new single-use token of kind for user and returns the
+// plaintext to mail out.
+func (router *Router) issueToken(ctx context.Context, db bun.IDB, kind string, user *model.User, ttl time.Duration) (string, error) {
+	token, hash, err := util.GenerateToken()
+	if err != nil {
+		return "", err
+	}
+
+	userToken := model.UserToken{
+		Kind:      kind,
+		TokenHash: hash,
+		Email:     user.Email,
+		ExpiresAt: time.Now().Add(ttl),
+		UserID:    user.ID,
+	}
+	_, err = db.NewInsert().Model(&userToken).Exec(ctx)
+	return token, err
+}
+
+// consumeToken marks a valid, unused token of kind as used and returns it.
+func (router *Router) consumeToken(ctx context.Context, db bun.IDB, kind, token string) (*model.UserToken, error) {
+	userToken := new(model.UserToken)
+	err := db.NewUpdate().Model(userToken).Set("used_at = current_timestamp").
+		Where("token_hash = ?", util.HashToken(token)).Where("kind = ?", kind).
+		Where("used_at IS NULL").Where("expires_at > current_timestamp").
+		Returning("*").Scan(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return userToken, nil
+}
+
+func (router *Router) sendVerification(ctx context.Context, user *model.User) error {
+	token, err := router.issueToken(ctx, router.DB, "verify_email", user, verifyEmailTTL)
+	if err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("Hi %s,\n\nConfirm your email address by opening the link below:\n\n%s/verify?token=%s\n\nThe link expires in 48 hours.\n",
+		user.Username, router.AppURL, token)
+	return router.Mailer.Send(user.Email, "Verify your email", body)
+}
+
+type SetEmailReq struct {
+	Email string `json:"email"`
+}
+
+type EmailRes struct {
+	Success bool `json:"success"`
+}
+
+func (router *Router) SetEmail(w http.ResponseWriter, r *http.Request) {
+	var req SetEmailReq
+	ctx := context.Background()
+	uid := principal(r).UserID
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to decode input.")
+		return
+	}
+
+	req.Email = normalizeEmail(req.Email)
+	if !validEmail(req.Email) {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid email.")
+		return
+	}
+
+	exists, err := router.DB.NewSelect().Model((*model.User)(nil)).Where("email = ?", req.Email).Where("id != ?", uid).Exists(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+	if exists {
+		util.ResError(err, w, http.StatusBadRequest, "Email already in use.")
+		return
+	}
+
+	user := &model.User{
+		ID: uid,
+	}
+	err = router.DB.NewUpdate().Model(user).Set("email = ?", req.Email).Set("email_verified = false").WherePK().Returning("*").Scan(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+	router.audit(r, uid, "email.change", "email:"+req.Email, true)
+
+	err = router.sendVerification(ctx, user)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to send email.")
+		return
+	}
+
+	res := EmailRes{
+		Success: true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+func (router *Router) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	uid := principal(r).UserID
+
+	user := &model.User{
+		ID: uid,
+	}
+	err := router.DB.NewSelect().Model(user).WherePK().Scan(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+
+	if user.Email == "" || user.EmailVerified {
+		util.ResError(err, w, http.StatusBadRequest, "Nothing to verify.")
+		return
+	}
+
+	err = router.sendVerification(ctx, user)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to send email.")
+		return
+	}
+
+	res := EmailRes{
+		Success: true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+type VerifyEmailReq struct {
+	Token string `json:"token"`
+}
+
+func (router *Router) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var req VerifyEmailReq
+	ctx := context.Background()
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to decode input.")
+		return
+	}
+
+	err = router.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		userToken, err := router.consumeToken(ctx, tx, "verify_email", req.Token)
+		if err != nil {
+			return err
+		}
+
+		// The address may have changed since the link was sent.
+		result, err := tx.NewUpdate().Model((*model.User)(nil)).Set("email_verified = true").
+			Where("id = ?", userToken.UserID).Where("email = ?", userToken.Email).Exec(ctx)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return fmt.Errorf("Email of user %d changed", userToken.UserID)
+		}
+		return nil
+	})
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid or expired token.")
+		return
+	}
+
+	res := EmailRes{
+		Success: true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+type ForgotPasswordReq struct {
+	Email string `json:"email"`
+}
+
+// ForgotPassword always reports success so it can't be used to find out
+// which addresses have accounts, or whether a link was sent at all: at most
+// one goes out per account every resetPasswordGap.
+func (router *Router) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var req ForgotPasswordReq
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to decode input.")
+		return
+	}
+
+	go func() {
+		ctx := context.Background()
+
+		user := new(model.User)
+		var token string
+		// The user row is locked, so concurrent requests see each other's token.
+		err := router.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+			err := tx.NewSelect().Model(user).Where("email = ?", normalizeEmail(req.Email)).Where("email_verified = true").Where("active = true").
+				For("UPDATE").Scan(ctx)
+			if err != nil {
+				return err
+			}
+
+			recent, err := tx.NewSelect().Model((*model.UserToken)(nil)).Where("user_id = ?", user.ID).Where("kind = 'reset_password'").
+				Where("created_at > ?", time.Now().Add(-resetPasswordGap)).Exists(ctx)
+			if err != nil || recent {
+				return err
+			}
+
+			token, err = router.issueToken(ctx, tx, "reset_password", user, resetPasswordTTL)
+			return err
+		})
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		if token == "" {
+			log.Printf("Skipped password reset mail to user %d, one was sent recently\n", user.ID)
+			return
+		}
+
+		body := fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password for your account. If it was you, open the link below:\n\n%s/reset?token=%s\n\nThe link expires in 1 hour. If you didn't ask for this you can ignore this email.\n",
+			user.Username, router.AppURL, token)
+		err = router.Mailer.Send(user.Email, "Reset your password", body)
+		if err != nil {
+			log.Println(err)
+		}
+	}()
+
+	res := EmailRes{
+		Success: true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+type ResetPasswordReq struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+func (router *Router) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var req ResetPasswordReq
+	ctx := context.Background()
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to decode input.")
+		return
+	}
+
+	if !validPassword(req.Password) {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid password.")
+		return
+	}
+
+	hashed, err := util.HashPassword(req.Password)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid password.")
+		return
+	}
+
+	var uid int64
+	err = router.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		userToken, err := router.consumeToken(ctx, tx, "reset_password", req.Token)
+		if err != nil {
+			return err
+		}
+
+		// Proving the mailbox also lifts a login lockout, and a successful
+		// attempt restarts the failure count behind the backoff.
+		uid = userToken.UserID
+		user := new(model.User)
+		err = tx.NewUpdate().Model(user).Set("password_hash = ?", hashed).Set("locked_until = NULL").
+			Where("id = ?", userToken.UserID).Returning("*").Scan(ctx)
+		if err != nil {
+			return err
+		}
+		_, err = tx.NewInsert().Model(&model.LoginAttempt{
+			Username:  user.Username,
+			IP:        util.ClientIP(r),
+			Success:   true,
+			Reason:    "password_reset",
+			UserAgent: r.UserAgent(),
+			UserID:    user.ID,
+		}).Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		// Any other outstanding reset links for this account die with this one.
+		_, err = tx.NewUpdate().Model((*model.UserToken)(nil)).Set("used_at = current_timestamp").
+			Where("user_id = ?", userToken.UserID).Where("kind = 'reset_password'").Where("used_at IS NULL").Exec(ctx)
+		return err
+	})
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid or expired token.")
+		return
+	}
+	router.audit(r, uid, "password.reset", auditTarget("user", uid), true)
+
+	res := EmailRes{
+		Success: true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
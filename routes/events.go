@@ -0,0 +1,135 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/uptrace/bun"
+
+	"gpu/model"
+	"gpu/util"
+)
+
+// QueryToken lets a token be given as the token query parameter, for clients
+// like EventSource that can't set headers. It must run before AuthMiddleware,
+// and only wraps streaming endpoints so tokens stay out of other URLs.
+func (router *Router) QueryToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token := r.URL.Query().Get("token"); token != "" && r.Header.Get("Authorization") == "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// eventScopes is the scope an API key needs to receive each type of event.
+var eventScopes = map[string]string{
+	"product":      "servers:read",
+	"purchase":     "billing:read",
+	"deposit":      "billing:read",
+	"notification": "profile:read",
+}
+
+// eventAllowed reports whether p may receive events of type eventType, API
+// keys only get those their scopes would let them read.
+func eventAllowed(p *Principal, eventType string) bool {
+	return !p.IsAPIKey() || p.HasScope(eventScopes[eventType])
+}
+
+// Events streams the caller's product status changes, new notifications,
+// purchases and deposits as server-sent events, including those of their
+// organizations. Clients refetch whatever they need after reconnecting.
+// Access is checked again on every ping: the stream closes once the user is
+// disabled, their token expired or their API key revoked, and follows
+// membership changes.
+func (router *Router) Events(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	p := principal(r)
+	uid := p.UserID
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		util.ResError(nil, w, http.StatusBadRequest, "Streaming is not supported.")
+		return
+	}
+
+	orgIDs, err := router.memberOrgs(ctx, uid)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+
+	sub := router.Bus.Subscribe(uid, orgIDs)
+	defer router.Bus.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 5000\n\n")
+	flusher.Flush()
+
+	// Comments keep proxies from closing an idle stream.
+	ping := time.NewTicker(25 * time.Second)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-sub.C:
+			if p.expired() {
+				return
+			}
+			if !eventAllowed(p, event.Type) {
+				continue
+			}
+			data, _ := json.Marshal(event)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+			flusher.Flush()
+		case <-ping.C:
+			if !router.streamAllowed(ctx, p) {
+				return
+			}
+			orgIDs, err := router.memberOrgs(ctx, uid)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			router.Bus.SetOrgs(sub, orgIDs)
+
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+// memberOrgs returns the organizations uid is a member of.
+func (router *Router) memberOrgs(ctx context.Context, uid int64) ([]int64, error) {
+	var orgIDs []int64
+	err := router.DB.NewSelect().Model((*model.Membership)(nil)).Column("organization_id").
+		Where("user_id = ?", uid).Scan(ctx, &orgIDs)
+	return orgIDs, err
+}
+
+// streamAllowed reports whether p may still receive events: the user is
+// active, a session token hasn't expired and, for API keys, the key is neither
+// revoked nor expired.
+func (router *Router) streamAllowed(ctx context.Context, p *Principal) bool {
+	if p.expired() || !router.userActive(p.UserID) {
+		return false
+	}
+	if !p.IsAPIKey() {
+		return true
+	}
+	valid, err := router.DB.NewSelect().Model((*model.APIKey)(nil)).Where("id = ?", p.KeyID).Where("revoked = false").
+		WhereGroup(" AND ", func(q *bun.SelectQuery) *bun.SelectQuery {
+			return q.Where("expires_at IS NULL").WhereOr("expires_at > current_timestamp")
+		}).Exists(ctx)
+	return err == nil && valid
+}
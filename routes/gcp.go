@@ -1,17 +1,17 @@
 package routes
 
 import (
-    "log"
-    "fmt"
     "time"
 	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 
     "github.com/goombaio/namegenerator"
-	"github.com/golang-jwt/jwt"
+    "github.com/uptrace/bun"
 
 	"gpu/model"
+	"gpu/provision"
 	"gpu/util"
 )
 
@@ -19,17 +19,51 @@ type SpinServerReq struct {
     ServerConfigID int64 `json:"server_config_id"`
     TemplateID int64 `json:"template_id"`
     Storage int `json:"storage"`
+    OrganizationID int64 `json:"organization_id"` // 0 launches on the personal account
+    Params map[string]interface{} `json:"params"` // values for the template's params
+    TTLHours int `json:"ttl_hours"` // 0 runs until destroyed
+    IdleMinutes int `json:"idle_minutes"` // 0 never counts as idle
+    ExpiryAction string `json:"expiry_action"` // destroy or stop, destroy by default
 }
 
 type SpinServerRes struct {
 	Success      bool   `json:"success"`
 }
 
+// launchTarget loads the active template and config of a launch, and checks
+// the template can run on the config. It returns the message for the user when
+// they can't be used.
+func (router *Router) launchTarget(ctx context.Context, p *Principal, req *SpinServerReq) (*model.Template, *model.ServerConfig, string, error) {
+	template := &model.Template{
+		ID: req.TemplateID,
+	}
+	err := router.DB.NewSelect().Model(template).WherePK().Where("active = true").Scan(ctx)
+	if err == nil {
+		err = router.authorizeTemplate(ctx, p, template, actionRead)
+	}
+	if err != nil {
+		return nil, nil, "Invalid template.", err
+	}
+
+	serverConfig := &model.ServerConfig{
+		ID: req.ServerConfigID,
+	}
+	err = router.DB.NewSelect().Model(serverConfig).WherePK().Where("active = true").Scan(ctx)
+	if err != nil {
+		return nil, nil, "Invalid config.", err
+	}
+
+	if msg := hardwareFits(template, serverConfig, req.Storage); msg != "" {
+		return nil, nil, msg, nil
+	}
+	return template, serverConfig, "", nil
+}
+
 func (router *Router) SpinServer(w http.ResponseWriter, r *http.Request) {
 	var req SpinServerReq
 	ctx := context.Background()
-	props, _ := r.Context().Value("props").(jwt.MapClaims)
-	uid := int64(props["sub"].(float64))
+	p := principal(r)
+	uid := p.UserID
 
 	decoder := json.NewDecoder(r.Body)
 	err := decoder.Decode(&req)
@@ -38,34 +72,38 @@ func (router *Router) SpinServer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-    if req.Storage < 100 {
-		util.ResError(err, w, http.StatusBadRequest, "This template needs 100GB.")
+	template, serverConfig, msg, err := router.launchTarget(ctx, p, &req)
+	if msg != "" {
+		util.ResError(err, w, http.StatusBadRequest, msg)
 		return
-    }
+	}
 
-    if uid != 1 {
-		util.ResError(err, w, http.StatusBadRequest, "Insufficent balance.")
+	if msg := router.validLifetime(&req, template); msg != "" {
+		util.ResError(nil, w, http.StatusBadRequest, msg)
 		return
-    }
+	}
 
-    template := model.Template{
-        ID: req.TemplateID,
-    }
-    err = router.DB.NewSelect().Model(&template).WherePK().Scan(ctx)
+	params, publicParams, err := util.ResolveParams(template.Params, req.Params)
 	if err != nil {
-		util.ResError(err, w, http.StatusBadRequest, "Invalid template.")
+		util.ResError(err, w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-    serverConfig := model.ServerConfig{
-        ID: req.ServerConfigID,
-    }
-    err = router.DB.NewSelect().Model(&serverConfig).WherePK().Scan(ctx)
+	sourceImage, script, metadata, err := provision.BootSpec(template, params, router.ContainerBase, router.EncryptionKey)
 	if err != nil {
-		util.ResError(err, w, http.StatusBadRequest, "Invalid config.")
+		util.ResError(err, w, http.StatusBadRequest, "Invalid template.")
 		return
 	}
 
+	var heartbeatHash string
+	if router.APIURL != "" {
+		metadata, heartbeatHash, err = provision.Heartbeat(metadata, router.APIURL)
+		if err != nil {
+			util.ResError(err, w, http.StatusBadRequest, "Failed to launch.")
+			return
+		}
+	}
+
     // func CreateInstance(projectID, zone, instanceName, machineType, sourceImage, region, script, gpuType string, gpuCount int32, disk int64) error {
     seed := time.Now().UTC().UnixNano()
     nameGenerator := namegenerator.NewNameGenerator(seed)
@@ -79,53 +117,61 @@ func (router *Router) SpinServer(w http.ResponseWriter, r *http.Request) {
         UserID: uid,
         ServerConfigID: serverConfig.ID,
         TemplateID: template.ID,
+        OrganizationID: req.OrganizationID,
+        Params: publicParams,
+        IdleMinutes: req.IdleMinutes,
+        ExpiryAction: req.ExpiryAction,
+        HeartbeatHash: heartbeatHash,
     }
-    _, err = router.DB.NewInsert().Model(&product).Exec(ctx)
+    if req.TTLHours > 0 {
+        product.ExpiresAt = time.Now().Add(time.Duration(req.TTLHours) * time.Hour)
+    }
+
+	// The quota and balance checks and the insert share a transaction, so
+	// concurrent launches can't both fit in the last slot or spend the same
+	// balance.
+	err = router.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		err := checkQuota(ctx, tx, uid, req.OrganizationID, serverConfig, req.Storage)
+		if err != nil {
+			return err
+		}
+		err = checkSpend(ctx, tx, uid, req.OrganizationID, serverConfig.Price)
+		if err != nil {
+			return err
+		}
+		_, err = tx.NewInsert().Model(&product).Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		purchase := model.Purchase{
+			UserID:         product.UserID,
+			ProductID:      product.ID,
+			Amount:         product.Price,
+			OrganizationID: product.OrganizationID,
+		}
+		_, err = tx.NewInsert().Model(&purchase).Exec(ctx)
+		return err
+	})
+	var quotaErr quotaError
+	if errors.As(err, &quotaErr) {
+		router.audit(r, uid, "server.launch", auditTarget("config", serverConfig.ID), false)
+		util.ResError(err, w, http.StatusBadRequest, quotaErr.Error())
+		return
+	}
+	var spendErr spendError
+	if errors.As(err, &spendErr) {
+		router.audit(r, uid, "server.launch", auditTarget("config", serverConfig.ID), false)
+		util.ResError(err, w, http.StatusBadRequest, spendErr.msg)
+		return
+	}
 	if err != nil {
 		util.ResError(err, w, http.StatusBadRequest, "Database error.")
 		return
 	}
+	router.audit(r, uid, "server.launch", "product:"+gcpId, true)
 
-    go func() {
-        err := util.CreateInstance("siggpu", serverConfig.Zone, gcpId, serverConfig.MachineType, template.Container, serverConfig.Region, "",
-            serverConfig.GPUType, int32(serverConfig.GPUCount), int64(req.Storage))
-        if err != nil {
-            product.Status = "failed"
-            return
-        } else {
-            product.Status = "building"
-            ip, err := util.GetInstanceIP("siggpu", serverConfig.Zone, gcpId)
-            if err != nil {
-                log.Println(err)
-            }
-            product.DNSLink = fmt.Sprintf("http://%s", ip)
-        }
-
-        _, err = router.DB.NewUpdate().Model(&product).Where("gcp_id = ?", gcpId).Exec(ctx)
-        if err != nil {
-            panic(err)
-        }
-
-        if product.Status == "building" {
-            time.Sleep(10)
-            product.Status = "active"
-            _, err = router.DB.NewUpdate().Model(&product).Where("gcp_id = ?", gcpId).Exec(ctx)
-            if err != nil {
-                panic(err)
-            }
-        }
-    }()
-
-    purchase := model.Purchase{
-        UserID: product.UserID,
-        ProductID: product.ID,
-        Amount: product.Price,
-    }
-    _, err = router.DB.NewInsert().Model(&purchase).Exec(ctx)
-    if err != nil {
-		util.ResError(err, w, http.StatusBadRequest, "Database error.")
-		return
-    }
+	go provision.Launch(router.DB, router.Notifier, &product, serverConfig, sourceImage, script, metadata)
 
 	res := SpinServerRes{
 		Success:      true,
@@ -141,6 +187,7 @@ type KillServerReq struct {
 func (router *Router) KillServer(w http.ResponseWriter, r *http.Request) {
 	var req KillServerReq
 	ctx := context.Background()
+	p := principal(r)
 
 	decoder := json.NewDecoder(r.Body)
 	err := decoder.Decode(&req)
@@ -149,33 +196,102 @@ func (router *Router) KillServer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-    product := new(model.Product)
-    err = router.DB.NewSelect().Model(product).Where("gcp_id = ?", req.GCPId).Relation("ServerConfig").Scan(ctx)
+    product, err := router.product(ctx, p, req.GCPId, actionDestroy)
 	if err != nil {
-		util.ResError(err, w, http.StatusBadRequest, "Invalid config.")
+		router.audit(r, p.UserID, "server.destroy", "product:"+req.GCPId, false)
+		util.ResError(err, w, http.StatusBadRequest, "Invalid product.")
+		return
+	}
+	if product.Status == "reserved" {
+		util.ResError(nil, w, http.StatusBadRequest, "Cancel the reservation instead.")
 		return
 	}
 
-    go func() {
-        err := util.DeleteInstance("siggpu", product.ServerConfig.Zone, req.GCPId)
-        if err != nil {
-            product.Status = "failed"
-            return
-        } else {
-            product.Status = "destroyed"
-        }
-
-        _, err = router.DB.NewUpdate().Model(product).Where("gcp_id = ?", req.GCPId).Exec(ctx)
-        if err != nil {
-            panic(err)
-        }
-    }()
-
-    product.Status = "destroying"
-    _, err = router.DB.NewUpdate().Model(product).Where("gcp_id = ?", req.GCPId).Exec(ctx)
+    err = provision.Destroy(router.DB, router.Notifier, product)
+	if errors.Is(err, provision.ErrInvalidStatus) {
+		util.ResError(err, w, http.StatusBadRequest, "Server can't be destroyed now.")
+		return
+	}
     if err != nil {
-        panic(err)
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
     }
+	router.audit(r, product.UserID, "server.destroy", "product:"+product.GCPID, true)
+
+	res := SpinServerRes{
+		Success:      true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+// ResumeServer starts a stopped server again. Its slot is still held, so
+// only the balance is checked, and the first hour is charged like a launch.
+func (router *Router) ResumeServer(w http.ResponseWriter, r *http.Request) {
+	var req KillServerReq
+	ctx := context.Background()
+	p := principal(r)
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to decode input.")
+		return
+	}
+
+	product, err := router.product(ctx, p, req.GCPId, actionDestroy)
+	if err != nil {
+		router.audit(r, p.UserID, "server.resume", "product:"+req.GCPId, false)
+		util.ResError(err, w, http.StatusBadRequest, "Invalid product.")
+		return
+	}
+
+	err = router.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		err := lockAccount(ctx, tx, p.UserID, product.OrganizationID)
+		if err != nil {
+			return err
+		}
+		err = checkSpend(ctx, tx, p.UserID, product.OrganizationID, product.Price)
+		if err != nil {
+			return err
+		}
+		err = provision.Transition(ctx, tx, product, "starting", "stopped")
+		if err != nil {
+			return err
+		}
+		// A TTL that stopped it is spent, so it would be stopped again at once.
+		_, err = tx.NewUpdate().Model((*model.Product)(nil)).Set("expires_at = NULL").Set("expiry_warned_at = NULL").
+			Where("id = ?", product.ID).Where("expires_at <= current_timestamp").Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		purchase := model.Purchase{
+			UserID:         p.UserID,
+			ProductID:      product.ID,
+			Amount:         product.Price,
+			OrganizationID: product.OrganizationID,
+		}
+		_, err = tx.NewInsert().Model(&purchase).Exec(ctx)
+		return err
+	})
+	if errors.Is(err, provision.ErrInvalidStatus) {
+		util.ResError(err, w, http.StatusBadRequest, "Server is not stopped.")
+		return
+	}
+	var spendErr spendError
+	if errors.As(err, &spendErr) {
+		router.audit(r, p.UserID, "server.resume", "product:"+product.GCPID, false)
+		util.ResError(err, w, http.StatusBadRequest, spendErr.msg)
+		return
+	}
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+	router.audit(r, p.UserID, "server.resume", "product:"+product.GCPID, true)
+
+	go provision.Start(router.DB, router.Notifier, product)
 
 	res := SpinServerRes{
 		Success:      true,
@@ -0,0 +1,178 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"gpu/model"
+	"gpu/util"
+)
+
+// Scopes that can be granted to an API key. Managing keys is deliberately not
+// among them, so a leaked key can't mint new ones.
+var APIKeyScopes = []string{
+	"servers:read",
+	"servers:write",
+	"billing:read",
+	"profile:read",
+	"profile:write",
+	"orgs:read",
+	"orgs:write",
+	"webhooks:read",
+	"webhooks:write",
+}
+
+func validScopes(scopes []string) bool {
+	if len(scopes) == 0 {
+		return false
+	}
+	for _, scope := range scopes {
+		valid := false
+		for _, s := range APIKeyScopes {
+			if scope == s {
+				valid = true
+			}
+		}
+		if !valid {
+			return false
+		}
+	}
+	return true
+}
+
+type KeysRes struct {
+	Success bool            `json:"success"`
+	Keys    []*model.APIKey `json:"keys"`
+}
+
+func (router *Router) Keys(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	uid := principal(r).UserID
+
+	keys := []*model.APIKey{}
+	err := router.DB.NewSelect().Model(&keys).Where("user_id = ?", uid).Where("revoked = false").OrderExpr("created_at DESC").Scan(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+
+	res := KeysRes{
+		Keys:    keys,
+		Success: true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+type CreateKeyReq struct {
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	ExpiresIn int      `json:"expires_in_days"` // 0 never expires
+}
+
+type CreateKeyRes struct {
+	Success bool          `json:"success"`
+	Key     string        `json:"key"`
+	APIKey  *model.APIKey `json:"api_key"`
+}
+
+func (router *Router) CreateKey(w http.ResponseWriter, r *http.Request) {
+	var req CreateKeyReq
+	ctx := context.Background()
+	uid := principal(r).UserID
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to decode input.")
+		return
+	}
+
+	if len(req.Name) == 0 || len(req.Name) > 64 {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid name.")
+		return
+	}
+
+	if !validScopes(req.Scopes) {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid scopes.")
+		return
+	}
+
+	if req.ExpiresIn < 0 {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid expiry.")
+		return
+	}
+
+	key, prefix, hash, err := util.GenerateAPIKey()
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to generate key.")
+		return
+	}
+
+	apiKey := model.APIKey{
+		Name:    req.Name,
+		Prefix:  prefix,
+		KeyHash: hash,
+		Scopes:  req.Scopes,
+		UserID:  uid,
+	}
+	if req.ExpiresIn > 0 {
+		apiKey.ExpiresAt = time.Now().Add(time.Duration(req.ExpiresIn) * 24 * time.Hour)
+	}
+	_, err = router.DB.NewInsert().Model(&apiKey).Exec(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+	router.audit(r, uid, "key.create", auditTarget("key", apiKey.ID), true)
+
+	// The plaintext key is only ever returned here.
+	res := CreateKeyRes{
+		Key:     key,
+		APIKey:  &apiKey,
+		Success: true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+type RevokeKeyReq struct {
+	ID int64 `json:"id"`
+}
+
+type RevokeKeyRes struct {
+	Success bool `json:"success"`
+}
+
+func (router *Router) RevokeKey(w http.ResponseWriter, r *http.Request) {
+	var req RevokeKeyReq
+	ctx := context.Background()
+	uid := principal(r).UserID
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to decode input.")
+		return
+	}
+
+	result, err := router.DB.NewUpdate().Model((*model.APIKey)(nil)).Set("revoked = true").Where("id = ?", req.ID).Where("user_id = ?", uid).Exec(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		router.audit(r, uid, "key.revoke", auditTarget("key", req.ID), false)
+		util.ResError(err, w, http.StatusBadRequest, "Invalid key.")
+		return
+	}
+	router.audit(r, uid, "key.revoke", auditTarget("key", req.ID), true)
+
+	res := RevokeKeyRes{
+		Success: true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
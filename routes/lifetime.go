@@ -0,0 +1,147 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"gpu/model"
+	"gpu/util"
+)
+
+const (
+	maxTTLHours    = 30 * 24
+	minIdleMinutes = 30
+	maxIdleMinutes = 7 * 24 * 60
+)
+
+func validTTL(hours int) bool {
+	return hours >= 0 && hours <= maxTTLHours
+}
+
+// validLifetime returns the message for an invalid TTL or idle policy of a
+// launch of template, or "".
+func (router *Router) validLifetime(req *SpinServerReq, template *model.Template) string {
+	if req.ExpiryAction == "" {
+		req.ExpiryAction = "destroy"
+	}
+	if req.ExpiryAction != "destroy" && req.ExpiryAction != "stop" {
+		return "Invalid expiry action."
+	}
+	if !validTTL(req.TTLHours) {
+		return "TTL must be at most 720 hours."
+	}
+	if req.IdleMinutes != 0 {
+		if router.APIURL == "" {
+			return "Idle shutdown is not available."
+		}
+		// Busy heartbeats come from the container startup script, machine
+		// images have nothing reporting them.
+		if template.Kind != "container" {
+			return "Idle shutdown is only available for container templates."
+		}
+		if req.IdleMinutes < minIdleMinutes || req.IdleMinutes > maxIdleMinutes {
+			return "Idle timeout must be between 30 minutes and 7 days."
+		}
+	}
+	return ""
+}
+
+type SetServerTTLReq struct {
+	GCPId    string `json:"gcp_id"`
+	TTLHours int    `json:"ttl_hours"` // from now, 0 removes the TTL
+}
+
+type SetServerTTLRes struct {
+	Success   bool      `json:"success"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// SetServerTTL extends or removes the TTL of a running server. Whoever may
+// destroy the server may change when it expires.
+func (router *Router) SetServerTTL(w http.ResponseWriter, r *http.Request) {
+	var req SetServerTTLReq
+	ctx := context.Background()
+	p := principal(r)
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to decode input.")
+		return
+	}
+
+	if !validTTL(req.TTLHours) {
+		util.ResError(nil, w, http.StatusBadRequest, "TTL must be at most 720 hours.")
+		return
+	}
+
+	product, err := router.product(ctx, p, req.GCPId, actionDestroy)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid product.")
+		return
+	}
+	if product.Status != "spinning" && product.Status != "building" && product.Status != "active" {
+		util.ResError(nil, w, http.StatusBadRequest, "Server is not running.")
+		return
+	}
+
+	product.ExpiresAt = time.Time{}
+	if req.TTLHours > 0 {
+		product.ExpiresAt = time.Now().Add(time.Duration(req.TTLHours) * time.Hour)
+	}
+	product.ExpiryWarnedAt = time.Time{}
+	_, err = router.DB.NewUpdate().Model(product).Column("expires_at", "expiry_warned_at").WherePK().Exec(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+	router.audit(r, p.UserID, "server.ttl", "product:"+product.GCPID, true)
+
+	res := SetServerTTLRes{
+		ExpiresAt: product.ExpiresAt,
+		Success:   true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+type HeartbeatReq struct {
+	Token string `json:"token"`
+	Busy  bool   `json:"busy"`
+}
+
+// Heartbeat is called by instances with the token from their metadata. Busy
+// heartbeats push back idle shutdown.
+func (router *Router) Heartbeat(w http.ResponseWriter, r *http.Request) {
+	var req HeartbeatReq
+	ctx := context.Background()
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil || req.Token == "" {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to decode input.")
+		return
+	}
+
+	q := router.DB.NewUpdate().Model((*model.Product)(nil)).
+		Where("heartbeat_hash = ?", util.HashToken(req.Token)).Where("status = 'active'")
+	if req.Busy {
+		q = q.Set("last_active_at = current_timestamp").Set("idle_warned_at = NULL")
+	} else {
+		// Touches nothing, only checks the token.
+		q = q.Set("heartbeat_hash = heartbeat_hash")
+	}
+	result, err := q.Exec(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		util.ResError(nil, w, http.StatusUnauthorized, "Invalid token.")
+		return
+	}
+
+	util.ResJSON(w, http.StatusOK, SpinServerRes{Success: true})
+}
@@ -0,0 +1,40 @@
+package routes
+
+import (
+	"testing"
+
+	"gpu/model"
+)
+
+func TestValidLifetime(t *testing.T) {
+	router := &Router{APIURL: "https://api.example.com"}
+	machine := &model.Template{Kind: "machine_image"}
+	container := &model.Template{Kind: "container"}
+
+	tests := []struct {
+		name     string
+		req      SpinServerReq
+		template *model.Template
+		ok       bool
+	}{
+		{"no policy", SpinServerReq{}, machine, true},
+		{"ttl on machine image", SpinServerReq{TTLHours: 24}, machine, true},
+		{"ttl too long", SpinServerReq{TTLHours: maxTTLHours + 1}, container, false},
+		{"idle on container", SpinServerReq{IdleMinutes: 60}, container, true},
+		{"idle on machine image", SpinServerReq{IdleMinutes: 60}, machine, false},
+		{"idle too short", SpinServerReq{IdleMinutes: 5}, container, false},
+		{"stop action", SpinServerReq{ExpiryAction: "stop"}, container, true},
+		{"unknown action", SpinServerReq{ExpiryAction: "suspend"}, container, false},
+	}
+	for _, tt := range tests {
+		msg := router.validLifetime(&tt.req, tt.template)
+		if ok := msg == ""; ok != tt.ok {
+			t.Errorf("%s: validLifetime = %q, want ok %v", tt.name, msg, tt.ok)
+		}
+	}
+
+	noAPI := &Router{}
+	if msg := noAPI.validLifetime(&SpinServerReq{IdleMinutes: 60}, container); msg == "" {
+		t.Error("idle shutdown allowed without an API URL")
+	}
+}
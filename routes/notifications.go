@@ -0,0 +1,217 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/uptrace/bun"
+
+	"gpu/model"
+	"gpu/util"
+)
+
+// Notifications are personal, every query is scoped to the caller's user_id
+// so ids of other users' notifications simply match nothing.
+
+type NotificationsRes struct {
+	Success       bool                  `json:"success"`
+	Notifications []*model.Notification `json:"notifications"`
+	Total         int                   `json:"total"`
+	Unread        int                   `json:"unread"`
+}
+
+// Notifications pages through the caller's inbox, newest first. unread=true
+// leaves out read ones, kind filters by kind or prefix such as "server", and
+// archived=true lists the archive instead.
+func (router *Router) Notifications(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	uid := principal(r).UserID
+	limit, offset := pageParams(r)
+	query := r.URL.Query()
+
+	notifications := []*model.Notification{}
+	q := router.DB.NewSelect().Model(&notifications).Where("user_id = ?", uid)
+	if query.Get("archived") == "true" {
+		q = q.Where("archived_at IS NOT NULL")
+	} else {
+		q = q.Where("archived_at IS NULL")
+	}
+	if query.Get("unread") == "true" {
+		q = q.Where("read = false")
+	}
+	if kind := query.Get("kind"); kind != "" {
+		q = q.WhereGroup(" AND ", func(q *bun.SelectQuery) *bun.SelectQuery {
+			return q.Where("kind = ?", kind).WhereOr("kind LIKE ?", kind+".%")
+		})
+	}
+	total, err := q.OrderExpr("created_at DESC").Limit(limit).Offset(offset).ScanAndCount(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+
+	unread, err := router.unreadCount(ctx, uid)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+
+	res := NotificationsRes{
+		Notifications: notifications,
+		Total:         total,
+		Unread:        unread,
+		Success:       true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+func (router *Router) unreadCount(ctx context.Context, uid int64) (int, error) {
+	return router.DB.NewSelect().Model((*model.Notification)(nil)).
+		Where("user_id = ?", uid).Where("read = false").Where("archived_at IS NULL").Count(ctx)
+}
+
+type UnreadNotificationsRes struct {
+	Success bool `json:"success"`
+	Unread  int  `json:"unread"`
+}
+
+// UnreadNotifications only counts, for badges that poll.
+func (router *Router) UnreadNotifications(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	unread, err := router.unreadCount(ctx, principal(r).UserID)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+
+	res := UnreadNotificationsRes{
+		Unread:  unread,
+		Success: true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+type NotificationsReq struct {
+	IDs []int64 `json:"ids"`
+	All bool    `json:"all"` // every notification in the inbox instead of ids
+}
+
+type NotificationsUpdateRes struct {
+	Success bool `json:"success"`
+	Updated int  `json:"updated"`
+	Unread  int  `json:"unread"`
+}
+
+// notificationsReq decodes which of the caller's notifications a request is
+// about, or returns the message for an invalid one.
+func notificationsReq(r *http.Request) (*NotificationsReq, string) {
+	var req NotificationsReq
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		return nil, "Failed to decode input."
+	}
+	if req.All == (len(req.IDs) > 0) {
+		return nil, "Give either ids or all."
+	}
+	if len(req.IDs) > 200 {
+		return nil, "At most 200 notifications at once."
+	}
+	return &req, ""
+}
+
+// updateNotifications applies update to the notifications req selects in the
+// caller's inbox and writes how many changed.
+func (router *Router) updateNotifications(w http.ResponseWriter, r *http.Request, update func(q *bun.UpdateQuery) *bun.UpdateQuery) {
+	ctx := context.Background()
+	uid := principal(r).UserID
+
+	req, msg := notificationsReq(r)
+	if msg != "" {
+		util.ResError(nil, w, http.StatusBadRequest, msg)
+		return
+	}
+
+	q := router.DB.NewUpdate().Model((*model.Notification)(nil)).Where("user_id = ?", uid)
+	if req.All {
+		q = q.Where("archived_at IS NULL")
+	} else {
+		q = q.Where("id IN (?)", bun.In(req.IDs))
+	}
+	result, err := update(q).Exec(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+	updated, _ := result.RowsAffected()
+
+	unread, err := router.unreadCount(ctx, uid)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+
+	res := NotificationsUpdateRes{
+		Updated: int(updated),
+		Unread:  unread,
+		Success: true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+// ReadNotifications marks notifications as read.
+func (router *Router) ReadNotifications(w http.ResponseWriter, r *http.Request) {
+	router.updateNotifications(w, r, func(q *bun.UpdateQuery) *bun.UpdateQuery {
+		return q.Set("read = true").Where("read = false")
+	})
+}
+
+// ArchiveNotifications moves notifications out of the inbox, read.
+func (router *Router) ArchiveNotifications(w http.ResponseWriter, r *http.Request) {
+	router.updateNotifications(w, r, func(q *bun.UpdateQuery) *bun.UpdateQuery {
+		return q.Set("read = true").Set("archived_at = current_timestamp").Where("archived_at IS NULL")
+	})
+}
+
+// DeleteNotifications deletes notifications for good, archived or not.
+func (router *Router) DeleteNotifications(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	uid := principal(r).UserID
+
+	req, msg := notificationsReq(r)
+	if msg != "" {
+		util.ResError(nil, w, http.StatusBadRequest, msg)
+		return
+	}
+	if req.All {
+		util.ResError(nil, w, http.StatusBadRequest, "Give the ids to delete.")
+		return
+	}
+
+	result, err := router.DB.NewDelete().Model((*model.Notification)(nil)).Where("user_id = ?", uid).
+		Where("id IN (?)", bun.In(req.IDs)).Exec(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+	deleted, _ := result.RowsAffected()
+
+	unread, err := router.unreadCount(ctx, uid)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+
+	res := NotificationsUpdateRes{
+		Updated: int(deleted),
+		Unread:  unread,
+		Success: true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
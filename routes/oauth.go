@@ -0,0 +1,369 @@
+package routes
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/uptrace/bun"
+
+	"gpu/model"
+	"gpu/util"
+)
+
+const oauthStateTTL = 10 * time.Minute
+
+// oauthCookie binds a sign in to the browser that started it, holding the
+// hash of its state. Without it anyone could have a victim's browser finish a
+// flow they started, and link or sign in to the wrong account.
+const oauthCookie = "oauth_state"
+
+func (router *Router) oauthProvider(r *http.Request) (*util.OAuthProvider, bool) {
+	provider, ok := router.OAuth[mux.Vars(r)["provider"]]
+	return provider, ok
+}
+
+// beginOAuth stores a fresh state and PKCE verifier, binds it to the browser
+// with a cookie and returns the URL to send the browser to.
+func (router *Router) beginOAuth(ctx context.Context, w http.ResponseWriter, provider *util.OAuthProvider, linkUserID int64, inviteCode string) (string, error) {
+	state, stateHash, err := util.GenerateToken()
+	if err != nil {
+		return "", err
+	}
+	verifier, challenge, err := util.GeneratePKCE()
+	if err != nil {
+		return "", err
+	}
+
+	oauthState := model.OAuthState{
+		StateHash:  stateHash,
+		Verifier:   verifier,
+		Provider:   provider.Name,
+		LinkUserID: linkUserID,
+		InviteCode: inviteCode,
+		ExpiresAt:  time.Now().Add(oauthStateTTL),
+	}
+	_, err = router.DB.NewInsert().Model(&oauthState).Exec(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	// Lax still sends it on the top-level redirect back from the provider.
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthCookie,
+		Value:    stateHash,
+		Path:     "/oauth",
+		MaxAge:   int(oauthStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   !router.Dev,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return provider.AuthCodeURL(state, challenge), nil
+}
+
+type OAuthStartRes struct {
+	Success bool   `json:"success"`
+	URL     string `json:"url"`
+}
+
+func (router *Router) OAuthStart(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	provider, ok := router.oauthProvider(r)
+	if !ok {
+		util.ResError(nil, w, http.StatusNotFound, "Unknown provider.")
+		return
+	}
+
+	authURL, err := router.beginOAuth(ctx, w, provider, 0, r.URL.Query().Get("invite_code"))
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+
+	res := OAuthStartRes{
+		URL:     authURL,
+		Success: true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+func (router *Router) OAuthLink(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	uid := principal(r).UserID
+
+	provider, ok := router.oauthProvider(r)
+	if !ok {
+		util.ResError(nil, w, http.StatusNotFound, "Unknown provider.")
+		return
+	}
+
+	authURL, err := router.beginOAuth(ctx, w, provider, uid, "")
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+
+	res := OAuthStartRes{
+		URL:     authURL,
+		Success: true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+// oauthRedirect sends the browser back to the frontend. Results travel in the
+// fragment so tokens never reach server logs.
+func (router *Router) oauthRedirect(w http.ResponseWriter, r *http.Request, values url.Values) {
+	http.Redirect(w, r, fmt.Sprintf("%s/oauth/callback#%s", router.AppURL, values.Encode()), http.StatusFound)
+}
+
+func (router *Router) oauthFail(w http.ResponseWriter, r *http.Request, err error, message string) {
+	log.Println(err)
+	router.oauthRedirect(w, r, url.Values{"error": {message}})
+}
+
+var usernameStrip = regexp.MustCompile(`[^a-zA-Z0-9]`)
+
+// freeUsername derives an unused, valid username from what the provider calls the user.
+func (router *Router) freeUsername(ctx context.Context, db bun.IDB, name string) (string, error) {
+	base := usernameStrip.ReplaceAllString(name, "")
+	if len(base) > 14 {
+		base = base[:14]
+	}
+	if len(base) < 4 {
+		base = "user" + base
+	}
+
+	username := base
+	for i := 0; i < 10; i++ {
+		exists, err := db.NewSelect().Model((*model.User)(nil)).Where("username = ?", username).Exists(ctx)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return username, nil
+		}
+		username = fmt.Sprintf("%s%04d", base, rand.Intn(10000))
+	}
+	return "", fmt.Errorf("No free username for %s", name)
+}
+
+// oauthUser finds the user an external identity belongs to, linking it to an
+// account with the same verified email when the provider is trusted with
+// emails, or registering a new account if needed.
+func (router *Router) oauthUser(ctx context.Context, provider *util.OAuthProvider, identity *util.OAuthIdentity, inviteCode string) (*model.User, error) {
+	user := new(model.User)
+	linked := router.DB.NewSelect().Model((*model.Identity)(nil)).Column("user_id").
+		Where("provider = ?", provider.Name).Where("subject = ?", identity.Subject)
+	err := router.DB.NewSelect().Model(user).Where("id IN (?)", linked).Scan(ctx)
+	if err == nil {
+		return user, nil
+	}
+
+	// Emails of providers that aren't trusted with them are ignored, so they
+	// can't be used to sign in to someone else's account.
+	email := ""
+	if identity.EmailVerified && provider.TrustEmail {
+		email = normalizeEmail(identity.Email)
+	}
+
+	err = router.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		found := false
+		if email != "" {
+			err := tx.NewSelect().Model(user).Where("email = ?", email).Where("email_verified = true").Scan(ctx)
+			found = err == nil
+		}
+
+		if !found {
+			username, err := router.freeUsername(ctx, tx, identity.Username)
+			if err != nil {
+				return err
+			}
+
+			// Nobody knows this password, the account signs in through the
+			// provider or after a password reset.
+			password, _, err := util.GenerateToken()
+			if err != nil {
+				return err
+			}
+			hashed, err := util.HashPassword(password)
+			if err != nil {
+				return err
+			}
+
+			user = &model.User{
+				Username:      username,
+				PasswordHash:  hashed,
+				Email:         email,
+				EmailVerified: email != "",
+			}
+			if email != "" {
+				inUse, err := tx.NewSelect().Model((*model.User)(nil)).Where("email = ?", email).Exists(ctx)
+				if err != nil {
+					return err
+				}
+				if inUse {
+					user.Email = ""
+					user.EmailVerified = false
+				}
+			}
+			err = router.registerUser(ctx, tx, user, inviteCode)
+			if err != nil {
+				return err
+			}
+		}
+
+		link := model.Identity{
+			Provider: provider.Name,
+			Subject:  identity.Subject,
+			Email:    identity.Email,
+			UserID:   user.ID,
+		}
+		_, err := tx.NewInsert().Model(&link).Exec(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (router *Router) OAuthCallback(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	provider, ok := router.oauthProvider(r)
+	if !ok {
+		util.ResError(nil, w, http.StatusNotFound, "Unknown provider.")
+		return
+	}
+
+	query := r.URL.Query()
+	if query.Get("error") != "" {
+		router.oauthFail(w, r, fmt.Errorf("%s: %s", provider.Name, query.Get("error")), "Sign in was cancelled.")
+		return
+	}
+
+	stateHash := util.HashToken(query.Get("state"))
+	cookie, err := r.Cookie(oauthCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(stateHash)) != 1 {
+		router.oauthFail(w, r, fmt.Errorf("%s: state not from this browser", provider.Name), "Invalid or expired sign in.")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthCookie,
+		Path:     "/oauth",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   !router.Dev,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	oauthState := new(model.OAuthState)
+	err = router.DB.NewDelete().Model(oauthState).
+		Where("state_hash = ?", stateHash).Where("provider = ?", provider.Name).
+		Where("expires_at > current_timestamp").Returning("*").Scan(ctx)
+	if err != nil {
+		router.oauthFail(w, r, err, "Invalid or expired sign in.")
+		return
+	}
+
+	accessToken, err := provider.Exchange(ctx, query.Get("code"), oauthState.Verifier)
+	if err != nil {
+		router.oauthFail(w, r, err, "Sign in failed.")
+		return
+	}
+
+	identity, err := provider.UserInfo(ctx, accessToken)
+	if err != nil {
+		router.oauthFail(w, r, err, "Sign in failed.")
+		return
+	}
+
+	if oauthState.LinkUserID != 0 {
+		link := model.Identity{
+			Provider: provider.Name,
+			Subject:  identity.Subject,
+			Email:    identity.Email,
+			UserID:   oauthState.LinkUserID,
+		}
+		_, err = router.DB.NewInsert().Model(&link).Exec(ctx)
+		if err != nil {
+			router.oauthFail(w, r, err, "Account is already linked.")
+			return
+		}
+		router.audit(r, link.UserID, "identity.link", "oauth:"+provider.Name, true)
+
+		router.oauthRedirect(w, r, url.Values{"linked": {provider.Name}})
+		return
+	}
+
+	user, err := router.oauthUser(ctx, provider, identity, oauthState.InviteCode)
+	if errors.Is(err, errInvalidInvite) || errors.Is(err, errRegistrationClosed) {
+		router.oauthFail(w, r, err, err.Error())
+		return
+	}
+	if err != nil {
+		router.oauthFail(w, r, err, "Sign in failed.")
+		return
+	}
+
+	if !user.Active {
+		router.audit(r, user.ID, "login", "oauth:"+provider.Name, false)
+		router.oauthFail(w, r, fmt.Errorf("Disabled user %d", user.ID), "Disabled.")
+		return
+	}
+
+	if user.TOTPEnabled {
+		challenge, err := util.GenerateChallengeJWT(user.ID, router.KeySet)
+		if err != nil {
+			router.oauthFail(w, r, err, "Failed to generate token.")
+			return
+		}
+
+		router.oauthRedirect(w, r, url.Values{"challenge": {challenge}})
+		return
+	}
+
+	token, refresh, err := util.GenerateJWT(user.Username, user.ID, user.Admin, router.KeySet)
+	if err != nil {
+		router.oauthFail(w, r, err, "Failed to generate token.")
+		return
+	}
+	router.audit(r, user.ID, "login", "oauth:"+provider.Name, true)
+
+	router.oauthRedirect(w, r, url.Values{"token": {token}, "refreshToken": {refresh}})
+}
+
+type IdentitiesRes struct {
+	Success    bool              `json:"success"`
+	Identities []*model.Identity `json:"identities"`
+}
+
+func (router *Router) Identities(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	uid := principal(r).UserID
+
+	identities := []*model.Identity{}
+	err := router.DB.NewSelect().Model(&identities).Where("user_id = ?", uid).Scan(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+
+	res := IdentitiesRes{
+		Identities: identities,
+		Success:    true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
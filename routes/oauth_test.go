@@ -0,0 +1,237 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"gpu/model"
+	"gpu/util"
+)
+
+// mockIdP is a provider that hands out one code, and counts the codes it was
+// asked to exchange.
+type mockIdP struct {
+	*httptest.Server
+	exchanges int32
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	idp := &mockIdP{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&idp.exchanges, 1)
+		r.ParseForm()
+		if r.Form.Get("code") != "good-code" || r.Form.Get("code_verifier") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "idp-token"})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer idp-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"sub":                "idp-42",
+			"preferred_username": "victim",
+			"email":              "victim@example.com",
+			"email_verified":     true,
+		})
+	})
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+func (idp *mockIdP) provider() *util.OAuthProvider {
+	return &util.OAuthProvider{
+		Name:         "mock",
+		ClientID:     "client",
+		ClientSecret: "secret",
+		RedirectURL:  "http://api.test/oauth/mock/callback",
+		AuthURL:      idp.URL + "/authorize",
+		TokenURL:     idp.URL + "/token",
+		UserInfoURL:  idp.URL + "/userinfo",
+		Scopes:       []string{"openid"},
+	}
+}
+
+func callback(router *Router, state string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/oauth/mock/callback?code=good-code&state="+url.QueryEscape(state), nil)
+	r = mux.SetURLVars(r, map[string]string{"provider": "mock"})
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	router.OAuthCallback(w, r)
+	return w
+}
+
+// fragment returns the values the callback redirected to the frontend with.
+func fragment(t *testing.T, w *httptest.ResponseRecorder) url.Values {
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := url.ParseQuery(location.Fragment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return values
+}
+
+// A callback from a browser that didn't start the sign in is refused before
+// the state is even looked up, so the database isn't needed.
+func TestOAuthCallbackRequiresStateCookie(t *testing.T) {
+	idp := newMockIdP(t)
+	router := &Router{
+		AppURL: "http://app.test",
+		OAuth:  map[string]*util.OAuthProvider{"mock": idp.provider()},
+	}
+
+	for name, cookies := range map[string][]*http.Cookie{
+		"missing":  nil,
+		"mismatch": {{Name: oauthCookie, Value: util.HashToken("someone-elses-state")}},
+	} {
+		w := callback(router, "attacker-state", cookies)
+		if w.Code != http.StatusFound || fragment(t, w).Get("error") == "" {
+			t.Errorf("%s cookie: got %d to %s, want an error redirect", name, w.Code, w.Header().Get("Location"))
+		}
+	}
+	if n := atomic.LoadInt32(&idp.exchanges); n != 0 {
+		t.Errorf("exchanged %d codes, want none", n)
+	}
+}
+
+// Linking completes only in the browser that started it. An attacker who
+// starts linking on their own account can't have a victim's browser finish it.
+func TestOAuthLinkAgainstMockIdP(t *testing.T) {
+	db := testDB(t)
+	idp := newMockIdP(t)
+	router := &Router{
+		DB:     db,
+		AppURL: "http://app.test",
+		OAuth:  map[string]*util.OAuthProvider{"mock": idp.provider()},
+		Dev:    true,
+	}
+	attacker := testUser(t, db, "attacker")
+	user := testUser(t, db, "linker")
+
+	start := func(uid int64) (string, []*http.Cookie) {
+		r := httptest.NewRequest(http.MethodPost, "/oauth/mock/link", nil)
+		r = mux.SetURLVars(r, map[string]string{"provider": "mock"})
+		r = withPrincipal(r, &Principal{UserID: uid})
+		w := httptest.NewRecorder()
+		router.OAuthLink(w, r)
+
+		var res OAuthStartRes
+		json.NewDecoder(w.Body).Decode(&res)
+		if !res.Success || !strings.HasPrefix(res.URL, idp.URL+"/authorize?") {
+			t.Fatalf("link start: %d %s", w.Code, res.URL)
+		}
+		authURL, _ := url.Parse(res.URL)
+		return authURL.Query().Get("state"), w.Result().Cookies()
+	}
+
+	// The victim's browser has no cookie for the attacker's flow.
+	attackerState, _ := start(attacker.ID)
+	w := callback(router, attackerState, nil)
+	if fragment(t, w).Get("error") == "" {
+		t.Fatalf("callback without the cookie: got %s, want an error", w.Header().Get("Location"))
+	}
+
+	state, cookies := start(user.ID)
+	w = callback(router, state, cookies)
+	if got := fragment(t, w).Get("linked"); got != "mock" {
+		t.Fatalf("callback: got %s, want linked=mock", w.Header().Get("Location"))
+	}
+
+	var identities []*model.Identity
+	err := db.NewSelect().Model(&identities).Where("subject = ?", "idp-42").Scan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(identities) != 1 || identities[0].UserID != user.ID {
+		t.Fatalf("got identities %+v, want one for user %d", identities, user.ID)
+	}
+
+	// A state is single use, replaying the callback links nothing more.
+	w = callback(router, state, cookies)
+	if fragment(t, w).Get("error") == "" {
+		t.Fatalf("replayed callback: got %s, want an error", w.Header().Get("Location"))
+	}
+}
+
+func TestOAuthExchangeAgainstMockIdP(t *testing.T) {
+	ctx := context.Background()
+	provider := newMockIdP(t).provider()
+
+	verifier, _, err := util.GeneratePKCE()
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := provider.Exchange(ctx, "good-code", verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, err := provider.UserInfo(ctx, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Subject != "idp-42" || !identity.EmailVerified {
+		t.Fatalf("got identity %+v", identity)
+	}
+
+	_, err = provider.Exchange(ctx, "stolen-code", verifier)
+	if err == nil {
+		t.Fatal("exchanged an invalid code")
+	}
+}
+
+// Only providers trusted with emails sign in to an existing account by a
+// verified address, others get an account of their own.
+func TestOAuthUserTrustEmail(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+	router := &Router{DB: db, RegistrationMode: "open"}
+	victim := testUser(t, db, "victim")
+	_, err := db.NewUpdate().Model(victim).Set("email = ?", "victim@example.com").Set("email_verified = true").WherePK().Exec(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identity := func(subject string) *util.OAuthIdentity {
+		return &util.OAuthIdentity{Subject: subject, Username: "victim", Email: "victim@example.com", EmailVerified: true}
+	}
+
+	untrusted := &util.OAuthProvider{Name: "oidc"}
+	user, err := router.oauthUser(ctx, untrusted, identity("oidc-1"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.ID == victim.ID {
+		t.Fatal("untrusted provider signed in to the account with its email")
+	}
+	if user.Email != "" || user.EmailVerified {
+		t.Errorf("untrusted email kept on the new account: %q", user.Email)
+	}
+
+	trusted := &util.OAuthProvider{Name: "corp", TrustEmail: true}
+	user, err = router.oauthUser(ctx, trusted, identity("corp-1"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.ID != victim.ID {
+		t.Errorf("trusted provider got user %d, want %d", user.ID, victim.ID)
+	}
+}
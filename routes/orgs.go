@@ -0,0 +1,545 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/uptrace/bun"
+
+	"gpu/model"
+	"gpu/util"
+)
+
+const invitationTTL = 7 * 24 * time.Hour
+
+func validRole(role string) bool {
+	return role == "owner" || role == "admin" || role == "member" || role == "billing"
+}
+
+// Billing-only members see the shared balance and ledger but not servers.
+func canManageOrg(role string) bool {
+	return role == "owner" || role == "admin"
+}
+
+func canUseServers(role string) bool {
+	return role == "owner" || role == "admin" || role == "member"
+}
+
+// orgParam reads the optional org_id query parameter. 0 means the personal account.
+func orgParam(r *http.Request) (int64, error) {
+	orgID := r.URL.Query().Get("org_id")
+	if orgID == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(orgID, 10, 64)
+}
+
+func (router *Router) membership(ctx context.Context, orgID, uid int64) (*model.Membership, error) {
+	membership := new(model.Membership)
+	err := router.DB.NewSelect().Model(membership).Where("organization_id = ?", orgID).Where("user_id = ?", uid).Scan(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return membership, nil
+}
+
+// monthlySpend sums what uid has spent from an organization's balance this month.
+func monthlySpend(ctx context.Context, db bun.IDB, orgID, uid int64) (float64, error) {
+	var spent float64
+	err := db.NewSelect().Model((*model.Purchase)(nil)).ColumnExpr("COALESCE(SUM(amount), 0)").
+		Where("organization_id = ?", orgID).Where("user_id = ?", uid).
+		Where("created_at >= date_trunc('month', current_timestamp)").Scan(ctx, &spent)
+	return spent, err
+}
+
+// spendError is a launch refused because the payer can't afford it. msg is
+// shown to the user, err is logged.
+type spendError struct {
+	msg string
+	err error
+}
+
+func (e spendError) Error() string {
+	return e.err.Error()
+}
+
+// checkSpend returns a spendError unless the payer can afford price and, for
+// organization launches, the member stays within their spending limit. It
+// must run in the transaction that records the purchase, after checkQuota or
+// lockAccount has locked the account, so concurrent launches can't both spend
+// the same balance.
+func checkSpend(ctx context.Context, tx bun.Tx, uid, orgID int64, price float64) error {
+	if orgID != 0 {
+		membership := new(model.Membership)
+		err := tx.NewSelect().Model(membership).Where("organization_id = ?", orgID).Where("user_id = ?", uid).Scan(ctx)
+		if err != nil || !canUseServers(membership.Role) {
+			return spendError{"Invalid organization.", fmt.Errorf("User %d cannot launch for organization %d: %v", uid, orgID, err)}
+		}
+
+		if membership.SpendingLimit > 0 {
+			spent, err := monthlySpend(ctx, tx, orgID, uid)
+			if err != nil {
+				return err
+			}
+			if spent+price > membership.SpendingLimit {
+				return spendError{"Spending limit reached.", fmt.Errorf("User %d over spending limit for organization %d", uid, orgID)}
+			}
+		}
+	}
+
+	balance, err := util.Balance(ctx, tx, uid, orgID)
+	if err != nil {
+		return err
+	}
+	if balance < price {
+		return spendError{"Insufficent balance.", fmt.Errorf("Balance %.2f below %.2f", balance, price)}
+	}
+
+	return nil
+}
+
+type OrgsRes struct {
+	Success     bool                `json:"success"`
+	Memberships []*model.Membership `json:"memberships"`
+}
+
+func (router *Router) Orgs(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	uid := principal(r).UserID
+
+	memberships := []*model.Membership{}
+	err := router.DB.NewSelect().Model(&memberships).Where("user_id = ?", uid).Relation("Organization").Scan(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+
+	res := OrgsRes{
+		Memberships: memberships,
+		Success:     true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+type CreateOrgReq struct {
+	Name string `json:"name"`
+}
+
+type CreateOrgRes struct {
+	Success      bool                `json:"success"`
+	Organization *model.Organization `json:"organization"`
+}
+
+func (router *Router) CreateOrg(w http.ResponseWriter, r *http.Request) {
+	var req CreateOrgReq
+	ctx := context.Background()
+	uid := principal(r).UserID
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to decode input.")
+		return
+	}
+
+	if len(req.Name) == 0 || len(req.Name) > 64 {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid name.")
+		return
+	}
+
+	org := model.Organization{
+		Name: req.Name,
+	}
+	err = router.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		_, err := tx.NewInsert().Model(&org).Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		membership := model.Membership{
+			OrganizationID: org.ID,
+			UserID:         uid,
+			Role:           "owner",
+		}
+		_, err = tx.NewInsert().Model(&membership).Exec(ctx)
+		return err
+	})
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+
+	res := CreateOrgRes{
+		Organization: &org,
+		Success:      true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+type OrgMember struct {
+	UserID        int64     `json:"user_id"`
+	Username      string    `json:"username"`
+	Role          string    `json:"role"`
+	SpendingLimit float64   `json:"spending_limit"`
+	Spent         float64   `json:"spent"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+type OrgMembersRes struct {
+	Success bool         `json:"success"`
+	Members []*OrgMember `json:"members"`
+}
+
+func (router *Router) OrgMembers(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	uid := principal(r).UserID
+
+	orgID, err := orgParam(r)
+	if err != nil || orgID == 0 {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid organization.")
+		return
+	}
+
+	_, err = router.membership(ctx, orgID, uid)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid organization.")
+		return
+	}
+
+	memberships := []*model.Membership{}
+	err = router.DB.NewSelect().Model(&memberships).Where("organization_id = ?", orgID).Relation("User").OrderExpr("membership.created_at ASC").Scan(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+
+	members := []*OrgMember{}
+	for _, m := range memberships {
+		spent, err := monthlySpend(ctx, router.DB, orgID, m.UserID)
+		if err != nil {
+			util.ResError(err, w, http.StatusBadRequest, "Database error.")
+			return
+		}
+
+		members = append(members, &OrgMember{
+			UserID:        m.UserID,
+			Username:      m.User.Username,
+			Role:          m.Role,
+			SpendingLimit: m.SpendingLimit,
+			Spent:         spent,
+			CreatedAt:     m.CreatedAt,
+		})
+	}
+
+	res := OrgMembersRes{
+		Members: members,
+		Success: true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+type InviteOrgMemberReq struct {
+	OrganizationID int64   `json:"organization_id"`
+	Username       string  `json:"username"`
+	Role           string  `json:"role"`
+	SpendingLimit  float64 `json:"spending_limit"`
+}
+
+type InviteOrgMemberRes struct {
+	Success    bool              `json:"success"`
+	Invitation *model.Invitation `json:"invitation"`
+}
+
+func (router *Router) InviteOrgMember(w http.ResponseWriter, r *http.Request) {
+	var req InviteOrgMemberReq
+	ctx := context.Background()
+	uid := principal(r).UserID
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to decode input.")
+		return
+	}
+
+	membership, err := router.membership(ctx, req.OrganizationID, uid)
+	if err != nil || !canManageOrg(membership.Role) {
+		util.ResError(err, w, http.StatusForbidden, "Not allowed.")
+		return
+	}
+
+	if !validRole(req.Role) || (req.Role == "owner" && membership.Role != "owner") {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid role.")
+		return
+	}
+
+	if req.SpendingLimit < 0 {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid spending limit.")
+		return
+	}
+
+	invitee := new(model.User)
+	err = router.DB.NewSelect().Model(invitee).Where("username = ?", req.Username).Scan(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid username.")
+		return
+	}
+
+	exists, err := router.DB.NewSelect().Model((*model.Membership)(nil)).Where("organization_id = ?", req.OrganizationID).Where("user_id = ?", invitee.ID).Exists(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+	if exists {
+		util.ResError(err, w, http.StatusBadRequest, "Already a member.")
+		return
+	}
+
+	invitation := model.Invitation{
+		OrganizationID: req.OrganizationID,
+		UserID:         invitee.ID,
+		InvitedByID:    uid,
+		Role:           req.Role,
+		SpendingLimit:  req.SpendingLimit,
+		Status:         "pending",
+		ExpiresAt:      time.Now().Add(invitationTTL),
+	}
+	_, err = router.DB.NewInsert().Model(&invitation).Exec(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+
+	res := InviteOrgMemberRes{
+		Invitation: &invitation,
+		Success:    true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+type InvitationsRes struct {
+	Success     bool                `json:"success"`
+	Invitations []*model.Invitation `json:"invitations"`
+}
+
+func (router *Router) Invitations(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	uid := principal(r).UserID
+
+	invitations := []*model.Invitation{}
+	err := router.DB.NewSelect().Model(&invitations).Where("user_id = ?", uid).Where("status = 'pending'").Where("expires_at > current_timestamp").Relation("Organization").Scan(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+
+	res := InvitationsRes{
+		Invitations: invitations,
+		Success:     true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+type RespondInvitationReq struct {
+	ID     int64 `json:"id"`
+	Accept bool  `json:"accept"`
+}
+
+type RespondInvitationRes struct {
+	Success bool `json:"success"`
+}
+
+func (router *Router) RespondInvitation(w http.ResponseWriter, r *http.Request) {
+	var req RespondInvitationReq
+	ctx := context.Background()
+	uid := principal(r).UserID
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to decode input.")
+		return
+	}
+
+	invitation := new(model.Invitation)
+	err = router.DB.NewSelect().Model(invitation).Where("id = ?", req.ID).Where("user_id = ?", uid).Where("status = 'pending'").Where("expires_at > current_timestamp").Scan(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid invitation.")
+		return
+	}
+
+	err = router.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		invitation.Status = "declined"
+		if req.Accept {
+			invitation.Status = "accepted"
+			membership := model.Membership{
+				OrganizationID: invitation.OrganizationID,
+				UserID:         uid,
+				Role:           invitation.Role,
+				SpendingLimit:  invitation.SpendingLimit,
+			}
+			_, err := tx.NewInsert().Model(&membership).On("CONFLICT DO NOTHING").Exec(ctx)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err := tx.NewUpdate().Model(invitation).Column("status").WherePK().Exec(ctx)
+		return err
+	})
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+
+	res := RespondInvitationRes{
+		Success: true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+// lastOwner reports whether uid is the only owner left in an organization.
+func (router *Router) lastOwner(ctx context.Context, orgID, uid int64) (bool, error) {
+	owners, err := router.DB.NewSelect().Model((*model.Membership)(nil)).Where("organization_id = ?", orgID).Where("role = 'owner'").Where("user_id != ?", uid).Count(ctx)
+	return owners == 0, err
+}
+
+type UpdateOrgMemberReq struct {
+	OrganizationID int64   `json:"organization_id"`
+	UserID         int64   `json:"user_id"`
+	Role           string  `json:"role"`
+	SpendingLimit  float64 `json:"spending_limit"`
+}
+
+type UpdateOrgMemberRes struct {
+	Success bool `json:"success"`
+}
+
+func (router *Router) UpdateOrgMember(w http.ResponseWriter, r *http.Request) {
+	var req UpdateOrgMemberReq
+	ctx := context.Background()
+	uid := principal(r).UserID
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to decode input.")
+		return
+	}
+
+	membership, err := router.membership(ctx, req.OrganizationID, uid)
+	if err != nil || !canManageOrg(membership.Role) {
+		util.ResError(err, w, http.StatusForbidden, "Not allowed.")
+		return
+	}
+
+	target, err := router.membership(ctx, req.OrganizationID, req.UserID)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid member.")
+		return
+	}
+
+	// Only owners may grant or take away ownership.
+	if !validRole(req.Role) || ((req.Role == "owner" || target.Role == "owner") && membership.Role != "owner") {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid role.")
+		return
+	}
+
+	if req.SpendingLimit < 0 {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid spending limit.")
+		return
+	}
+
+	if target.Role == "owner" && req.Role != "owner" {
+		last, err := router.lastOwner(ctx, req.OrganizationID, req.UserID)
+		if err != nil || last {
+			util.ResError(err, w, http.StatusBadRequest, "An organization needs an owner.")
+			return
+		}
+	}
+
+	target.Role = req.Role
+	target.SpendingLimit = req.SpendingLimit
+	_, err = router.DB.NewUpdate().Model(target).Column("role", "spending_limit").WherePK().Exec(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+
+	res := UpdateOrgMemberRes{
+		Success: true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+type RemoveOrgMemberReq struct {
+	OrganizationID int64 `json:"organization_id"`
+	UserID         int64 `json:"user_id"`
+}
+
+type RemoveOrgMemberRes struct {
+	Success bool `json:"success"`
+}
+
+func (router *Router) RemoveOrgMember(w http.ResponseWriter, r *http.Request) {
+	var req RemoveOrgMemberReq
+	ctx := context.Background()
+	uid := principal(r).UserID
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to decode input.")
+		return
+	}
+
+	membership, err := router.membership(ctx, req.OrganizationID, uid)
+	if err != nil {
+		util.ResError(err, w, http.StatusForbidden, "Not allowed.")
+		return
+	}
+
+	target, err := router.membership(ctx, req.OrganizationID, req.UserID)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid member.")
+		return
+	}
+
+	// Anyone may leave, otherwise only admins and owners remove members and
+	// only owners remove other owners.
+	if req.UserID != uid && (!canManageOrg(membership.Role) || (target.Role == "owner" && membership.Role != "owner")) {
+		util.ResError(err, w, http.StatusForbidden, "Not allowed.")
+		return
+	}
+
+	if target.Role == "owner" {
+		last, err := router.lastOwner(ctx, req.OrganizationID, req.UserID)
+		if err != nil || last {
+			util.ResError(err, w, http.StatusBadRequest, "An organization needs an owner.")
+			return
+		}
+	}
+
+	_, err = router.DB.NewDelete().Model(target).WherePK().Exec(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+
+	res := RemoveOrgMemberRes{
+		Success: true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,158 @@
+package routes
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+
+	"gpu/model"
+)
+
+// Principal is who a request acts as. AuthMiddleware resolves it once from a
+// session token or an API key, and handlers read it with principal(r).
+type Principal struct {
+	UserID   int64
+	Username string
+	Admin    bool
+	KeyID    int64    // 0 for session tokens
+	Scopes   []string // only restricts API keys
+	// ExpiresAt is when a session token expires, zero for API keys. Long
+	// lived requests such as streams check it again.
+	ExpiresAt time.Time
+}
+
+type principalKey struct{}
+
+func principalFromClaims(claims jwt.MapClaims) (*Principal, error) {
+	sub, ok := claims["sub"].(float64)
+	if !ok {
+		return nil, fmt.Errorf("Invalid subject %v", claims["sub"])
+	}
+
+	username, _ := claims["username"].(string)
+	admin, _ := claims["admin"].(bool)
+	p := &Principal{
+		UserID:   int64(sub),
+		Username: username,
+		Admin:    admin,
+	}
+	if exp, ok := claims["exp"].(float64); ok {
+		p.ExpiresAt = time.Unix(int64(exp), 0)
+	}
+	return p, nil
+}
+
+func withPrincipal(r *http.Request, p *Principal) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), principalKey{}, p))
+}
+
+// principal returns the caller of a request that went through AuthMiddleware.
+func principal(r *http.Request) *Principal {
+	p, _ := r.Context().Value(principalKey{}).(*Principal)
+	return p
+}
+
+func (p *Principal) IsAPIKey() bool {
+	return p.KeyID != 0
+}
+
+// expired reports whether the session token p came from has expired.
+func (p *Principal) expired() bool {
+	return !p.ExpiresAt.IsZero() && time.Now().After(p.ExpiresAt)
+}
+
+func (p *Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Policies return an error whenever the principal may not act on a resource.
+// Handlers report denials the same way as missing rows, so ids belonging to
+// other users can't be probed.
+
+const (
+	actionRead    = "read"
+	actionDestroy = "destroy"
+	actionManage  = "manage"
+)
+
+// authorizeOrg checks that p is a member of the organization with a role allow accepts.
+func (router *Router) authorizeOrg(ctx context.Context, p *Principal, orgID int64, allow func(role string) bool) (*model.Membership, error) {
+	membership, err := router.membership(ctx, orgID, p.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("User %d is not in organization %d: %v", p.UserID, orgID, err)
+	}
+	if !allow(membership.Role) {
+		return nil, fmt.Errorf("User %d with role %s denied on organization %d", p.UserID, membership.Role, orgID)
+	}
+	return membership, nil
+}
+
+// authorizeProduct lets users act on their personal servers. Organization
+// servers can be seen by anyone allowed to use servers there, and destroyed by
+// whoever launched them or an organization admin.
+func (router *Router) authorizeProduct(ctx context.Context, p *Principal, product *model.Product, action string) error {
+	if product.OrganizationID == 0 {
+		if product.UserID != p.UserID {
+			return fmt.Errorf("User %d denied %s on product %d", p.UserID, action, product.ID)
+		}
+		return nil
+	}
+
+	membership, err := router.authorizeOrg(ctx, p, product.OrganizationID, canUseServers)
+	if err != nil {
+		return err
+	}
+	if action == actionDestroy && product.UserID != p.UserID && !canManageOrg(membership.Role) {
+		return fmt.Errorf("User %d denied %s on product %d", p.UserID, action, product.ID)
+	}
+	return nil
+}
+
+// product loads a product with its ServerConfig by gcp_id, if p may act on it.
+func (router *Router) product(ctx context.Context, p *Principal, gcpID, action string) (*model.Product, error) {
+	product := new(model.Product)
+	err := router.DB.NewSelect().Model(product).Where("gcp_id = ?", gcpID).Relation("ServerConfig").Scan(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = router.authorizeProduct(ctx, p, product, action)
+	if err != nil {
+		return nil, err
+	}
+	return product, nil
+}
+
+// authorizeTemplate lets anyone read catalog templates, which only admins
+// manage. Owned templates can be read by their owner, and by members who can
+// use servers in the organization they are shared with. They are managed by
+// the owner or an organization admin.
+func (router *Router) authorizeTemplate(ctx context.Context, p *Principal, template *model.Template, action string) error {
+	if template.OwnerID == 0 {
+		if action != actionRead {
+			return fmt.Errorf("User %d denied %s on catalog template %d", p.UserID, action, template.ID)
+		}
+		return nil
+	}
+	if template.OwnerID == p.UserID {
+		return nil
+	}
+	if template.OrganizationID == 0 {
+		return fmt.Errorf("User %d denied %s on template %d", p.UserID, action, template.ID)
+	}
+
+	allow := canUseServers
+	if action != actionRead {
+		allow = canManageOrg
+	}
+	_, err := router.authorizeOrg(ctx, p, template.OrganizationID, allow)
+	return err
+}
@@ -0,0 +1,229 @@
+package routes
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/uptrace/bun"
+
+	"gpu/model"
+)
+
+// tenants is two users with personal servers, and two organizations: acme,
+// where alice launched a server, carol is an admin and dave a member, and
+// globex, where bob is an admin.
+type tenants struct {
+	db                      *bun.DB
+	alice, bob, carol, dave *model.User
+	acme, globex            *model.Organization
+}
+
+func newTenants(t *testing.T) *tenants {
+	ctx := context.Background()
+	db := testDB(t)
+	tn := &tenants{
+		db:     db,
+		alice:  testUser(t, db, "alice"),
+		bob:    testUser(t, db, "bob"),
+		carol:  testUser(t, db, "carol"),
+		dave:   testUser(t, db, "dave"),
+		acme:   &model.Organization{Name: "acme"},
+		globex: &model.Organization{Name: "globex"},
+	}
+
+	insert := func(models ...interface{}) {
+		for _, m := range models {
+			_, err := db.NewInsert().Model(m).Exec(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	insert(tn.acme, tn.globex)
+	insert(
+		&model.Membership{OrganizationID: tn.acme.ID, UserID: tn.alice.ID, Role: "member"},
+		&model.Membership{OrganizationID: tn.acme.ID, UserID: tn.carol.ID, Role: "admin"},
+		&model.Membership{OrganizationID: tn.acme.ID, UserID: tn.dave.ID, Role: "member"},
+		&model.Membership{OrganizationID: tn.globex.ID, UserID: tn.bob.ID, Role: "admin"},
+	)
+
+	config := &model.ServerConfig{Region: "us-east1", Zone: "us-east1-b", MachineType: "n1-standard-4", Price: 1}
+	insert(config)
+	products := []*model.Product{
+		{GCPID: "alice-box", UserID: tn.alice.ID},
+		{GCPID: "bob-box", UserID: tn.bob.ID},
+		{GCPID: "acme-box", UserID: tn.alice.ID, OrganizationID: tn.acme.ID},
+		{GCPID: "globex-box", UserID: tn.bob.ID, OrganizationID: tn.globex.ID},
+		{GCPID: "alice-reserved", UserID: tn.alice.ID, Status: "reserved"},
+		{GCPID: "acme-reserved", UserID: tn.alice.ID, OrganizationID: tn.acme.ID, Status: "reserved"},
+	}
+	for _, product := range products {
+		if product.Status == "" {
+			product.Status = "active"
+		}
+		product.Price = config.Price
+		product.Storage = 100
+		product.ServerConfigID = config.ID
+		product.TemplateID = 1
+		insert(product)
+
+		if product.Status == "reserved" {
+			insert(&model.Reservation{
+				StartsAt:       time.Now().Add(time.Hour),
+				EndsAt:         time.Now().Add(2 * time.Hour),
+				EndAction:      "destroy",
+				Status:         "scheduled",
+				Amount:         1,
+				UserID:         product.UserID,
+				OrganizationID: product.OrganizationID,
+				ProductID:      product.ID,
+			})
+		}
+	}
+	return tn
+}
+
+func (tn *tenants) router() *Router {
+	return &Router{
+		DB:     tn.db,
+		APIURL: "http://api.test",
+	}
+}
+
+// call runs a handler as user with body as its JSON input.
+func call(handler http.HandlerFunc, user *model.User, body interface{}) *httptest.ResponseRecorder {
+	b, _ := json.Marshal(body)
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(b))
+	r = withPrincipal(r, &Principal{UserID: user.ID, Username: user.Username})
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestAuthorizeProduct(t *testing.T) {
+	tn := newTenants(t)
+	router := tn.router()
+
+	tests := []struct {
+		user    *model.User
+		gcpID   string
+		action  string
+		allowed bool
+	}{
+		{tn.alice, "alice-box", actionDestroy, true},
+		{tn.bob, "alice-box", actionRead, false},
+		{tn.bob, "alice-box", actionDestroy, false},
+		// Being an admin elsewhere grants nothing.
+		{tn.bob, "acme-box", actionRead, false},
+		{tn.bob, "acme-box", actionDestroy, false},
+		{tn.carol, "globex-box", actionRead, false},
+		// Nor does sharing an organization grant access to personal servers.
+		{tn.carol, "alice-box", actionRead, false},
+		{tn.carol, "acme-box", actionDestroy, true},
+		{tn.dave, "acme-box", actionRead, true},
+		{tn.dave, "acme-box", actionDestroy, false},
+		{tn.alice, "acme-box", actionDestroy, true},
+	}
+	for _, test := range tests {
+		_, err := router.product(context.Background(), &Principal{UserID: test.user.ID}, test.gcpID, test.action)
+		if (err == nil) != test.allowed {
+			t.Errorf("%s %s %s: got %v, want allowed %v", test.user.Username, test.action, test.gcpID, err, test.allowed)
+		}
+	}
+}
+
+func TestKillServerCrossTenant(t *testing.T) {
+	tn := newTenants(t)
+	router := tn.router()
+
+	for _, gcpID := range []string{"alice-box", "acme-box"} {
+		w := call(router.KillServer, tn.bob, KillServerReq{GCPId: gcpID})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("bob destroying %s: got %d, want %d", gcpID, w.Code, http.StatusBadRequest)
+		}
+		var product model.Product
+		err := tn.db.NewSelect().Model(&product).Where("gcp_id = ?", gcpID).Scan(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if product.Status != "active" {
+			t.Errorf("%s is %s after a denied destroy", gcpID, product.Status)
+		}
+	}
+
+	// Allowed through the policy, then refused for being a reservation, so
+	// the test never reaches the provider.
+	w := call(router.KillServer, tn.carol, KillServerReq{GCPId: "acme-reserved"})
+	if !bytes.Contains(w.Body.Bytes(), []byte("Cancel the reservation instead.")) {
+		t.Errorf("carol destroying acme-reserved: got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestSetServerTTLCrossTenant(t *testing.T) {
+	tn := newTenants(t)
+	router := tn.router()
+
+	tests := []struct {
+		user   *model.User
+		gcpID  string
+		status int
+	}{
+		{tn.bob, "alice-box", http.StatusBadRequest},
+		{tn.bob, "acme-box", http.StatusBadRequest},
+		{tn.dave, "acme-box", http.StatusBadRequest},
+		{tn.carol, "acme-box", http.StatusOK},
+	}
+	for _, test := range tests {
+		w := call(router.SetServerTTL, test.user, SetServerTTLReq{GCPId: test.gcpID, TTLHours: 1})
+		if w.Code != test.status {
+			t.Errorf("%s setting the TTL of %s: got %d, want %d", test.user.Username, test.gcpID, w.Code, test.status)
+		}
+	}
+}
+
+func TestCancelReservationCrossTenant(t *testing.T) {
+	ctx := context.Background()
+	tn := newTenants(t)
+	router := tn.router()
+
+	reservation := func(gcpID string) *model.Reservation {
+		reservation := new(model.Reservation)
+		err := tn.db.NewSelect().Model(reservation).
+			Where("product_id = (SELECT id FROM products WHERE gcp_id = ?)", gcpID).Scan(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reservation
+	}
+
+	personal := reservation("alice-reserved")
+	org := reservation("acme-reserved")
+	tests := []struct {
+		user        *model.User
+		reservation *model.Reservation
+		status      int
+	}{
+		{tn.bob, personal, http.StatusBadRequest},
+		{tn.bob, org, http.StatusBadRequest},
+		{tn.dave, org, http.StatusBadRequest},
+		{tn.carol, org, http.StatusOK},
+	}
+	for _, test := range tests {
+		w := call(router.CancelReservation, test.user, CancelReservationReq{ID: test.reservation.ID})
+		if w.Code != test.status {
+			t.Errorf("%s cancelling reservation %d: got %d, want %d", test.user.Username, test.reservation.ID, w.Code, test.status)
+		}
+	}
+
+	if status := reservation("alice-reserved").Status; status != "scheduled" {
+		t.Errorf("alice's reservation is %s after a denied cancel", status)
+	}
+	if status := reservation("acme-reserved").Status; status != "cancelled" {
+		t.Errorf("acme's reservation is %s, want cancelled", status)
+	}
+}
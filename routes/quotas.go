@@ -0,0 +1,407 @@
+package routes
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/uptrace/bun"
+
+	"gpu/model"
+	"gpu/util"
+)
+
+// defaultQuota applies to every account without an override.
+var defaultQuota = model.QuotaLimits{
+	MaxProducts:       4,
+	MaxGPUs:           map[string]int{"*": 8},
+	MaxStorage:        2000,
+	MaxLaunchesPerDay: 20,
+}
+
+// quotaError is a launch refused by a quota, its text is shown to the user.
+type quotaError string
+
+func (e quotaError) Error() string {
+	return string(e)
+}
+
+// QuotaUsage is what an account holds, counted the way QuotaLimits caps it.
+type QuotaUsage struct {
+	Products      int            `json:"products"`
+	GPUs          map[string]int `json:"gpus"` // by GPU type, "*" for all types
+	Storage       int            `json:"storage"`
+	LaunchesToday int            `json:"launches_today"`
+}
+
+// accountProducts selects the products billed to a personal account, or an
+// organization when orgID isn't 0.
+func accountProducts(db bun.IDB, uid, orgID int64) *bun.SelectQuery {
+	q := db.NewSelect().Model((*model.Product)(nil))
+	if orgID != 0 {
+		return q.Where("product.organization_id = ?", orgID)
+	}
+	return q.Where("product.user_id = ?", uid).Where("product.organization_id IS NULL")
+}
+
+// quotaLimits returns the limits of an account, the defaults with its override
+// applied, and the override if there is one.
+func quotaLimits(ctx context.Context, db bun.IDB, uid, orgID int64) (model.QuotaLimits, *model.Quota, error) {
+	limits := defaultQuota
+	limits.MaxGPUs = map[string]int{}
+	for gpuType, max := range defaultQuota.MaxGPUs {
+		limits.MaxGPUs[gpuType] = max
+	}
+
+	quota := new(model.Quota)
+	q := db.NewSelect().Model(quota)
+	if orgID != 0 {
+		q = q.Where("organization_id = ?", orgID)
+	} else {
+		q = q.Where("user_id = ?", uid)
+	}
+	err := q.Scan(ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return limits, nil, nil
+	}
+	if err != nil {
+		return limits, nil, err
+	}
+
+	if quota.MaxProducts != nil {
+		limits.MaxProducts = *quota.MaxProducts
+	}
+	for gpuType, max := range quota.MaxGPUs {
+		limits.MaxGPUs[gpuType] = max
+	}
+	if quota.MaxStorage != nil {
+		limits.MaxStorage = *quota.MaxStorage
+	}
+	if quota.MaxLaunchesPerDay != nil {
+		limits.MaxLaunchesPerDay = *quota.MaxLaunchesPerDay
+	}
+	return limits, quota, nil
+}
+
+// quotaUsage counts what an account holds. Failed launches never got an
+// instance, so only destroyed and failed products are left out. Stopped
+// servers keep their disk and hold their slot until destroyed.
+func quotaUsage(ctx context.Context, db bun.IDB, uid, orgID int64) (QuotaUsage, error) {
+	usage := QuotaUsage{
+		GPUs: map[string]int{},
+	}
+
+	err := accountProducts(db, uid, orgID).ColumnExpr("COUNT(*)").ColumnExpr("COALESCE(SUM(product.storage), 0)").
+		Where("product.status NOT IN ('destroyed', 'failed')").Scan(ctx, &usage.Products, &usage.Storage)
+	if err != nil {
+		return usage, err
+	}
+
+	var gpus []struct {
+		GPUType string `bun:"gpu_type"`
+		Count   int    `bun:"count"`
+	}
+	err = accountProducts(db, uid, orgID).Join("JOIN server_types AS server_config ON server_config.id = product.server_config_id").
+		ColumnExpr("server_config.gpu_type").ColumnExpr("SUM(server_config.gpu_count) AS count").
+		Where("product.status NOT IN ('destroyed', 'failed')").Where("server_config.gpu_count > 0").
+		Group("server_config.gpu_type").Scan(ctx, &gpus)
+	if err != nil {
+		return usage, err
+	}
+	for _, g := range gpus {
+		usage.GPUs[g.GPUType] = g.Count
+		usage.GPUs["*"] += g.Count
+	}
+
+	usage.LaunchesToday, err = accountProducts(db, uid, orgID).Where("product.created_at > ?", time.Now().Add(-24*time.Hour)).Count(ctx)
+	return usage, err
+}
+
+// over reports whether adding n to used goes over limit.
+func over(limit, used, n int) bool {
+	return limit != model.Unlimited && used+n > limit
+}
+
+// quotaExceeded returns why launching storage GB on config would go over
+// limits, or "".
+func quotaExceeded(limits model.QuotaLimits, usage QuotaUsage, config *model.ServerConfig, storage int) string {
+	if over(limits.MaxProducts, usage.Products, 1) {
+		return fmt.Sprintf("Quota reached: %d servers.", limits.MaxProducts)
+	}
+	if over(limits.MaxStorage, usage.Storage, storage) {
+		return fmt.Sprintf("Quota reached: %dGB of storage.", limits.MaxStorage)
+	}
+	if over(limits.MaxLaunchesPerDay, usage.LaunchesToday, 1) {
+		return fmt.Sprintf("Quota reached: %d launches a day.", limits.MaxLaunchesPerDay)
+	}
+	if config.GPUCount > 0 {
+		if max, ok := limits.MaxGPUs[config.GPUType]; ok && over(max, usage.GPUs[config.GPUType], config.GPUCount) {
+			return fmt.Sprintf("Quota reached: %d %s GPUs.", max, config.GPUType)
+		}
+		if max, ok := limits.MaxGPUs["*"]; ok && over(max, usage.GPUs["*"], config.GPUCount) {
+			return fmt.Sprintf("Quota reached: %d GPUs.", max)
+		}
+	}
+	return ""
+}
+
+// lockAccount locks the account until tx ends, so concurrent launches and
+// resumes are counted and charged one after the other.
+func lockAccount(ctx context.Context, tx bun.Tx, uid, orgID int64) error {
+	account := fmt.Sprintf("quota:user:%d", uid)
+	if orgID != 0 {
+		account = fmt.Sprintf("quota:org:%d", orgID)
+	}
+	_, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext(?))", account)
+	return err
+}
+
+// checkQuota returns a quotaError if launching storage GB on config would put
+// the account over its quota. It locks the account until tx ends, so
+// concurrent launches are counted one after the other.
+func checkQuota(ctx context.Context, tx bun.Tx, uid, orgID int64, config *model.ServerConfig, storage int) error {
+	err := lockAccount(ctx, tx, uid, orgID)
+	if err != nil {
+		return err
+	}
+
+	limits, _, err := quotaLimits(ctx, tx, uid, orgID)
+	if err != nil {
+		return err
+	}
+	usage, err := quotaUsage(ctx, tx, uid, orgID)
+	if err != nil {
+		return err
+	}
+	if msg := quotaExceeded(limits, usage, config, storage); msg != "" {
+		return quotaError(msg)
+	}
+	return nil
+}
+
+type QuotasRes struct {
+	Success bool              `json:"success"`
+	Limits  model.QuotaLimits `json:"limits"`
+	Usage   QuotaUsage        `json:"usage"`
+}
+
+// Quotas shows the caller's limits and usage, or an organization's with org_id.
+func (router *Router) Quotas(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	p := principal(r)
+
+	orgID, err := orgParam(r)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid organization.")
+		return
+	}
+	if orgID != 0 {
+		if _, err := router.authorizeOrg(ctx, p, orgID, validRole); err != nil {
+			util.ResError(err, w, http.StatusBadRequest, "Invalid organization.")
+			return
+		}
+	}
+
+	limits, _, err := quotaLimits(ctx, router.DB, p.UserID, orgID)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+	usage, err := quotaUsage(ctx, router.DB, p.UserID, orgID)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+
+	res := QuotasRes{
+		Limits:  limits,
+		Usage:   usage,
+		Success: true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+type AdminQuotaRes struct {
+	Success  bool              `json:"success"`
+	Override *model.Quota      `json:"override"` // null when the defaults apply
+	Limits   model.QuotaLimits `json:"limits"`
+	Usage    QuotaUsage        `json:"usage"`
+}
+
+// adminAccount reads the user_id or org_id query parameter.
+func adminAccount(r *http.Request) (int64, int64, error) {
+	orgID, err := orgParam(r)
+	if err != nil || orgID != 0 {
+		return 0, orgID, err
+	}
+	uid, err := userParam(r)
+	return uid, 0, err
+}
+
+// AdminQuota shows the override, limits and usage of a user_id or org_id.
+func (router *Router) AdminQuota(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	uid, orgID, err := adminAccount(r)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid account.")
+		return
+	}
+
+	limits, quota, err := quotaLimits(ctx, router.DB, uid, orgID)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+	usage, err := quotaUsage(ctx, router.DB, uid, orgID)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+
+	res := AdminQuotaRes{
+		Override: quota,
+		Limits:   limits,
+		Usage:    usage,
+		Success:  true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+// AdminQuotaReq overrides the quota of one account, a user or an organization.
+// Fields left null keep the default, -1 is unlimited and 0 allows nothing.
+type AdminQuotaReq struct {
+	UserID            int64          `json:"user_id"`
+	OrganizationID    int64          `json:"organization_id"`
+	MaxProducts       *int           `json:"max_products"`
+	MaxGPUs           map[string]int `json:"max_gpus"`
+	MaxStorage        *int           `json:"max_storage"`
+	MaxLaunchesPerDay *int           `json:"max_launches_per_day"`
+}
+
+func validQuota(req *AdminQuotaReq) bool {
+	if (req.UserID == 0) == (req.OrganizationID == 0) {
+		return false
+	}
+	for _, limit := range []*int{req.MaxProducts, req.MaxStorage, req.MaxLaunchesPerDay} {
+		if limit != nil && *limit < model.Unlimited {
+			return false
+		}
+	}
+	for gpuType, max := range req.MaxGPUs {
+		if gpuType == "" || max < model.Unlimited {
+			return false
+		}
+	}
+	return true
+}
+
+func quotaTarget(uid, orgID int64) string {
+	if orgID != 0 {
+		return auditTarget("org", orgID)
+	}
+	return auditTarget("user", uid)
+}
+
+// AdminSetQuota replaces the override of an account. Servers already over the
+// new limits keep running, only new launches are refused.
+func (router *Router) AdminSetQuota(w http.ResponseWriter, r *http.Request) {
+	var req AdminQuotaReq
+	ctx := context.Background()
+	uid := principal(r).UserID
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to decode input.")
+		return
+	}
+
+	if !validQuota(&req) {
+		util.ResError(nil, w, http.StatusBadRequest, "Invalid quota.")
+		return
+	}
+
+	quota := &model.Quota{
+		UserID:            req.UserID,
+		OrganizationID:    req.OrganizationID,
+		MaxProducts:       req.MaxProducts,
+		MaxGPUs:           req.MaxGPUs,
+		MaxStorage:        req.MaxStorage,
+		MaxLaunchesPerDay: req.MaxLaunchesPerDay,
+		UpdatedAt:         time.Now(),
+		UpdatedByID:       uid,
+	}
+	conflict := "CONFLICT (user_id) DO UPDATE"
+	if req.OrganizationID != 0 {
+		conflict = "CONFLICT (organization_id) DO UPDATE"
+	}
+	_, err = router.DB.NewInsert().Model(quota).On(conflict).
+		Set("max_products = EXCLUDED.max_products").
+		Set("max_gpus = EXCLUDED.max_gpus").
+		Set("max_storage = EXCLUDED.max_storage").
+		Set("max_launches_per_day = EXCLUDED.max_launches_per_day").
+		Set("updated_at = EXCLUDED.updated_at").
+		Set("updated_by_id = EXCLUDED.updated_by_id").
+		Returning("*").Exec(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+	router.audit(r, uid, "quota.update", quotaTarget(req.UserID, req.OrganizationID), true)
+	router.Notifier.Account(ctx, req.UserID, req.OrganizationID, "admin.quota", "", map[string]interface{}{})
+
+	res := AdminRes{
+		Success: true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+type AdminResetQuotaReq struct {
+	UserID         int64 `json:"user_id"`
+	OrganizationID int64 `json:"organization_id"`
+}
+
+// AdminResetQuota drops the override of an account, so the defaults apply again.
+func (router *Router) AdminResetQuota(w http.ResponseWriter, r *http.Request) {
+	var req AdminResetQuotaReq
+	ctx := context.Background()
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to decode input.")
+		return
+	}
+
+	q := router.DB.NewDelete().Model((*model.Quota)(nil))
+	switch {
+	case req.OrganizationID != 0 && req.UserID == 0:
+		q = q.Where("organization_id = ?", req.OrganizationID)
+	case req.UserID != 0 && req.OrganizationID == 0:
+		q = q.Where("user_id = ?", req.UserID)
+	default:
+		util.ResError(nil, w, http.StatusBadRequest, "Invalid account.")
+		return
+	}
+	_, err = q.Exec(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+	router.audit(r, principal(r).UserID, "quota.reset", quotaTarget(req.UserID, req.OrganizationID), true)
+	router.Notifier.Account(ctx, req.UserID, req.OrganizationID, "admin.quota", "", map[string]interface{}{})
+
+	res := AdminRes{
+		Success: true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
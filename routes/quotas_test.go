@@ -0,0 +1,71 @@
+package routes
+
+import (
+	"testing"
+
+	"gpu/model"
+)
+
+func TestQuotaExceeded(t *testing.T) {
+	h100 := &model.ServerConfig{GPUType: "nvidia-h100-80gb", GPUCount: 2}
+	cpu := &model.ServerConfig{}
+	limits := func(products, storage, launches int, gpus map[string]int) model.QuotaLimits {
+		return model.QuotaLimits{MaxProducts: products, MaxStorage: storage, MaxLaunchesPerDay: launches, MaxGPUs: gpus}
+	}
+	unlimited := limits(model.Unlimited, model.Unlimited, model.Unlimited, map[string]int{})
+
+	tests := []struct {
+		name    string
+		limits  model.QuotaLimits
+		usage   QuotaUsage
+		config  *model.ServerConfig
+		storage int
+		ok      bool
+	}{
+		{"defaults, nothing used", defaultQuota, QuotaUsage{}, h100, 100, true},
+		{"unlimited", unlimited, QuotaUsage{Products: 100, Storage: 1e6, LaunchesToday: 100, GPUs: map[string]int{"*": 64}}, h100, 1000, true},
+		{"last product slot", limits(2, -1, -1, nil), QuotaUsage{Products: 1}, cpu, 0, true},
+		{"products full", limits(2, -1, -1, nil), QuotaUsage{Products: 2}, cpu, 0, false},
+		{"zero products suspends", limits(0, -1, -1, nil), QuotaUsage{}, cpu, 0, false},
+		{"storage fits exactly", limits(-1, 500, -1, nil), QuotaUsage{Storage: 400}, cpu, 100, true},
+		{"storage over", limits(-1, 500, -1, nil), QuotaUsage{Storage: 400}, cpu, 101, false},
+		{"zero storage", limits(-1, 0, -1, nil), QuotaUsage{}, cpu, 10, false},
+		{"launches left", limits(-1, -1, 20, nil), QuotaUsage{LaunchesToday: 19}, cpu, 0, true},
+		{"launches used up", limits(-1, -1, 20, nil), QuotaUsage{LaunchesToday: 20}, cpu, 0, false},
+		{"GPU type fits", limits(-1, -1, -1, map[string]int{"nvidia-h100-80gb": 4}), QuotaUsage{GPUs: map[string]int{"nvidia-h100-80gb": 2}}, h100, 0, true},
+		{"GPU type over", limits(-1, -1, -1, map[string]int{"nvidia-h100-80gb": 3}), QuotaUsage{GPUs: map[string]int{"nvidia-h100-80gb": 2}}, h100, 0, false},
+		{"GPU type blocked", limits(-1, -1, -1, map[string]int{"nvidia-h100-80gb": 0}), QuotaUsage{}, h100, 0, false},
+		{"other GPU type blocked", limits(-1, -1, -1, map[string]int{"nvidia-l4": 0}), QuotaUsage{}, h100, 0, true},
+		{"GPU type unlimited under a total", limits(-1, -1, -1, map[string]int{"nvidia-h100-80gb": -1, "*": 8}), QuotaUsage{GPUs: map[string]int{"*": 7}}, h100, 0, false},
+		{"all GPUs blocked", limits(-1, -1, -1, map[string]int{"*": 0}), QuotaUsage{}, h100, 0, false},
+		{"all GPUs blocked, CPU launch", limits(-1, -1, -1, map[string]int{"*": 0}), QuotaUsage{}, cpu, 0, true},
+	}
+	for _, tt := range tests {
+		msg := quotaExceeded(tt.limits, tt.usage, tt.config, tt.storage)
+		if (msg == "") != tt.ok {
+			t.Errorf("%s: quotaExceeded = %q, want ok %v", tt.name, msg, tt.ok)
+		}
+	}
+}
+
+func TestValidQuota(t *testing.T) {
+	n := func(v int) *int { return &v }
+	tests := []struct {
+		name string
+		req  AdminQuotaReq
+		ok   bool
+	}{
+		{"zero is a limit", AdminQuotaReq{UserID: 1, MaxProducts: n(0), MaxGPUs: map[string]int{"nvidia-h100-80gb": 0}}, true},
+		{"unlimited", AdminQuotaReq{OrganizationID: 1, MaxStorage: n(model.Unlimited)}, true},
+		{"below unlimited", AdminQuotaReq{UserID: 1, MaxLaunchesPerDay: n(-2)}, false},
+		{"GPU below unlimited", AdminQuotaReq{UserID: 1, MaxGPUs: map[string]int{"*": -2}}, false},
+		{"empty GPU type", AdminQuotaReq{UserID: 1, MaxGPUs: map[string]int{"": 1}}, false},
+		{"no account", AdminQuotaReq{MaxProducts: n(1)}, false},
+		{"both accounts", AdminQuotaReq{UserID: 1, OrganizationID: 1}, false},
+	}
+	for _, tt := range tests {
+		if ok := validQuota(&tt.req); ok != tt.ok {
+			t.Errorf("%s: validQuota = %v, want %v", tt.name, ok, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/goombaio/namegenerator"
+	"github.com/uptrace/bun"
+
+	"gpu/model"
+	"gpu/scan"
+	"gpu/util"
+)
+
+const (
+	maxReservation        = 7 * 24 * time.Hour
+	maxReservationAdvance = 90 * 24 * time.Hour
+)
+
+var errNotScheduled = errors.New("Only scheduled reservations can be cancelled.")
+
+type ReservationsRes struct {
+	Success      bool                 `json:"success"`
+	Reservations []*model.Reservation `json:"reservations"`
+	Total        int                  `json:"total"`
+}
+
+// Reservations lists the caller's reservations, or an organization's with org_id.
+func (router *Router) Reservations(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	p := principal(r)
+	limit, offset := pageParams(r)
+
+	orgID, err := orgParam(r)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid organization.")
+		return
+	}
+
+	reservations := []*model.Reservation{}
+	q := router.DB.NewSelect().Model(&reservations).Relation("Product").Relation("Product.ServerConfig")
+	if orgID != 0 {
+		if _, err := router.authorizeOrg(ctx, p, orgID, canUseServers); err != nil {
+			util.ResError(err, w, http.StatusBadRequest, "Invalid organization.")
+			return
+		}
+		q = q.Where("reservation.organization_id = ?", orgID)
+	} else {
+		q = q.Where("reservation.user_id = ?", p.UserID).Where("reservation.organization_id IS NULL")
+	}
+	total, err := q.OrderExpr("reservation.starts_at DESC").Limit(limit).Offset(offset).ScanAndCount(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+
+	res := ReservationsRes{
+		Reservations: reservations,
+		Total:        total,
+		Success:      true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+type CreateReservationReq struct {
+	SpinServerReq
+	StartsAt  time.Time `json:"starts_at"`
+	EndsAt    time.Time `json:"ends_at"`
+	EndAction string    `json:"end_action"` // destroy or stop, destroy by default
+}
+
+type ReservationRes struct {
+	Success     bool               `json:"success"`
+	Reservation *model.Reservation `json:"reservation"`
+}
+
+// validReservation returns the message for a window that can't be booked, or "".
+func validReservation(req *CreateReservationReq) string {
+	if req.TTLHours != 0 || req.IdleMinutes != 0 || req.ExpiryAction != "" {
+		return "Reservations end with their window, use end_action."
+	}
+	if req.EndAction == "" {
+		req.EndAction = "destroy"
+	}
+	if req.EndAction != "destroy" && req.EndAction != "stop" {
+		return "Invalid end action."
+	}
+
+	now := time.Now()
+	if req.StartsAt.Before(now.Add(scan.ProvisionLead)) {
+		return fmt.Sprintf("Reservations must start at least %d minutes from now.", int(scan.ProvisionLead.Minutes()))
+	}
+	if req.StartsAt.After(now.Add(maxReservationAdvance)) {
+		return "Reservations can start at most 90 days from now."
+	}
+	if !req.EndsAt.After(req.StartsAt) || req.EndsAt.Sub(req.StartsAt) > maxReservation {
+		return "Reservations last up to 7 days."
+	}
+	return ""
+}
+
+// CreateReservation books a config for a future window. The whole window is
+// charged now, by the started hour at the config's price, and the server is
+// launched shortly before it starts.
+func (router *Router) CreateReservation(w http.ResponseWriter, r *http.Request) {
+	var req CreateReservationReq
+	ctx := context.Background()
+	p := principal(r)
+	uid := p.UserID
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to decode input.")
+		return
+	}
+
+	if msg := validReservation(&req); msg != "" {
+		util.ResError(nil, w, http.StatusBadRequest, msg)
+		return
+	}
+
+	template, serverConfig, msg, err := router.launchTarget(ctx, p, &req.SpinServerReq)
+	if msg != "" {
+		util.ResError(err, w, http.StatusBadRequest, msg)
+		return
+	}
+
+	params, publicParams, err := util.ResolveParams(template.Params, req.Params)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Secret params are kept encrypted until launch, never in the product.
+	var secrets string
+	if len(params) > len(publicParams) {
+		if router.EncryptionKey == nil {
+			util.ResError(nil, w, http.StatusBadRequest, "Secret params can't be stored for reservations.")
+			return
+		}
+		secretParams := map[string]string{}
+		for name, value := range params {
+			if _, ok := publicParams[name]; !ok {
+				secretParams[name] = value
+			}
+		}
+		plain, _ := json.Marshal(secretParams)
+		secrets, err = util.Encrypt(router.EncryptionKey, string(plain))
+		if err != nil {
+			util.ResError(err, w, http.StatusBadRequest, "Failed to store params.")
+			return
+		}
+	}
+
+	amount := math.Ceil(req.EndsAt.Sub(req.StartsAt).Hours()) * serverConfig.Price
+	product := model.Product{
+		Price:          serverConfig.Price,
+		Status:         "reserved",
+		GCPID:          namegenerator.NewNameGenerator(time.Now().UTC().UnixNano()).Generate(),
+		Storage:        req.Storage,
+		UserID:         uid,
+		ServerConfigID: serverConfig.ID,
+		TemplateID:     template.ID,
+		OrganizationID: req.OrganizationID,
+		Params:         publicParams,
+		ExpiryAction:   req.EndAction,
+	}
+	reservation := model.Reservation{
+		StartsAt:       req.StartsAt,
+		EndsAt:         req.EndsAt,
+		EndAction:      req.EndAction,
+		Status:         "scheduled",
+		Amount:         amount,
+		Secrets:        secrets,
+		UserID:         uid,
+		OrganizationID: req.OrganizationID,
+	}
+
+	// A reserved product holds its quota from booking until the window ends.
+	err = router.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		err := checkQuota(ctx, tx, uid, req.OrganizationID, serverConfig, req.Storage)
+		if err != nil {
+			return err
+		}
+		err = checkSpend(ctx, tx, uid, req.OrganizationID, amount)
+		if err != nil {
+			return err
+		}
+		_, err = tx.NewInsert().Model(&product).Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		purchase := model.Purchase{
+			UserID:         uid,
+			ProductID:      product.ID,
+			Amount:         amount,
+			OrganizationID: req.OrganizationID,
+		}
+		_, err = tx.NewInsert().Model(&purchase).Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		reservation.ProductID = product.ID
+		_, err = tx.NewInsert().Model(&reservation).Exec(ctx)
+		return err
+	})
+	var quotaErr quotaError
+	if errors.As(err, &quotaErr) {
+		router.audit(r, uid, "reservation.create", auditTarget("config", serverConfig.ID), false)
+		util.ResError(err, w, http.StatusBadRequest, quotaErr.Error())
+		return
+	}
+	var spendErr spendError
+	if errors.As(err, &spendErr) {
+		router.audit(r, uid, "reservation.create", auditTarget("config", serverConfig.ID), false)
+		util.ResError(err, w, http.StatusBadRequest, spendErr.msg)
+		return
+	}
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+	router.audit(r, uid, "reservation.create", auditTarget("reservation", reservation.ID), true)
+
+	reservation.Product = &product
+	res := ReservationRes{
+		Reservation: &reservation,
+		Success:     true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+type CancelReservationReq struct {
+	ID int64 `json:"id"`
+}
+
+// CancelReservation refunds a reservation that hasn't started provisioning.
+// Once it has, destroy its server instead.
+func (router *Router) CancelReservation(w http.ResponseWriter, r *http.Request) {
+	var req CancelReservationReq
+	ctx := context.Background()
+	p := principal(r)
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to decode input.")
+		return
+	}
+
+	reservation := &model.Reservation{
+		ID: req.ID,
+	}
+	err = router.DB.NewSelect().Model(reservation).WherePK().Relation("Product").Scan(ctx)
+	if err == nil {
+		err = router.authorizeProduct(ctx, p, reservation.Product, actionDestroy)
+	}
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid reservation.")
+		return
+	}
+
+	err = router.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		result, err := tx.NewUpdate().Model(reservation).Set("status = 'cancelled'").WherePK().Where("status = 'scheduled'").Exec(ctx)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return errNotScheduled
+		}
+		reservation.Status = "cancelled"
+
+		_, err = tx.NewUpdate().Model((*model.Product)(nil)).Set("status = 'destroyed'").Where("id = ?", reservation.ProductID).Exec(ctx)
+		if err != nil {
+			return err
+		}
+		return scan.RefundReservation(ctx, tx, reservation)
+	})
+	if errors.Is(err, errNotScheduled) {
+		util.ResError(err, w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+	router.audit(r, p.UserID, "reservation.cancel", auditTarget("reservation", reservation.ID), true)
+
+	res := ReservationRes{
+		Reservation: reservation,
+		Success:     true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
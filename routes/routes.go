@@ -5,31 +5,54 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/golang-jwt/jwt"
 	"github.com/uptrace/bun"
 
+	"gpu/events"
+	"gpu/model"
+	"gpu/notify"
 	"gpu/util"
 )
 
 type Router struct {
-	DB            *bun.DB
-	JwtSecret     string
-	StripeSecret  string
-	StripeWebhook string
-	GCPComputeKey string
-	Dev           bool
+	DB               *bun.DB
+	KeySet           *util.KeySet
+	StripeSecret     string
+	StripeWebhook    string
+	GCPComputeKey    string
+	AppURL           string
+	APIURL           string // where instances report heartbeats, empty disables idle shutdown
+	RegistrationMode string // open, invite or closed, anything else counts as closed
+	EncryptionKey    []byte // for stored secrets, nil disables storing them
+	ContainerBase    string // machine image container templates run on
+	Mailer           util.Mailer
+	Notifier         *notify.Notifier
+	Bus              *events.Bus // streams changes to Events
+	OAuth            map[string]*util.OAuthProvider
+	Dev              bool
 }
 
-func NewRouter(db *bun.DB, jwtSecret, stripeSecret, stripeWebhook, GCPComputeKey string, dev bool) *Router {
+func NewRouter(db *bun.DB, keys *util.KeySet, stripeSecret, stripeWebhook, GCPComputeKey, appURL, apiURL, registrationMode string, encryptionKey []byte, containerBase string, mailer util.Mailer, bus *events.Bus, oauth map[string]*util.OAuthProvider, dev bool) *Router {
 	return &Router{
-		DB:            db,
-		JwtSecret:     jwtSecret,
-		StripeSecret:  stripeSecret,
-		StripeWebhook: stripeWebhook,
-		GCPComputeKey: GCPComputeKey,
-		Dev:           dev,
+		DB:               db,
+		KeySet:           keys,
+		StripeSecret:     stripeSecret,
+		StripeWebhook:    stripeWebhook,
+		GCPComputeKey:    GCPComputeKey,
+		AppURL:           appURL,
+		APIURL:           apiURL,
+		RegistrationMode: registrationMode,
+		EncryptionKey:    encryptionKey,
+		ContainerBase:    containerBase,
+		Mailer:           mailer,
+		Notifier:         notify.New(db, mailer),
+		Bus:              bus,
+		OAuth:            oauth,
+		Dev:              dev,
 	}
 }
 
@@ -38,23 +61,129 @@ func (router *Router) AuthMiddleware(next http.Handler) http.Handler {
 		authHeader := strings.Split(r.Header.Get("Authorization"), "Bearer ")
 		if len(authHeader) != 2 {
 			util.ResError(errors.New(""), w, http.StatusUnauthorized, "Malformed token")
+		} else if util.IsAPIKey(authHeader[1]) {
+			p, err := router.apiKeyPrincipal(authHeader[1])
+			if err != nil {
+				util.ResError(err, w, http.StatusUnauthorized, "Unauthorized")
+				return
+			}
+			next.ServeHTTP(w, withPrincipal(r, p))
 		} else {
 			jwtToken := authHeader[1]
-			token, err := jwt.Parse(jwtToken, func(token *jwt.Token) (interface{}, error) {
-				if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-					return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+			token, err := router.KeySet.Parse(jwtToken)
+
+			// Typed tokens such as 2FA challenges are only good for their own endpoint.
+			if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid && claims["typ"] == nil {
+				p, err := principalFromClaims(claims)
+				if err != nil {
+					util.ResError(err, w, http.StatusUnauthorized, "Unauthorized")
+					return
 				}
-				return []byte(router.JwtSecret), nil
-			})
-
-			if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-				ctx := context.WithValue(r.Context(), "props", claims)
-				// Access context values in handlers like this
-				// props, _ := r.Context().Value("props").(jwt.MapClaims)
-				next.ServeHTTP(w, r.WithContext(ctx))
+				if !router.userActive(p.UserID) {
+					util.ResError(fmt.Errorf("Disabled user %d", p.UserID), w, http.StatusUnauthorized, "Disabled.")
+					return
+				}
+				// Handlers read the caller with principal(r).
+				next.ServeHTTP(w, withPrincipal(r, p))
 			} else {
 				util.ResError(err, w, http.StatusUnauthorized, "Unauthorized")
 			}
 		}
 	})
 }
+
+// userActive rechecks the account behind a token, so disabling a user takes
+// effect before their token expires.
+func (router *Router) userActive(uid int64) bool {
+	active, err := router.DB.NewSelect().Model((*model.User)(nil)).Where("id = ?", uid).Where("active = true").Exists(context.Background())
+	return err == nil && active
+}
+
+// apiKeyPrincipal resolves an API key into its user, plus the key id and its
+// scopes so RequireScope can restrict what it may do.
+func (router *Router) apiKeyPrincipal(key string) (*Principal, error) {
+	ctx := context.Background()
+
+	prefix, err := util.ParseAPIKeyPrefix(key)
+	if err != nil {
+		return nil, err
+	}
+
+	apiKey := new(model.APIKey)
+	err = router.DB.NewSelect().Model(apiKey).Where("prefix = ?", prefix).Relation("User").Scan(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if !util.CheckAPIKeyHash(key, apiKey.KeyHash) {
+		return nil, fmt.Errorf("Invalid API key %s", prefix)
+	}
+	if apiKey.Revoked {
+		return nil, fmt.Errorf("Revoked API key %s", prefix)
+	}
+	if !apiKey.ExpiresAt.IsZero() && apiKey.ExpiresAt.Before(time.Now()) {
+		return nil, fmt.Errorf("Expired API key %s", prefix)
+	}
+	if !apiKey.User.Active {
+		return nil, fmt.Errorf("Disabled user %d", apiKey.UserID)
+	}
+
+	_, err = router.DB.NewUpdate().Model(apiKey).Set("last_used_at = current_timestamp").WherePK().Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Principal{
+		UserID:   apiKey.UserID,
+		Username: apiKey.User.Username,
+		Admin:    apiKey.User.Admin,
+		KeyID:    apiKey.ID,
+		Scopes:   apiKey.Scopes,
+	}, nil
+}
+
+// RequireScope limits API keys to the routes their scopes allow. Session
+// tokens from /login carry no scopes and are not restricted.
+func (router *Router) RequireScope(scope string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p := principal(r); p.IsAPIKey() && !p.HasScope(scope) {
+			util.ResError(fmt.Errorf("API key missing scope %s", scope), w, http.StatusForbidden, "Insufficient scope.")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AdminMiddleware only lets through users that are admins in the database,
+// not just in their token claims. It must run after AuthMiddleware.
+func (router *Router) AdminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := principal(r)
+		if !p.Admin {
+			util.ResError(fmt.Errorf("Non-admin %d on %s", p.UserID, r.URL.Path), w, http.StatusForbidden, "Forbidden")
+			return
+		}
+
+		admin, err := router.DB.NewSelect().Model((*model.User)(nil)).Where("id = ?", p.UserID).Where("admin = true").Where("active = true").Exists(context.Background())
+		if err != nil || !admin {
+			util.ResError(err, w, http.StatusForbidden, "Forbidden")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// pageParams reads limit and offset query parameters, defaulting to the first 50 rows.
+func pageParams(r *http.Request) (int, int) {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	return limit, offset
+}
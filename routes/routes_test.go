@@ -0,0 +1,146 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+
+	"gpu/model"
+	"gpu/util"
+)
+
+func TestRequireScope(t *testing.T) {
+	router := &Router{}
+	handler := router.RequireScope("servers:write", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name string
+		p    *Principal
+		code int
+	}{
+		{"session token", &Principal{UserID: 1}, http.StatusOK},
+		{"key with scope", &Principal{UserID: 1, KeyID: 2, Scopes: []string{"servers:read", "servers:write"}}, http.StatusOK},
+		{"key without scope", &Principal{UserID: 1, KeyID: 2, Scopes: []string{"servers:read"}}, http.StatusForbidden},
+		{"key without scopes", &Principal{UserID: 1, KeyID: 2}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, withPrincipal(httptest.NewRequest(http.MethodPost, "/spinServer", nil), tt.p))
+		if w.Code != tt.code {
+			t.Errorf("%s: code %d, want %d", tt.name, w.Code, tt.code)
+		}
+	}
+}
+
+func TestEventAllowed(t *testing.T) {
+	session := &Principal{UserID: 1}
+	key := &Principal{UserID: 1, KeyID: 2, Scopes: []string{"servers:read"}}
+
+	tests := []struct {
+		p         *Principal
+		eventType string
+		ok        bool
+	}{
+		{session, "product", true},
+		{session, "purchase", true},
+		{session, "notification", true},
+		{key, "product", true},
+		{key, "purchase", false},
+		{key, "deposit", false},
+		{key, "notification", false},
+		{key, "unknown", false},
+	}
+	for _, tt := range tests {
+		if ok := eventAllowed(tt.p, tt.eventType); ok != tt.ok {
+			t.Errorf("eventAllowed(key %v, %s) = %v, want %v", tt.p.IsAPIKey(), tt.eventType, ok, tt.ok)
+		}
+	}
+}
+
+func TestPrincipalExpiry(t *testing.T) {
+	p, err := principalFromClaims(jwt.MapClaims{"sub": float64(1), "exp": float64(time.Now().Add(-time.Minute).Unix())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.expired() {
+		t.Error("principal of an expired token not expired")
+	}
+
+	p, err = principalFromClaims(jwt.MapClaims{"sub": float64(1), "exp": float64(time.Now().Add(time.Hour).Unix())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.expired() {
+		t.Error("principal of a valid token expired")
+	}
+
+	// The stream is closed before checking the user in the database.
+	if (&Router{}).streamAllowed(context.Background(), &Principal{UserID: 1, ExpiresAt: time.Now().Add(-time.Second)}) {
+		t.Error("stream allowed after the token expired")
+	}
+	if (&Principal{UserID: 1, KeyID: 2}).expired() {
+		t.Error("API key principal expired")
+	}
+}
+
+func TestAPIKeyPrincipal(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+	router := &Router{DB: db}
+	alice := testUser(t, db, "alice")
+	disabled := testUser(t, db, "mallory")
+	_, err := db.NewUpdate().Model(disabled).Set("active = false").WherePK().Exec(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newKey := func(user *model.User, revoked bool, expiresAt time.Time) string {
+		key, prefix, hash, err := util.GenerateAPIKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.NewInsert().Model(&model.APIKey{
+			Name:      "test",
+			Prefix:    prefix,
+			KeyHash:   hash,
+			Scopes:    []string{"servers:read"},
+			ExpiresAt: expiresAt,
+			Revoked:   revoked,
+			UserID:    user.ID,
+		}).Exec(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+
+	valid := newKey(alice, false, time.Now().Add(time.Hour))
+	p, err := router.apiKeyPrincipal(valid)
+	if err != nil {
+		t.Fatalf("valid key refused: %v", err)
+	}
+	if p.UserID != alice.ID || !p.IsAPIKey() || !p.HasScope("servers:read") || p.HasScope("servers:write") {
+		t.Errorf("valid key resolved to %+v", p)
+	}
+
+	prefix, _ := util.ParseAPIKeyPrefix(valid)
+	refused := map[string]string{
+		"revoked":      newKey(alice, true, time.Time{}),
+		"expired":      newKey(alice, false, time.Now().Add(-time.Minute)),
+		"disabled":     newKey(disabled, false, time.Time{}),
+		"wrong secret": util.APIKeyPrefix + prefix + "_" + "00000000000000000000000000000000000000000000000",
+		"unknown":      util.APIKeyPrefix + "ffffffff_secret",
+		"malformed":    util.APIKeyPrefix + "nosecret",
+	}
+	for name, key := range refused {
+		if p, err := router.apiKeyPrincipal(key); err == nil {
+			t.Errorf("%s key accepted as %+v", name, p)
+		}
+	}
+}
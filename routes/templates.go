@@ -0,0 +1,322 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"gpu/model"
+	"gpu/util"
+)
+
+type TemplateReq struct {
+	ID               int64                 `json:"id"` // ignored on create
+	Name             string                `json:"name"`
+	Description      string                `json:"description"`
+	Type             string                `json:"type"`
+	Kind             string                `json:"kind"`            // machine_image or container
+	Container        string                `json:"container"`       // image reference
+	OrganizationID   int64                 `json:"organization_id"` // shares the template with the organization
+	RegistryUsername string                `json:"registry_username"`
+	RegistryPassword string                `json:"registry_password"` // kept on update when empty
+	Params           []model.TemplateParam `json:"params"`
+	TemplateHardware
+}
+
+// minStorage is the smallest disk a template may ask for, and the default
+// when it doesn't.
+const minStorage = 100
+
+// TemplateHardware is what a template needs from a config.
+type TemplateHardware struct {
+	MinStorage   int      `json:"min_storage"`    // GB, minStorage when 0
+	MinGPUMemory int      `json:"min_gpu_memory"` // GB per GPU
+	MinGPUCount  int      `json:"min_gpu_count"`
+	GPUTypes     []string `json:"gpu_types"` // empty allows any
+}
+
+// validate returns the message for invalid requirements, or "".
+func (h *TemplateHardware) validate() string {
+	if h.MinStorage == 0 {
+		h.MinStorage = minStorage
+	}
+	if h.MinStorage < minStorage || h.MinStorage > 65536 {
+		return fmt.Sprintf("Storage must be between %dGB and 65536GB.", minStorage)
+	}
+	if h.MinGPUMemory < 0 || h.MinGPUCount < 0 || h.MinGPUCount > 16 {
+		return "Invalid GPU requirements."
+	}
+	for i, gpuType := range h.GPUTypes {
+		h.GPUTypes[i] = strings.TrimSpace(gpuType)
+		if h.GPUTypes[i] == "" {
+			return "Invalid GPU type."
+		}
+	}
+	return ""
+}
+
+func (h *TemplateHardware) apply(template *model.Template) {
+	template.MinStorage = h.MinStorage
+	template.MinGPUMemory = h.MinGPUMemory
+	template.MinGPUCount = h.MinGPUCount
+	template.GPUTypes = h.GPUTypes
+}
+
+// hardwareFits returns why template can't launch on config with storage GB of
+// disk, or "". searchCompatible is the same check in SQL.
+func hardwareFits(template *model.Template, config *model.ServerConfig, storage int) string {
+	if storage < template.MinStorage {
+		return fmt.Sprintf("This template needs %dGB.", template.MinStorage)
+	}
+	if config.MaxStorage > 0 && storage > config.MaxStorage {
+		return fmt.Sprintf("This config allows at most %dGB.", config.MaxStorage)
+	}
+	if config.GPUCount < template.MinGPUCount {
+		return fmt.Sprintf("This template needs %d GPUs.", template.MinGPUCount)
+	}
+	if config.GPUMemory < template.MinGPUMemory {
+		return fmt.Sprintf("This template needs GPUs with %dGB of memory.", template.MinGPUMemory)
+	}
+	if len(template.GPUTypes) > 0 {
+		for _, gpuType := range template.GPUTypes {
+			if gpuType == config.GPUType {
+				return ""
+			}
+		}
+		return "This template needs one of " + strings.Join(template.GPUTypes, ", ") + "."
+	}
+	return ""
+}
+
+type TemplateRes struct {
+	Success  bool            `json:"success"`
+	Template *model.Template `json:"template"`
+}
+
+// validateTemplate returns the message for an invalid user template, or "".
+func (router *Router) validateTemplate(ctx context.Context, p *Principal, req *TemplateReq) (string, error) {
+	req.Name = strings.TrimSpace(req.Name)
+	req.Container = strings.TrimSpace(req.Container)
+	req.RegistryUsername = strings.TrimSpace(req.RegistryUsername)
+
+	if req.Name == "" || len(req.Name) > 64 {
+		return "Invalid name.", nil
+	}
+
+	switch req.Kind {
+	case "machine_image":
+		if !util.ValidMachineImageRef(req.Container) {
+			return "Invalid machine image, use projects/<project>/global/machineImages/<name>.", nil
+		}
+		if req.RegistryUsername != "" || req.RegistryPassword != "" {
+			return "Registry credentials only apply to containers.", nil
+		}
+	case "container":
+		if router.ContainerBase == "" {
+			return "Container templates are not available.", nil
+		}
+		if !util.ValidContainerRef(req.Container) {
+			return "Invalid container image.", nil
+		}
+		if req.RegistryPassword != "" && router.EncryptionKey == nil {
+			return "Registry credentials are not available.", nil
+		}
+	default:
+		return "Invalid kind.", nil
+	}
+
+	if err := util.ValidateParamSchema(req.Params); err != nil {
+		return err.Error(), err
+	}
+	if msg := req.TemplateHardware.validate(); msg != "" {
+		return msg, nil
+	}
+
+	if req.OrganizationID != 0 {
+		if _, err := router.authorizeOrg(ctx, p, req.OrganizationID, canUseServers); err != nil {
+			return "Invalid organization.", err
+		}
+	}
+
+	return "", nil
+}
+
+func (router *Router) CreateTemplate(w http.ResponseWriter, r *http.Request) {
+	var req TemplateReq
+	ctx := context.Background()
+	p := principal(r)
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to decode input.")
+		return
+	}
+
+	if msg, err := router.validateTemplate(ctx, p, &req); msg != "" {
+		util.ResError(err, w, http.StatusBadRequest, msg)
+		return
+	}
+
+	template := model.Template{
+		Name:             req.Name,
+		Description:      req.Description,
+		Type:             req.Type,
+		Kind:             req.Kind,
+		Container:        req.Container,
+		Params:           req.Params,
+		Active:           true,
+		OwnerID:          p.UserID,
+		OrganizationID:   req.OrganizationID,
+		RegistryUsername: req.RegistryUsername,
+	}
+	req.TemplateHardware.apply(&template)
+	if req.RegistryPassword != "" {
+		template.RegistryPassword, err = util.Encrypt(router.EncryptionKey, req.RegistryPassword)
+		if err != nil {
+			util.ResError(err, w, http.StatusBadRequest, "Failed to store credentials.")
+			return
+		}
+	}
+	_, err = router.DB.NewInsert().Model(&template).Exec(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+	router.audit(r, p.UserID, "template.create", auditTarget("template", template.ID), true)
+
+	res := TemplateRes{
+		Template: &template,
+		Success:  true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+// UpdateTemplate replaces a template the caller manages. Servers already
+// running keep the image they were launched with.
+func (router *Router) UpdateTemplate(w http.ResponseWriter, r *http.Request) {
+	var req TemplateReq
+	ctx := context.Background()
+	p := principal(r)
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to decode input.")
+		return
+	}
+
+	template := &model.Template{
+		ID: req.ID,
+	}
+	err = router.DB.NewSelect().Model(template).WherePK().Scan(ctx)
+	if err == nil {
+		err = router.authorizeTemplate(ctx, p, template, actionManage)
+	}
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid template.")
+		return
+	}
+
+	if msg, err := router.validateTemplate(ctx, p, &req); msg != "" {
+		util.ResError(err, w, http.StatusBadRequest, msg)
+		return
+	}
+
+	// Credentials stay unless replaced, and go away with the username.
+	if req.RegistryPassword != "" {
+		template.RegistryPassword, err = util.Encrypt(router.EncryptionKey, req.RegistryPassword)
+		if err != nil {
+			util.ResError(err, w, http.StatusBadRequest, "Failed to store credentials.")
+			return
+		}
+	}
+	if req.RegistryUsername == "" || req.Kind != "container" {
+		template.RegistryPassword = ""
+	}
+
+	template.Name = req.Name
+	template.Description = req.Description
+	template.Type = req.Type
+	template.Kind = req.Kind
+	template.Container = req.Container
+	template.Params = req.Params
+	template.OrganizationID = req.OrganizationID
+	template.RegistryUsername = req.RegistryUsername
+	req.TemplateHardware.apply(template)
+	_, err = router.DB.NewUpdate().Model(template).
+		Column("name", "description", "type", "kind", "container", "params", "organization_id", "registry_username", "registry_password",
+			"min_storage", "min_gpu_memory", "min_gpu_count", "gpu_types").
+		WherePK().Exec(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+	router.audit(r, p.UserID, "template.update", auditTarget("template", template.ID), true)
+
+	res := TemplateRes{
+		Template: template,
+		Success:  true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+type DeleteTemplateReq struct {
+	ID int64 `json:"id"`
+}
+
+type DeleteTemplateRes struct {
+	Success bool `json:"success"`
+}
+
+func (router *Router) DeleteTemplate(w http.ResponseWriter, r *http.Request) {
+	var req DeleteTemplateReq
+	ctx := context.Background()
+	p := principal(r)
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to decode input.")
+		return
+	}
+
+	template := &model.Template{
+		ID: req.ID,
+	}
+	err = router.DB.NewSelect().Model(template).WherePK().Scan(ctx)
+	if err == nil {
+		err = router.authorizeTemplate(ctx, p, template, actionManage)
+	}
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid template.")
+		return
+	}
+
+	live, err := router.liveProducts(ctx, "template_id", template.ID)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+	if live {
+		util.ResError(err, w, http.StatusBadRequest, "Servers are running from this template.")
+		return
+	}
+
+	_, err = router.DB.NewDelete().Model(template).WherePK().Exec(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+	router.audit(r, p.UserID, "template.delete", auditTarget("template", template.ID), true)
+
+	res := DeleteTemplateRes{
+		Success: true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,124 @@
+package routes
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/uptrace/bun"
+
+	"gpu/model"
+	"gpu/util"
+)
+
+const (
+	loginWindow       = 15 * time.Minute
+	loginFreeFailures = 5  // failures allowed before backoff starts
+	loginLockFailures = 10 // failures on one account before it is locked
+	loginLockDuration = 15 * time.Minute
+	loginMaxBackoff   = 15 * time.Minute
+)
+
+// dummyHash is checked against when the username doesn't exist, so unknown
+// and known usernames take as long to reject.
+const dummyHash = "$2a$14$yjUA/k33iIdn94GaZFXbe.NMV2zBJAOZoP7dUr4Qw8rVbfWzJje/q"
+
+// recentFailures counts failed logins matching column = value within the
+// window and since the last success, and returns when the latest one was.
+func (router *Router) recentFailures(ctx context.Context, column, value string) (int, time.Time, error) {
+	since := time.Now().Add(-loginWindow)
+
+	var lastSuccess time.Time
+	err := router.DB.NewSelect().Model((*model.LoginAttempt)(nil)).ColumnExpr("COALESCE(MAX(created_at), 'epoch')").
+		Where("? = ?", bun.Ident(column), value).Where("success = true").Scan(ctx, &lastSuccess)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	if lastSuccess.After(since) {
+		since = lastSuccess
+	}
+
+	var failures int
+	var lastFailure time.Time
+	err = router.DB.NewSelect().Model((*model.LoginAttempt)(nil)).ColumnExpr("COUNT(*)").ColumnExpr("COALESCE(MAX(created_at), 'epoch')").
+		Where("? = ?", bun.Ident(column), value).Where("success = false").Where("reason != 'throttled'").
+		Where("created_at > ?", since).Scan(ctx, &failures, &lastFailure)
+	return failures, lastFailure, err
+}
+
+// backoff doubles the wait for every failure past the free ones.
+func backoff(failures int) time.Duration {
+	if failures < loginFreeFailures {
+		return 0
+	}
+	wait := time.Duration(math.Pow(2, float64(failures-loginFreeFailures))) * time.Second
+	if wait > loginMaxBackoff {
+		return loginMaxBackoff
+	}
+	return wait
+}
+
+// loginThrottled returns how long the caller must wait before trying to log
+// in as username from ip again, or 0 if they may try now.
+func (router *Router) loginThrottled(ctx context.Context, username, ip string) (time.Duration, error) {
+	var retry time.Duration
+	for _, key := range [][2]string{{"username", username}, {"ip", ip}} {
+		failures, last, err := router.recentFailures(ctx, key[0], key[1])
+		if err != nil {
+			return 0, err
+		}
+		if wait := time.Until(last.Add(backoff(failures))); wait > retry {
+			retry = wait
+		}
+	}
+	return retry, nil
+}
+
+// recordLogin stores an attempt, and locks the account once it has failed too
+// often. uid is 0 when the username doesn't exist.
+func (router *Router) recordLogin(ctx context.Context, r *http.Request, username string, uid int64, success bool, reason string) {
+	attempt := model.LoginAttempt{
+		Username:  username,
+		IP:        util.ClientIP(r),
+		Success:   success,
+		Reason:    reason,
+		UserAgent: r.UserAgent(),
+		UserID:    uid,
+	}
+	_, err := router.DB.NewInsert().Model(&attempt).Exec(ctx)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	router.audit(r, uid, "login", "user:"+username, success)
+
+	if success || uid == 0 {
+		return
+	}
+
+	failures, _, err := router.recentFailures(ctx, "username", username)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if failures >= loginLockFailures {
+		_, err = router.DB.NewUpdate().Model((*model.User)(nil)).Set("locked_until = ?", time.Now().Add(loginLockDuration)).Where("id = ?", uid).Exec(ctx)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// tooManyAttempts is the one response for throttled and locked logins, so
+// neither tells whether the account exists.
+func tooManyAttempts(w http.ResponseWriter, username string, retry time.Duration) {
+	if retry < time.Second {
+		retry = time.Second
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+	util.ResError(fmt.Errorf("Throttled login for %s", username), w, http.StatusTooManyRequests, "Too many attempts. Try again later.")
+}
@@ -0,0 +1,308 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/uptrace/bun"
+
+	"gpu/model"
+	"gpu/util"
+)
+
+const (
+	totpIssuer        = "Unbolted"
+	recoveryCodeCount = 10
+)
+
+// checkSecondFactor accepts either a current TOTP code or an unused recovery
+// code. Both are single use.
+func (router *Router) checkSecondFactor(ctx context.Context, user *model.User, code string) bool {
+	if step, ok := util.ValidateTOTP(user.TOTPSecret, code, time.Now(), user.TOTPLastStep); ok {
+		// Guards against the same code being replayed by a concurrent request.
+		result, err := router.DB.NewUpdate().Model((*model.User)(nil)).Set("totp_last_step = ?", step).
+			Where("id = ?", user.ID).Where("totp_last_step < ?", step).Exec(ctx)
+		if err != nil {
+			return false
+		}
+		n, _ := result.RowsAffected()
+		return n == 1
+	}
+
+	result, err := router.DB.NewUpdate().Model((*model.RecoveryCode)(nil)).Set("used_at = current_timestamp").
+		Where("user_id = ?", user.ID).Where("code_hash = ?", util.HashToken(util.NormalizeRecoveryCode(code))).
+		Where("used_at IS NULL").Exec(ctx)
+	if err != nil {
+		return false
+	}
+	n, _ := result.RowsAffected()
+	return n == 1
+}
+
+type EnrollTwoFactorRes struct {
+	Success bool   `json:"success"`
+	Secret  string `json:"secret"`
+	URI     string `json:"otpauth_uri"`
+}
+
+func (router *Router) EnrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	uid := principal(r).UserID
+
+	user := &model.User{
+		ID: uid,
+	}
+	err := router.DB.NewSelect().Model(user).WherePK().Scan(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+
+	if user.TOTPEnabled {
+		util.ResError(err, w, http.StatusBadRequest, "Two-factor authentication is already enabled.")
+		return
+	}
+
+	secret, err := util.GenerateTOTPSecret()
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to generate secret.")
+		return
+	}
+
+	// Stays pending until ConfirmTwoFactor sees a code generated from it.
+	_, err = router.DB.NewUpdate().Model(user).Set("totp_secret = ?", secret).Set("totp_last_step = 0").WherePK().Exec(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+
+	res := EnrollTwoFactorRes{
+		Secret:  secret,
+		URI:     util.TOTPURI(totpIssuer, user.Username, secret),
+		Success: true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+type ConfirmTwoFactorReq struct {
+	Code string `json:"code"`
+}
+
+type ConfirmTwoFactorRes struct {
+	Success       bool     `json:"success"`
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+func (router *Router) ConfirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var req ConfirmTwoFactorReq
+	ctx := context.Background()
+	uid := principal(r).UserID
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to decode input.")
+		return
+	}
+
+	user := &model.User{
+		ID: uid,
+	}
+	err = router.DB.NewSelect().Model(user).WherePK().Scan(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+
+	if user.TOTPEnabled || user.TOTPSecret == "" {
+		util.ResError(err, w, http.StatusBadRequest, "Nothing to confirm.")
+		return
+	}
+
+	step, ok := util.ValidateTOTP(user.TOTPSecret, req.Code, time.Now(), user.TOTPLastStep)
+	if !ok {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid code.")
+		return
+	}
+
+	codes, hashes, err := util.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to generate recovery codes.")
+		return
+	}
+
+	err = router.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		_, err := tx.NewUpdate().Model(user).Set("totp_enabled = true").Set("totp_last_step = ?", step).WherePK().Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.NewDelete().Model((*model.RecoveryCode)(nil)).Where("user_id = ?", uid).Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		recoveryCodes := []model.RecoveryCode{}
+		for _, hash := range hashes {
+			recoveryCodes = append(recoveryCodes, model.RecoveryCode{UserID: uid, CodeHash: hash})
+		}
+		_, err = tx.NewInsert().Model(&recoveryCodes).Exec(ctx)
+		return err
+	})
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+
+	router.audit(r, uid, "2fa.enable", auditTarget("user", uid), true)
+
+	res := ConfirmTwoFactorRes{
+		RecoveryCodes: codes,
+		Success:       true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+type DisableTwoFactorReq struct {
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
+type DisableTwoFactorRes struct {
+	Success bool `json:"success"`
+}
+
+func (router *Router) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var req DisableTwoFactorReq
+	ctx := context.Background()
+	uid := principal(r).UserID
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to decode input.")
+		return
+	}
+
+	user := &model.User{
+		ID: uid,
+	}
+	err = router.DB.NewSelect().Model(user).WherePK().Scan(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+
+	if !user.TOTPEnabled {
+		util.ResError(err, w, http.StatusBadRequest, "Two-factor authentication is not enabled.")
+		return
+	}
+
+	if !util.CheckPasswordHash(req.Password, user.PasswordHash) || !router.checkSecondFactor(ctx, user, req.Code) {
+		router.audit(r, uid, "2fa.disable", auditTarget("user", uid), false)
+		util.ResError(err, w, http.StatusBadRequest, "Invalid password or code.")
+		return
+	}
+
+	err = router.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		_, err := tx.NewUpdate().Model(user).Set("totp_enabled = false").Set("totp_secret = ''").Set("totp_last_step = 0").WherePK().Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.NewDelete().Model((*model.RecoveryCode)(nil)).Where("user_id = ?", uid).Exec(ctx)
+		return err
+	})
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+
+	router.audit(r, uid, "2fa.disable", auditTarget("user", uid), true)
+
+	res := DisableTwoFactorRes{
+		Success: true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+type LoginTwoFactorReq struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"`
+}
+
+func (router *Router) LoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var req LoginTwoFactorReq
+	ctx := context.Background()
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to decode input.")
+		return
+	}
+
+	uid, err := util.ParseChallengeJWT(req.Challenge, router.KeySet)
+	if err != nil {
+		util.ResError(err, w, http.StatusUnauthorized, "Invalid or expired challenge.")
+		return
+	}
+
+	user := &model.User{
+		ID: uid,
+	}
+	err = router.DB.NewSelect().Model(user).WherePK().Scan(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+
+	retry, err := router.loginThrottled(ctx, user.Username, util.ClientIP(r))
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+	if retry > 0 {
+		router.recordLogin(ctx, r, user.Username, user.ID, false, "throttled")
+		tooManyAttempts(w, user.Username, retry)
+		return
+	}
+
+	if user.LockedUntil.After(time.Now()) {
+		router.recordLogin(ctx, r, user.Username, user.ID, false, "locked")
+		tooManyAttempts(w, user.Username, time.Until(user.LockedUntil))
+		return
+	}
+
+	if !user.Active {
+		router.recordLogin(ctx, r, user.Username, user.ID, false, "disabled")
+		util.ResError(err, w, http.StatusBadRequest, "Disabled.")
+		return
+	}
+
+	if !user.TOTPEnabled || !router.checkSecondFactor(ctx, user, req.Code) {
+		router.recordLogin(ctx, r, user.Username, user.ID, false, "totp")
+		util.ResError(err, w, http.StatusBadRequest, "Invalid code.")
+		return
+	}
+
+	token, refresh, err := util.GenerateJWT(user.Username, user.ID, user.Admin, router.KeySet)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to generate token.")
+		return
+	}
+	router.recordLogin(ctx, r, user.Username, user.ID, true, "totp")
+
+	res := LoginRes{
+		Token:        token,
+		RefreshToken: refresh,
+		Success:      true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
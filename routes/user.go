@@ -5,7 +5,6 @@ import (
 	"context"
 	"net/http"
 
-	"github.com/golang-jwt/jwt"
 	"github.com/uptrace/bun"
 
 	"gpu/model"
@@ -20,31 +19,24 @@ type ProfileRes struct {
 
 func (router *Router) Profile(w http.ResponseWriter, r *http.Request) {
 	ctx := context.Background()
-	props, _ := r.Context().Value("props").(jwt.MapClaims)
-	uid := int(props["sub"].(float64))
+	uid := principal(r).UserID
 
 	notifications := []model.Notification{}
-	err := router.DB.NewSelect().Model(&notifications).Where("user_id = ?", uid).Where("read = false").Scan(ctx)
+	err := router.DB.NewSelect().Model(&notifications).Where("user_id = ?", uid).Where("read = false").
+		Where("archived_at IS NULL").OrderExpr("created_at DESC").Limit(50).Scan(ctx)
 	if err != nil {
 		util.ResError(err, w, http.StatusBadRequest, "Database error.")
 		return
 	}
 
-	depositQuery := router.DB.NewSelect().Model((*model.Deposit)(nil)).ColumnExpr("SUM(amount) AS deposit_sum").Where("user_id = ?", uid)
-	var depositSum float64
-	if err := depositQuery.Scan(ctx, &depositSum); err != nil {
-		util.ResError(err, w, http.StatusBadRequest, "Database error.")
-		return
-	}
-	purchaseQuery := router.DB.NewSelect().Model((*model.Purchase)(nil)).ColumnExpr("SUM(amount) AS purchase_sum").Where("user_id = ?", uid)
-	var purchaseSum float64
-	if err := purchaseQuery.Scan(ctx, &purchaseSum); err != nil {
+	balance, err := util.Balance(ctx, router.DB, uid, 0)
+	if err != nil {
 		util.ResError(err, w, http.StatusBadRequest, "Database error.")
 		return
 	}
 
 	res := ProfileRes{
-		Balance:       depositSum - purchaseSum,
+		Balance:       balance,
 		Notifications: notifications,
 		Success:       true,
 	}
@@ -60,16 +52,50 @@ type TransactionsRes struct {
 
 func (router *Router) Transactions(w http.ResponseWriter, r *http.Request) {
 	ctx := context.Background()
-	props, _ := r.Context().Value("props").(jwt.MapClaims)
-	uid := int64(props["sub"].(float64))
+	p := principal(r)
+	uid := p.UserID
+
+	orgID, err := orgParam(r)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid organization.")
+		return
+	}
+
+	if orgID != 0 {
+		_, err = router.authorizeOrg(ctx, p, orgID, validRole)
+		if err != nil {
+			util.ResError(err, w, http.StatusBadRequest, "Invalid organization.")
+			return
+		}
+
+		deposits := []*model.Deposit{}
+		err = router.DB.NewSelect().Model(&deposits).Where("organization_id = ?", orgID).OrderExpr("created_at DESC").Scan(ctx)
+		if err != nil {
+			util.ResError(err, w, http.StatusBadRequest, "Database error.")
+			return
+		}
+		purchases := []*model.Purchase{}
+		err = router.DB.NewSelect().Model(&purchases).Where("organization_id = ?", orgID).OrderExpr("created_at DESC").Scan(ctx)
+		if err != nil {
+			util.ResError(err, w, http.StatusBadRequest, "Database error.")
+			return
+		}
+
+		util.ResJSON(w, http.StatusOK, TransactionsRes{
+			Deposits:  deposits,
+			Purchases: purchases,
+			Success:   true,
+		})
+		return
+	}
 
 	user := model.User{
 		ID: uid,
 	}
-	err := router.DB.NewSelect().Model(&user).WherePK().Relation("Purchases", func(q *bun.SelectQuery) *bun.SelectQuery {
-        return q.OrderExpr("created_at DESC")
+	err = router.DB.NewSelect().Model(&user).WherePK().Relation("Purchases", func(q *bun.SelectQuery) *bun.SelectQuery {
+        return q.Where("organization_id IS NULL").OrderExpr("created_at DESC")
     }).Relation("Deposits", func(q *bun.SelectQuery) *bun.SelectQuery {
-        return q.OrderExpr("created_at DESC")
+        return q.Where("organization_id IS NULL").OrderExpr("created_at DESC")
     }).Scan(ctx)
 	if err != nil {
 		util.ResError(err, w, http.StatusBadRequest, "Database error.")
@@ -92,14 +118,41 @@ type ProductsRes struct {
 
 func (router *Router) Products(w http.ResponseWriter, r *http.Request) {
 	ctx := context.Background()
-	props, _ := r.Context().Value("props").(jwt.MapClaims)
-	uid := int64(props["sub"].(float64))
+	p := principal(r)
+	uid := p.UserID
+
+	orgID, err := orgParam(r)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid organization.")
+		return
+	}
+
+	if orgID != 0 {
+		_, err := router.authorizeOrg(ctx, p, orgID, canUseServers)
+		if err != nil {
+			util.ResError(err, w, http.StatusBadRequest, "Invalid organization.")
+			return
+		}
+
+		products := []*model.Product{}
+		err = router.DB.NewSelect().Model(&products).Where("organization_id = ?", orgID).Relation("ServerConfig").OrderExpr("product.created_at DESC").Scan(ctx)
+		if err != nil {
+			util.ResError(err, w, http.StatusBadRequest, "Database error.")
+			return
+		}
+
+		util.ResJSON(w, http.StatusOK, ProductsRes{
+			Products: products,
+			Success:  true,
+		})
+		return
+	}
 
 	user := model.User{
 		ID: uid,
 	}
-	err := router.DB.NewSelect().Model(&user).WherePK().Relation("Products", func(q *bun.SelectQuery) *bun.SelectQuery {
-        return q.Relation("ServerConfig")
+	err = router.DB.NewSelect().Model(&user).WherePK().Relation("Products", func(q *bun.SelectQuery) *bun.SelectQuery {
+        return q.Where("organization_id IS NULL").Relation("ServerConfig")
     }).OrderExpr("created_at DESC").Scan(ctx)
     log.Println(user)
 	if err != nil {
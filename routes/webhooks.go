@@ -0,0 +1,348 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"gpu/model"
+	"gpu/notify"
+	"gpu/util"
+)
+
+const maxWebhooks = 10
+
+type WebhooksRes struct {
+	Success  bool             `json:"success"`
+	Webhooks []*model.Webhook `json:"webhooks"`
+	Events   []string         `json:"events"` // what webhooks can subscribe to
+}
+
+func (router *Router) Webhooks(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	uid := principal(r).UserID
+
+	webhooks := []*model.Webhook{}
+	err := router.DB.NewSelect().Model(&webhooks).Where("user_id = ?", uid).OrderExpr("created_at DESC").Scan(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+
+	res := WebhooksRes{
+		Webhooks: webhooks,
+		Events:   notify.Kinds(),
+		Success:  true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+type WebhookReq struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+}
+
+// validWebhook returns the message for a webhook that can't be saved, or "".
+// Plain http is only allowed in development. Hosts must be public names, the
+// addresses they resolve to are checked again on every delivery.
+func (router *Router) validWebhook(req *WebhookReq) string {
+	u, err := url.Parse(req.URL)
+	if err != nil || len(req.URL) > 2048 || u.Host == "" || (u.Scheme != "https" && !(router.Dev && u.Scheme == "http")) {
+		return "Invalid URL, it must be https."
+	}
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if net.ParseIP(host) != nil || host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return "Invalid URL, it must use a public host name."
+	}
+	if len(req.Events) == 0 {
+		return "Subscribe to at least one event."
+	}
+	for _, event := range req.Events {
+		if !notify.Known(event) {
+			return "Unknown event " + event + "."
+		}
+	}
+	return ""
+}
+
+type CreateWebhookRes struct {
+	Success bool           `json:"success"`
+	Secret  string         `json:"secret"`
+	Webhook *model.Webhook `json:"webhook"`
+}
+
+// CreateWebhook registers an endpoint. Its signing secret is only returned
+// here.
+func (router *Router) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	var req WebhookReq
+	ctx := context.Background()
+	uid := principal(r).UserID
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to decode input.")
+		return
+	}
+
+	if router.EncryptionKey == nil {
+		util.ResError(nil, w, http.StatusBadRequest, "Webhooks are not available.")
+		return
+	}
+	if msg := router.validWebhook(&req); msg != "" {
+		util.ResError(nil, w, http.StatusBadRequest, msg)
+		return
+	}
+
+	count, err := router.DB.NewSelect().Model((*model.Webhook)(nil)).Where("user_id = ?", uid).Count(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+	if count >= maxWebhooks {
+		util.ResError(nil, w, http.StatusBadRequest, "At most 10 webhooks.")
+		return
+	}
+
+	secret, err := util.GenerateWebhookSecret()
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to generate secret.")
+		return
+	}
+	encrypted, err := util.Encrypt(router.EncryptionKey, secret)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to store secret.")
+		return
+	}
+
+	webhook := model.Webhook{
+		URL:    req.URL,
+		Events: req.Events,
+		Secret: encrypted,
+		Active: true,
+		UserID: uid,
+	}
+	_, err = router.DB.NewInsert().Model(&webhook).Exec(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+	router.audit(r, uid, "webhook.create", auditTarget("webhook", webhook.ID), true)
+
+	res := CreateWebhookRes{
+		Secret:  secret,
+		Webhook: &webhook,
+		Success: true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+type UpdateWebhookReq struct {
+	WebhookReq
+	ID     int64 `json:"id"`
+	Active bool  `json:"active"`
+}
+
+type WebhookRes struct {
+	Success bool           `json:"success"`
+	Webhook *model.Webhook `json:"webhook"`
+}
+
+// UpdateWebhook replaces the URL, events and active flag of a webhook. The
+// secret stays the same.
+func (router *Router) UpdateWebhook(w http.ResponseWriter, r *http.Request) {
+	var req UpdateWebhookReq
+	ctx := context.Background()
+	uid := principal(r).UserID
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to decode input.")
+		return
+	}
+
+	if msg := router.validWebhook(&req.WebhookReq); msg != "" {
+		util.ResError(nil, w, http.StatusBadRequest, msg)
+		return
+	}
+
+	webhook := &model.Webhook{
+		ID:     req.ID,
+		URL:    req.URL,
+		Events: req.Events,
+		Active: req.Active,
+	}
+	result, err := router.DB.NewUpdate().Model(webhook).Column("url", "events", "active").
+		WherePK().Where("user_id = ?", uid).Returning("*").Exec(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		router.audit(r, uid, "webhook.update", auditTarget("webhook", req.ID), false)
+		util.ResError(nil, w, http.StatusBadRequest, "Invalid webhook.")
+		return
+	}
+	router.audit(r, uid, "webhook.update", auditTarget("webhook", req.ID), true)
+
+	res := WebhookRes{
+		Webhook: webhook,
+		Success: true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+type WebhookIDReq struct {
+	ID int64 `json:"id"`
+}
+
+type DeleteWebhookRes struct {
+	Success bool `json:"success"`
+}
+
+// DeleteWebhook deletes a webhook and its delivery log.
+func (router *Router) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	var req WebhookIDReq
+	ctx := context.Background()
+	uid := principal(r).UserID
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to decode input.")
+		return
+	}
+
+	result, err := router.DB.NewDelete().Model((*model.Webhook)(nil)).Where("id = ?", req.ID).Where("user_id = ?", uid).Exec(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		router.audit(r, uid, "webhook.delete", auditTarget("webhook", req.ID), false)
+		util.ResError(nil, w, http.StatusBadRequest, "Invalid webhook.")
+		return
+	}
+	_, err = router.DB.NewDelete().Model((*model.WebhookDelivery)(nil)).Where("webhook_id = ?", req.ID).Exec(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+	router.audit(r, uid, "webhook.delete", auditTarget("webhook", req.ID), true)
+
+	res := DeleteWebhookRes{
+		Success: true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+// webhook loads a webhook of the caller.
+func (router *Router) webhook(ctx context.Context, uid, id int64) (*model.Webhook, error) {
+	webhook := &model.Webhook{
+		ID: id,
+	}
+	err := router.DB.NewSelect().Model(webhook).WherePK().Where("user_id = ?", uid).Scan(ctx)
+	return webhook, err
+}
+
+type WebhookDeliveriesRes struct {
+	Success    bool                     `json:"success"`
+	Deliveries []*model.WebhookDelivery `json:"deliveries"`
+	Total      int                      `json:"total"`
+}
+
+// WebhookDeliveries pages through the delivery log of a webhook, newest
+// first, optionally only those with status.
+func (router *Router) WebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	uid := principal(r).UserID
+	limit, offset := pageParams(r)
+	query := r.URL.Query()
+
+	id, err := strconv.ParseInt(query.Get("id"), 10, 64)
+	if err == nil {
+		_, err = router.webhook(ctx, uid, id)
+	}
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid webhook.")
+		return
+	}
+
+	deliveries := []*model.WebhookDelivery{}
+	q := router.DB.NewSelect().Model(&deliveries).Where("webhook_id = ?", id)
+	if status := query.Get("status"); status != "" {
+		q = q.Where("status = ?", status)
+	}
+	total, err := q.OrderExpr("created_at DESC").Limit(limit).Offset(offset).ScanAndCount(ctx)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+
+	res := WebhookDeliveriesRes{
+		Deliveries: deliveries,
+		Total:      total,
+		Success:    true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
+
+type WebhookDeliveryRes struct {
+	Success  bool                   `json:"success"`
+	Delivery *model.WebhookDelivery `json:"delivery"`
+}
+
+// TestWebhook queues a webhook.test event for a webhook, whatever it is
+// subscribed to. Poll its deliveries to see how it went.
+func (router *Router) TestWebhook(w http.ResponseWriter, r *http.Request) {
+	var req WebhookIDReq
+	ctx := context.Background()
+	uid := principal(r).UserID
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Failed to decode input.")
+		return
+	}
+
+	webhook, err := router.webhook(ctx, uid, req.ID)
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Invalid webhook.")
+		return
+	}
+	if !webhook.Active {
+		util.ResError(nil, w, http.StatusBadRequest, "Webhook is not active.")
+		return
+	}
+
+	delivery, err := notify.Enqueue(ctx, router.DB, webhook, notify.Event{
+		Event:     "webhook.test",
+		Title:     "Test event",
+		Body:      "This is a test event.",
+		Data:      map[string]interface{}{},
+		CreatedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		util.ResError(err, w, http.StatusBadRequest, "Database error.")
+		return
+	}
+
+	res := WebhookDeliveryRes{
+		Delivery: delivery,
+		Success:  true,
+	}
+
+	util.ResJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,25 @@
+package routes
+
+import "testing"
+
+func TestValidWebhookHost(t *testing.T) {
+	router := &Router{}
+	tests := map[string]bool{
+		"https://hooks.example.com/gpu":           true,
+		"https://hooks.example.com:8443/gpu":      true,
+		"http://hooks.example.com/gpu":            false,
+		"https://127.0.0.1/hook":                  false,
+		"https://169.254.169.254/computeMetadata": false,
+		"https://[::1]/hook":                      false,
+		"https://10.0.0.5:8080/hook":              false,
+		"https://localhost/hook":                  false,
+		"https://LOCALHOST./hook":                 false,
+		"https://api.localhost/hook":              false,
+	}
+	for url, ok := range tests {
+		msg := router.validWebhook(&WebhookReq{URL: url, Events: []string{"server.ready"}})
+		if (msg == "") != ok {
+			t.Errorf("validWebhook(%s) = %q, want ok %v", url, msg, ok)
+		}
+	}
+}
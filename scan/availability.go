@@ -0,0 +1,86 @@
+package scan
+
+import (
+    "context"
+    "log"
+    "time"
+
+    "github.com/uptrace/bun"
+
+    "gpu/model"
+    "gpu/util"
+)
+
+const (
+    probeInterval = 10 * time.Minute
+    failureWindow = time.Hour
+)
+
+// ProbeAvailability keeps the availability of every active config current.
+// Recent launch failures on a config are always taken into account, the
+// provider's accelerator and quota APIs only when provider is set.
+func ProbeAvailability(db *bun.DB, provider bool) {
+    ctx := context.Background()
+    for {
+        var configs []model.ServerConfig
+        err := db.NewSelect().Model(&configs).Where("active = true").Scan(ctx)
+        if err != nil {
+            log.Println(err)
+        }
+
+        for _, config := range configs {
+            availability, err := probe(ctx, db, config, provider)
+            if err != nil {
+                log.Println(err)
+            }
+
+            _, err = db.NewUpdate().Model((*model.ServerConfig)(nil)).
+                Set("availability = ?", availability).Set("availability_checked_at = current_timestamp").
+                Where("id = ?", config.ID).Exec(ctx)
+            if err != nil {
+                log.Println(err)
+            }
+        }
+
+        time.Sleep(probeInterval)
+    }
+}
+
+func probe(ctx context.Context, db *bun.DB, config model.ServerConfig, provider bool) (string, error) {
+    // A failed launch since the last successful one means the zone is out of
+    // capacity right now, whatever the quota says.
+    var lastFailure, lastSuccess time.Time
+    err := db.NewSelect().Model((*model.Product)(nil)).
+        ColumnExpr("COALESCE(MAX(created_at) FILTER (WHERE status = 'failed'), 'epoch')").
+        ColumnExpr("COALESCE(MAX(created_at) FILTER (WHERE status NOT IN ('failed', 'spinning', 'reserved')), 'epoch')").
+        Where("server_config_id = ?", config.ID).Where("created_at > ?", time.Now().Add(-failureWindow)).
+        Scan(ctx, &lastFailure, &lastSuccess)
+    if err != nil {
+        return "unknown", err
+    }
+    failing := lastFailure.After(lastSuccess)
+
+    if !provider || config.GPUCount == 0 {
+        if failing {
+            return "unavailable", nil
+        }
+        return "unknown", nil
+    }
+
+    headroom, offered, err := util.GPUHeadroom("siggpu", config.Region, config.Zone, config.GPUType)
+    if err != nil {
+        if failing {
+            return "unavailable", err
+        }
+        return "unknown", err
+    }
+
+    switch {
+    case !offered || failing || headroom < float64(config.GPUCount):
+        return "unavailable", nil
+    case headroom < float64(2*config.GPUCount):
+        return "limited", nil
+    default:
+        return "available", nil
+    }
+}
@@ -2,37 +2,92 @@ package scan
 
 import (
     "log"
+    "fmt"
     "time"
     "context"
 
 	"github.com/uptrace/bun"
 
     "gpu/model"
+    "gpu/notify"
+    "gpu/util"
 )
 
-func ScanBalance(db *bun.DB) error {
+// account is who pays for some of the active or stopped products, and how much an hour.
+type account struct {
+    userID int64
+    orgID  int64
+    hourly float64
+    server string
+}
+
+func ScanBalance(db *bun.DB, notifier *notify.Notifier) error {
     ctx := context.Background()
     for {
         var activeProducts []model.Product
-        err := db.NewSelect().Model(&activeProducts).Where("status = 'active'").Scan(ctx)
+        err := db.NewSelect().Model(&activeProducts).Where("status IN ('active', 'stopped')").
+            // Reservations are charged for their whole window when booked,
+            // a server stopped at the end of one is charged like any other.
+            Where("NOT EXISTS (SELECT 1 FROM reservations WHERE reservations.product_id = product.id AND reservations.status IN ('scheduled', 'provisioning', 'active'))").
+            Scan(ctx)
         if err != nil {
             log.Println(err)
             time.Sleep(time.Minute * 1)
             continue
         }
 
+        accounts := map[string]*account{}
         for _, product := range activeProducts {
+            // A stopped server only keeps its disk.
+            price := product.Price
+            if product.Status == "stopped" {
+                price = util.StoragePrice(product.Storage)
+            }
             purchase := model.Purchase{
                 UserID: product.UserID,
                 ProductID: product.ID,
-                Amount: product.Price,
+                Amount: price,
+                OrganizationID: product.OrganizationID,
             }
             _, err := db.NewInsert().Model(&purchase).Exec(ctx)
             if err != nil {
                 log.Println(err)
             }
+
+            key := fmt.Sprintf("user:%d", product.UserID)
+            if product.OrganizationID != 0 {
+                key = fmt.Sprintf("org:%d", product.OrganizationID)
+            }
+            if accounts[key] == nil {
+                accounts[key] = &account{userID: product.UserID, orgID: product.OrganizationID, server: product.GCPID}
+            }
+            accounts[key].hourly += price
+        }
+
+        for key, acc := range accounts {
+            warnBalance(ctx, db, notifier, key, acc)
         }
 
         time.Sleep(time.Minute * 60)
     }
 }
+
+// warnBalance tells an account it couldn't cover this hour, or that it won't
+// cover another day at this rate.
+func warnBalance(ctx context.Context, db *bun.DB, notifier *notify.Notifier, key string, acc *account) {
+    balance, err := util.Balance(ctx, db, acc.userID, acc.orgID)
+    if err != nil {
+        log.Println(err)
+        return
+    }
+
+    data := map[string]interface{}{
+        "balance": notify.Money(balance),
+        "server":  acc.server,
+    }
+    if balance < 0 {
+        notifier.Account(ctx, acc.userID, acc.orgID, "charge.failed", key, data)
+    } else if balance < 24*acc.hourly {
+        notifier.Account(ctx, acc.userID, acc.orgID, "balance.low", key, data)
+    }
+}
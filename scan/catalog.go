@@ -0,0 +1,196 @@
+package scan
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "regexp"
+    "strings"
+    "time"
+
+    "github.com/uptrace/bun"
+
+    "gpu/model"
+    "gpu/util"
+)
+
+// syncedMachines are the machine types ListOfferings enumerates. Configs on
+// anything else are never proposed for deactivation.
+var syncedMachines = regexp.MustCompile(`^(a2|a3|g2|n1-standard)-`)
+
+// GPUs that are attached to n1 machines rather than built into their own family.
+var n1GPUs = map[string]bool{
+    "nvidia-tesla-t4":   true,
+    "nvidia-tesla-p4":   true,
+    "nvidia-tesla-p100": true,
+    "nvidia-tesla-v100": true,
+}
+
+func configKey(zone, machineType, gpuType string, gpuCount int) string {
+    return fmt.Sprintf("%s/%s/%s/%d", zone, machineType, gpuType, gpuCount)
+}
+
+func regionOf(zone string) string {
+    return zone[:strings.LastIndex(zone, "-")]
+}
+
+// SyncCatalog compares the catalog with what the provider offers in the
+// regions we already sell in, and files proposals for admins to review: new
+// GPU configs priced from their cost, and configs the provider dropped. A
+// proposal is filed once, a rejected one is not filed again. It returns how
+// many proposals were filed.
+func SyncCatalog(ctx context.Context, db *bun.DB) (int, error) {
+    var regions []string
+    err := db.NewSelect().Model((*model.ServerConfig)(nil)).ColumnExpr("DISTINCT region").Scan(ctx, &regions)
+    if err != nil || len(regions) == 0 {
+        return 0, err
+    }
+
+    machines, accelerators, err := util.ListOfferings("siggpu", regions)
+    if err != nil {
+        return 0, err
+    }
+
+    offeredMachines := map[string]util.MachineOffering{}
+    for _, m := range machines {
+        offeredMachines[m.Zone+"/"+m.Name] = m
+    }
+    offeredGPUs := map[string]int32{}
+    for _, a := range accelerators {
+        offeredGPUs[a.Zone+"/"+a.Name] = a.MaxCount
+    }
+
+    candidates := []model.ConfigProposal{}
+    propose := func(m util.MachineOffering, gpuType string, gpuCount int32) {
+        price, _ := util.SuggestPrice(m.CPUs, m.MemoryMB, gpuType, gpuCount)
+        candidates = append(candidates, model.ConfigProposal{
+            Kind:        "add",
+            Region:      regionOf(m.Zone),
+            Zone:        m.Zone,
+            MachineType: m.Name,
+            GPUType:     gpuType,
+            GPUCount:    int(gpuCount),
+            GPUMemory:   util.GPUMemory(gpuType),
+            CPUs:        int(m.CPUs),
+            Memory:      int(m.MemoryMB / 1024),
+            Price:       price,
+            Status:      "pending",
+        })
+    }
+    for _, m := range machines {
+        if m.GPUCount > 0 {
+            propose(m, m.GPUType, m.GPUCount)
+        }
+    }
+    // Attachable GPUs get an n1-standard with 8 vCPUs per GPU.
+    for _, a := range accelerators {
+        if !n1GPUs[a.Name] {
+            continue
+        }
+        for count := int32(1); count <= a.MaxCount && count <= 8; count *= 2 {
+            if m, ok := offeredMachines[fmt.Sprintf("%s/n1-standard-%d", a.Zone, 8*count)]; ok {
+                propose(m, a.Name, count)
+            }
+        }
+    }
+
+    // Syncs run one after the other from here, so a manual sync running with
+    // the daily one can't file the same proposals twice.
+    var filed []model.ConfigProposal
+    err = db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+        _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext('catalog_sync'))")
+        if err != nil {
+            return err
+        }
+
+        var configs []model.ServerConfig
+        err = tx.NewSelect().Model(&configs).Scan(ctx)
+        if err != nil {
+            return err
+        }
+        var proposals []model.ConfigProposal
+        err = tx.NewSelect().Model(&proposals).Scan(ctx)
+        if err != nil {
+            return err
+        }
+
+        // Skip anything already sold, or already proposed whatever the review said.
+        known := map[string]bool{}
+        deactivationFiled := map[int64]bool{}
+        for _, c := range configs {
+            known[configKey(c.Zone, c.MachineType, c.GPUType, c.GPUCount)] = true
+        }
+        for _, p := range proposals {
+            if p.Kind == "add" {
+                known[configKey(p.Zone, p.MachineType, p.GPUType, p.GPUCount)] = true
+            } else {
+                deactivationFiled[p.ServerConfigID] = true
+            }
+        }
+
+        filed = []model.ConfigProposal{}
+        for _, candidate := range candidates {
+            key := configKey(candidate.Zone, candidate.MachineType, candidate.GPUType, candidate.GPUCount)
+            if !known[key] {
+                known[key] = true
+                filed = append(filed, candidate)
+            }
+        }
+
+        for _, c := range configs {
+            if !c.Active || deactivationFiled[c.ID] || !syncedMachines.MatchString(c.MachineType) {
+                continue
+            }
+
+            reason := ""
+            m, ok := offeredMachines[c.Zone+"/"+c.MachineType]
+            switch {
+            case !ok:
+                reason = fmt.Sprintf("%s is no longer offered in %s", c.MachineType, c.Zone)
+            case m.GPUCount == 0 && c.GPUCount > 0 && offeredGPUs[c.Zone+"/"+c.GPUType] < int32(c.GPUCount):
+                reason = fmt.Sprintf("%d %s are no longer offered in %s", c.GPUCount, c.GPUType, c.Zone)
+            }
+            if reason == "" {
+                continue
+            }
+
+            filed = append(filed, model.ConfigProposal{
+                Kind:           "deactivate",
+                Region:         c.Region,
+                Zone:           c.Zone,
+                MachineType:    c.MachineType,
+                GPUType:        c.GPUType,
+                GPUCount:       c.GPUCount,
+                Price:          c.Price,
+                Status:         "pending",
+                Reason:         reason,
+                ServerConfigID: c.ID,
+            })
+        }
+
+        if len(filed) == 0 {
+            return nil
+        }
+        _, err = tx.NewInsert().Model(&filed).Exec(ctx)
+        return err
+    })
+    if err != nil {
+        return 0, err
+    }
+    return len(filed), nil
+}
+
+// CatalogSync runs SyncCatalog once a day.
+func CatalogSync(db *bun.DB) {
+    ctx := context.Background()
+    for {
+        filed, err := SyncCatalog(ctx, db)
+        if err != nil {
+            log.Println(err)
+        } else if filed > 0 {
+            log.Printf("Catalog sync filed %d proposals\n", filed)
+        }
+
+        time.Sleep(24 * time.Hour)
+    }
+}
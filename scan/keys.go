@@ -0,0 +1,31 @@
+package scan
+
+import (
+    "context"
+    "log"
+    "time"
+
+    "gpu/util"
+)
+
+// RotateKeys reloads the signing keys so every replica picks up rotations,
+// and rotates once the current key is older than every.
+func RotateKeys(keys *util.KeySet, every time.Duration) {
+    ctx := context.Background()
+    for {
+        time.Sleep(time.Hour)
+
+        err := keys.Load(ctx)
+        if err != nil {
+            log.Println(err)
+            continue
+        }
+
+        if keys.SigningKeyAge() > every {
+            err = keys.Rotate(ctx)
+            if err != nil {
+                log.Println(err)
+            }
+        }
+    }
+}
@@ -0,0 +1,134 @@
+package scan
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "time"
+
+    "github.com/uptrace/bun"
+
+    "gpu/model"
+    "gpu/notify"
+    "gpu/provision"
+)
+
+const (
+    expiryWarning = time.Hour
+    idleWarning   = 15 * time.Minute
+)
+
+// idleDeadline is when an active product with an idle policy counts as idle,
+// IdleMinutes after its last busy heartbeat or its launch.
+const idleDeadline = "COALESCE(product.last_active_at, product.created_at) + make_interval(mins => product.idle_minutes)"
+
+// EnforceLifetimes stops or destroys servers past their TTL or idle for too
+// long, once a minute, and warns their launcher ahead of time.
+func EnforceLifetimes(db *bun.DB, notifier *notify.Notifier) {
+    ctx := context.Background()
+    for {
+        err := warnLifetimes(ctx, db, notifier)
+        if err != nil {
+            log.Println(err)
+        }
+        err = endLifetimes(ctx, db, notifier)
+        if err != nil {
+            log.Println(err)
+        }
+
+        time.Sleep(time.Minute)
+    }
+}
+
+func warnLifetimes(ctx context.Context, db *bun.DB, notifier *notify.Notifier) error {
+    var expiring []*model.Product
+    err := db.NewSelect().Model(&expiring).Where("product.status = 'active'").
+        Where("product.expiry_warned_at IS NULL").Where("product.expires_at <= ?", time.Now().Add(expiryWarning)).
+        Scan(ctx)
+    if err != nil {
+        return err
+    }
+    for _, product := range expiring {
+        // Keyed by the deadline, so a server warned before its TTL was
+        // extended is warned again for the new one.
+        notifier.User(ctx, product.UserID, "server.expiring", fmt.Sprintf("product:%s|%d", product.GCPID, product.ExpiresAt.Unix()), map[string]interface{}{
+            "server": product.GCPID,
+            "at":     product.ExpiresAt.UTC().Format(time.RFC1123),
+            "action": endedAs(product),
+        })
+
+        _, err := db.NewUpdate().Model(product).Set("expiry_warned_at = current_timestamp").WherePK().Exec(ctx)
+        if err != nil {
+            return err
+        }
+    }
+
+    var idle []*model.Product
+    err = db.NewSelect().Model(&idle).Where("product.status = 'active'").Where("product.idle_minutes > 0").
+        Where("product.idle_warned_at IS NULL").Where(idleDeadline+" <= ?", time.Now().Add(idleWarning)).
+        Scan(ctx)
+    if err != nil {
+        return err
+    }
+    for _, product := range idle {
+        // An idle server warned, then busy again, may go idle more than once.
+        notifier.User(ctx, product.UserID, "server.idle", "", map[string]interface{}{
+            "server":  product.GCPID,
+            "action":  endedAs(product),
+            "minutes": int(idleWarning.Minutes()),
+        })
+
+        _, err := db.NewUpdate().Model(product).Set("idle_warned_at = current_timestamp").WherePK().Exec(ctx)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func endLifetimes(ctx context.Context, db *bun.DB, notifier *notify.Notifier) error {
+    var over []*model.Product
+    err := db.NewSelect().Model(&over).Where("product.status = 'active'").
+        WhereGroup(" AND ", func(q *bun.SelectQuery) *bun.SelectQuery {
+            return q.Where("product.expires_at <= current_timestamp").
+                WhereOr("product.idle_minutes > 0 AND " + idleDeadline + " <= current_timestamp")
+        }).
+        Relation("ServerConfig").Scan(ctx)
+    if err != nil {
+        return err
+    }
+
+    for _, product := range over {
+        reason := "reached its time limit"
+        if product.ExpiresAt.IsZero() || product.ExpiresAt.After(time.Now()) {
+            reason = fmt.Sprintf("was idle for %d minutes", product.IdleMinutes)
+        }
+
+        if product.ExpiryAction == "stop" {
+            err = provision.Stop(db, product)
+        } else {
+            // server.ended below says why, server.destroyed would repeat it.
+            err = provision.Destroy(db, nil, product)
+        }
+        if err != nil {
+            log.Println(err)
+            continue
+        }
+
+        // A resumed server can end again.
+        subject := fmt.Sprintf("product:%s|%d", product.GCPID, time.Now().Unix())
+        notifier.User(ctx, product.UserID, "server.ended", subject, map[string]interface{}{
+            "server": product.GCPID,
+            "reason": reason,
+            "action": endedAs(product),
+        })
+    }
+    return nil
+}
+
+func endedAs(product *model.Product) string {
+    if product.ExpiryAction == "stop" {
+        return "stopped"
+    }
+    return "destroyed"
+}
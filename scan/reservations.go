@@ -0,0 +1,218 @@
+package scan
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "log"
+    "time"
+
+    "github.com/uptrace/bun"
+
+    "gpu/model"
+    "gpu/notify"
+    "gpu/provision"
+    "gpu/util"
+)
+
+// ProvisionLead is how long before its start a reservation is launched, so the
+// server is active on time. Reservations must be booked at least this early.
+const ProvisionLead = 15 * time.Minute
+
+// staleClaim is how long a reservation may stay provisioning. Launches take
+// minutes, one still going after this was lost with the process running it.
+const staleClaim = 30 * time.Minute
+
+// RunReservations launches reservations about to start and stops or destroys
+// the ones that are over, once a minute. Container templates boot on
+// containerBase, and stored secrets are decrypted with encryptionKey.
+func RunReservations(db *bun.DB, notifier *notify.Notifier, containerBase string, encryptionKey []byte) {
+    ctx := context.Background()
+    for {
+        // Claimed with one UPDATE, so a reservation is only ever launched once.
+        var due []*model.Reservation
+        err := db.NewUpdate().Model((*model.Reservation)(nil)).
+            Set("status = 'provisioning'").Set("claimed_at = current_timestamp").
+            Where("status = 'scheduled'").Where("starts_at <= ?", time.Now().Add(ProvisionLead)).
+            Returning("*").Scan(ctx, &due)
+        if err != nil {
+            log.Println(err)
+        }
+        for _, reservation := range due {
+            go func(reservation *model.Reservation) {
+                err := startReservation(ctx, db, notifier, reservation, containerBase, encryptionKey)
+                if err != nil {
+                    log.Println(err)
+                }
+            }(reservation)
+        }
+
+        err = recoverReservations(ctx, db, notifier)
+        if err != nil {
+            log.Println(err)
+        }
+
+        var over []*model.Reservation
+        err = db.NewSelect().Model(&over).Where("reservation.status = 'active'").Where("reservation.ends_at <= current_timestamp").
+            Relation("Product").Relation("Product.ServerConfig").Scan(ctx)
+        if err != nil {
+            log.Println(err)
+        }
+        for _, reservation := range over {
+            err := endReservation(ctx, db, notifier, reservation)
+            if err != nil {
+                log.Println(err)
+            }
+        }
+
+        time.Sleep(time.Minute)
+    }
+}
+
+// startReservation launches the product of a claimed reservation and waits
+// for it. A failed launch is refunded.
+func startReservation(ctx context.Context, db *bun.DB, notifier *notify.Notifier, reservation *model.Reservation, containerBase string, encryptionKey []byte) error {
+    product := new(model.Product)
+    err := db.NewSelect().Model(product).Where("product.id = ?", reservation.ProductID).
+        Relation("ServerConfig").Relation("Template").Scan(ctx)
+    if err != nil {
+        return err
+    }
+
+    params := map[string]string{}
+    for name, value := range product.Params {
+        params[name] = value
+    }
+    if reservation.Secrets != "" {
+        secrets, err := util.Decrypt(encryptionKey, reservation.Secrets)
+        if err == nil {
+            err = json.Unmarshal([]byte(secrets), &params)
+        }
+        if err != nil {
+            return failReservation(ctx, db, notifier, reservation, product, err)
+        }
+    }
+
+    sourceImage, script, metadata, err := provision.BootSpec(product.Template, params, containerBase, encryptionKey)
+    if err != nil {
+        return failReservation(ctx, db, notifier, reservation, product, err)
+    }
+
+    product.Status = "spinning"
+    _, err = db.NewUpdate().Model(product).Column("status").WherePK().Exec(ctx)
+    if err != nil {
+        return err
+    }
+    provision.Launch(db, notifier, product, product.ServerConfig, sourceImage, script, metadata)
+    if product.Status == "failed" {
+        return failReservation(ctx, db, notifier, reservation, product, nil)
+    }
+
+    reservation.Status = "active"
+    _, err = db.NewUpdate().Model(reservation).Column("status").WherePK().Exec(ctx)
+    return err
+}
+
+// recoverReservations settles reservations whose launch was interrupted by a
+// restart: active if their server made it, otherwise failed and refunded, with
+// whatever instance was half created deleted.
+func recoverReservations(ctx context.Context, db *bun.DB, notifier *notify.Notifier) error {
+    var stale []*model.Reservation
+    err := db.NewSelect().Model(&stale).Where("reservation.status = 'provisioning'").
+        WhereGroup(" AND ", func(q *bun.SelectQuery) *bun.SelectQuery {
+            return q.Where("reservation.claimed_at IS NULL").WhereOr("reservation.claimed_at < ?", time.Now().Add(-staleClaim))
+        }).
+        Relation("Product").Relation("Product.ServerConfig").Scan(ctx)
+    if err != nil {
+        return err
+    }
+
+    for _, reservation := range stale {
+        product := reservation.Product
+        if product.Status == "active" {
+            reservation.Status = "active"
+            _, err = db.NewUpdate().Model(reservation).Column("status").WherePK().Exec(ctx)
+        } else {
+            if product.Status != "failed" {
+                go func(product *model.Product) {
+                    err := util.DeleteInstance("siggpu", product.ServerConfig.Zone, product.GCPID)
+                    if err != nil {
+                        log.Println(err)
+                    }
+                }(product)
+            }
+            err = failReservation(ctx, db, notifier, reservation, product, fmt.Errorf("launch interrupted"))
+        }
+        if err != nil {
+            log.Println(err)
+        }
+    }
+    return nil
+}
+
+// failReservation marks a reservation that couldn't launch as failed and
+// refunds its window, then tells the user.
+func failReservation(ctx context.Context, db *bun.DB, notifier *notify.Notifier, reservation *model.Reservation, product *model.Product, cause error) error {
+    if cause != nil {
+        log.Printf("Reservation %d failed: %v\n", reservation.ID, cause)
+    }
+
+    err := db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+        if product.Status != "failed" {
+            _, err := tx.NewUpdate().Model((*model.Product)(nil)).Set("status = 'failed'").Where("id = ?", product.ID).Exec(ctx)
+            if err != nil {
+                return err
+            }
+        }
+
+        reservation.Status = "failed"
+        _, err := tx.NewUpdate().Model(reservation).Column("status").WherePK().Exec(ctx)
+        if err != nil {
+            return err
+        }
+        return RefundReservation(ctx, tx, reservation)
+    })
+    if err != nil {
+        return err
+    }
+
+    notifier.User(ctx, reservation.UserID, "reservation.failed", fmt.Sprintf("reservation:%d", reservation.ID), map[string]interface{}{
+        "server": product.GCPID,
+        "amount": notify.Money(reservation.Amount),
+    })
+    return nil
+}
+
+// RefundReservation credits back what a reservation was charged, as a
+// negative purchase on its product.
+func RefundReservation(ctx context.Context, tx bun.Tx, reservation *model.Reservation) error {
+    refund := model.Purchase{
+        UserID:         reservation.UserID,
+        ProductID:      reservation.ProductID,
+        Amount:         -reservation.Amount,
+        OrganizationID: reservation.OrganizationID,
+    }
+    _, err := tx.NewInsert().Model(&refund).Exec(ctx)
+    return err
+}
+
+// endReservation stops or destroys the server of a reservation that is over.
+// Servers the user already destroyed are left alone.
+func endReservation(ctx context.Context, db *bun.DB, notifier *notify.Notifier, reservation *model.Reservation) error {
+    product := reservation.Product
+    if product.Status == "active" {
+        var err error
+        if reservation.EndAction == "stop" {
+            err = provision.Stop(db, product)
+        } else {
+            err = provision.Destroy(db, notifier, product)
+        }
+        if err != nil {
+            return err
+        }
+    }
+
+    reservation.Status = "ended"
+    _, err := db.NewUpdate().Model(reservation).Column("status").WherePK().Exec(ctx)
+    return err
+}
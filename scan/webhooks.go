@@ -0,0 +1,89 @@
+package scan
+
+import (
+    "context"
+    "log"
+    "time"
+
+    "github.com/uptrace/bun"
+
+    "gpu/model"
+    "gpu/util"
+)
+
+const (
+    // maxWebhookAttempts before a delivery is given up as failed, the last
+    // one about 5 hours after the first.
+    maxWebhookAttempts = 6
+    // webhookClaim is how long a claimed delivery is left alone, longer than
+    // an attempt can take, so a crash mid-send just retries it later.
+    webhookClaim = 5 * time.Minute
+)
+
+// DeliverWebhooks sends pending webhook deliveries every few seconds, signed
+// with secrets decrypted with encryptionKey. Failed attempts are retried after
+// 1, 4, 16, 64 and 256 minutes.
+func DeliverWebhooks(db *bun.DB, encryptionKey []byte) {
+    ctx := context.Background()
+    for {
+        // Claimed with one UPDATE, so a delivery is never sent twice at once.
+        var due []*model.WebhookDelivery
+        pending := db.NewSelect().Model((*model.WebhookDelivery)(nil)).Column("id").
+            Where("status = 'pending'").Where("next_attempt_at <= current_timestamp").
+            OrderExpr("next_attempt_at").Limit(50).For("UPDATE SKIP LOCKED")
+        err := db.NewUpdate().Model((*model.WebhookDelivery)(nil)).
+            Set("attempts = attempts + 1").Set("next_attempt_at = ?", time.Now().Add(webhookClaim)).
+            Where("id IN (?)", pending).Returning("*").Scan(ctx, &due)
+        if err != nil {
+            log.Println(err)
+        }
+
+        for _, delivery := range due {
+            go func(delivery *model.WebhookDelivery) {
+                err := deliverWebhook(ctx, db, delivery, encryptionKey)
+                if err != nil {
+                    log.Println(err)
+                }
+            }(delivery)
+        }
+
+        time.Sleep(10 * time.Second)
+    }
+}
+
+// deliverWebhook makes one attempt at a claimed delivery and records how it
+// went.
+func deliverWebhook(ctx context.Context, db *bun.DB, delivery *model.WebhookDelivery, encryptionKey []byte) error {
+    webhook := &model.Webhook{
+        ID: delivery.WebhookID,
+    }
+    err := db.NewSelect().Model(webhook).WherePK().Scan(ctx)
+    if err != nil || !webhook.Active {
+        delivery.Status = "failed"
+        delivery.Error = "Webhook disabled."
+        _, err = db.NewUpdate().Model(delivery).Column("status", "error").WherePK().Exec(ctx)
+        return err
+    }
+
+    secret, err := util.Decrypt(encryptionKey, webhook.Secret)
+    if err == nil {
+        delivery.ResponseCode, err = util.PostWebhook(webhook.URL, secret, delivery.Event, []byte(delivery.Payload))
+    }
+
+    switch {
+    case err == nil:
+        delivery.Status = "delivered"
+        delivery.Error = ""
+        delivery.DeliveredAt = time.Now()
+    case delivery.Attempts >= maxWebhookAttempts:
+        delivery.Status = "failed"
+        delivery.Error = err.Error()
+    default:
+        delivery.Error = err.Error()
+        delivery.NextAttemptAt = time.Now().Add(time.Minute << (2 * (delivery.Attempts - 1)))
+    }
+
+    _, err = db.NewUpdate().Model(delivery).
+        Column("status", "response_code", "error", "next_attempt_at", "delivered_at").WherePK().Exec(ctx)
+    return err
+}
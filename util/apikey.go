@@ -0,0 +1,41 @@
+package util
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"strings"
+)
+
+// API keys look like gpu_<prefix>_<secret>. The prefix is stored in the clear
+// so a key can be looked up and recognised in logs, the full key only as a hash.
+const APIKeyPrefix = "gpu_"
+
+func GenerateAPIKey() (key, prefix, hash string, err error) {
+	prefix, err = randomHex(4)
+	if err != nil {
+		return "", "", "", err
+	}
+	secret, err := randomHex(24)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	key = fmt.Sprintf("%s%s_%s", APIKeyPrefix, prefix, secret)
+	return key, prefix, HashToken(key), nil
+}
+
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, APIKeyPrefix)
+}
+
+func ParseAPIKeyPrefix(key string) (string, error) {
+	parts := strings.Split(strings.TrimPrefix(key, APIKeyPrefix), "_")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", fmt.Errorf("Malformed API key")
+	}
+	return parts[0], nil
+}
+
+func CheckAPIKeyHash(key, hash string) bool {
+	return subtle.ConstantTimeCompare([]byte(HashToken(key)), []byte(hash)) == 1
+}
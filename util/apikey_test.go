@@ -0,0 +1,53 @@
+package util
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGenerateAPIKey(t *testing.T) {
+	key, prefix, hash, err := GenerateAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsAPIKey(key) || !strings.HasPrefix(key, APIKeyPrefix+prefix+"_") {
+		t.Fatalf("key %q does not carry prefix %q", key, prefix)
+	}
+
+	parsed, err := ParseAPIKeyPrefix(key)
+	if err != nil || parsed != prefix {
+		t.Errorf("ParseAPIKeyPrefix = %q, %v, want %q", parsed, err, prefix)
+	}
+	if !CheckAPIKeyHash(key, hash) {
+		t.Error("key does not match its hash")
+	}
+	if CheckAPIKeyHash(key+"0", hash) || CheckAPIKeyHash(APIKeyPrefix+prefix+"_wrong", hash) {
+		t.Error("wrong secret matches the hash")
+	}
+
+	other, _, _, _ := GenerateAPIKey()
+	if other == key {
+		t.Error("two generated keys are equal")
+	}
+}
+
+func TestParseAPIKeyPrefix(t *testing.T) {
+	tests := map[string]bool{
+		"gpu_abcd1234_secret": true,
+		"gpu_abcd1234_":       false,
+		"gpu__secret":         false,
+		"gpu_abcd1234":        false,
+		"gpu_a_b_c":           false,
+		"gpu_":                false,
+	}
+	for key, ok := range tests {
+		_, err := ParseAPIKeyPrefix(key)
+		if (err == nil) != ok {
+			t.Errorf("ParseAPIKeyPrefix(%q) = %v, want ok %v", key, err, ok)
+		}
+	}
+
+	if IsAPIKey("eyJhbGciOiJFUzI1NiJ9.e30.sig") {
+		t.Error("a JWT is taken for an API key")
+	}
+}
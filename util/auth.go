@@ -22,26 +22,22 @@ func CheckPasswordHash(password, hash string) bool {
 	return err == nil
 }
 
-func GenerateJWT(username string, userid int64, admin bool, jwtSecret string) (string, string, error) {
-	jwtSecretBytes := []byte(jwtSecret)
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+func GenerateJWT(username string, userid int64, admin bool, keys *KeySet) (string, string, error) {
+	tokenString, err := keys.Sign(jwt.MapClaims{
 		"sub":      userid,
 		"exp":      time.Now().Add(48 * time.Hour).Unix(), // TODO: Refresh tokens
 		"username": username,
 		"admin":    admin,
 	})
-
-	tokenString, err := token.SignedString(jwtSecretBytes)
 	if err != nil {
 		return "", "", err
 	}
 
-	refreshToken := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+	refreshTokenString, err := keys.Sign(jwt.MapClaims{
 		"sub": userid,
-		"exp": time.Now().Add(96 * time.Hour).Unix(),
+		"exp": time.Now().Add(TokenLifetime).Unix(),
+		"typ": "refresh",
 	})
-
-	refreshTokenString, err := refreshToken.SignedString(jwtSecretBytes)
 	if err != nil {
 		return "", "", err
 	}
@@ -49,44 +45,79 @@ func GenerateJWT(username string, userid int64, admin bool, jwtSecret string) (s
 	return tokenString, refreshTokenString, nil
 }
 
-func GenerateJWTFromRefreshToken(db *bun.DB, jwtSecret string, rt string, ctx context.Context) (string, error) {
-	token, err := jwt.Parse(rt, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return "", fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
-		}
+func isRefreshToken(token *jwt.Token, claims jwt.MapClaims) bool {
+	if claims["typ"] == "refresh" {
+		return true
+	}
 
-		return []byte(jwtSecret), nil
-	})
+	// Refresh tokens signed with the old shared secret have no kid, typ or
+	// username, and were always HS256.
+	_, hasKID := token.Header["kid"]
+	_, hasUsername := claims["username"]
+	return !hasKID && token.Method == jwt.SigningMethodHS256 && claims["typ"] == nil && !hasUsername
+}
+
+func GenerateJWTFromRefreshToken(db *bun.DB, keys *KeySet, rt string, ctx context.Context) (string, error) {
+	token, err := keys.Parse(rt)
 	if err != nil {
 		return "", err
 	}
 
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		user := new(model.User)
-		err := db.NewSelect().Model(&user).Where("id = ?", claims["sub"].(string)).Scan(ctx)
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid || !isRefreshToken(token, claims) {
+		return "", fmt.Errorf("Invalid refresh token")
+	}
+	sub, ok := claims["sub"].(float64)
+	if !ok {
+		return "", fmt.Errorf("Invalid refresh token")
+	}
+
+	user := new(model.User)
+	err = db.NewSelect().Model(user).Where("id = ?", int64(sub)).Scan(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if user.Active {
+		tokenString, err := keys.Sign(jwt.MapClaims{
+			"sub":      user.ID,
+			"exp":      time.Now().Add(48 * time.Minute).Unix(), // TODO: Refresh tokens
+			"username": user.Username,
+			"admin":    user.Admin,
+		})
 		if err != nil {
 			return "", err
 		}
 
-		if user.Active {
-			jwtSecretBytes := []byte(jwtSecret)
-			token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-				"sub":      user.ID,
-				"exp":      time.Now().Add(48 * time.Minute).Unix(), // TODO: Refresh tokens
-				"username": user.Username,
-				"admin":    user.Admin,
-			})
-
-			tokenString, err := token.SignedString(jwtSecretBytes)
-			if err != nil {
-				return "", err
-			}
-
-			return tokenString, err
-		} else {
-			return "", fmt.Errorf("Disabled")
-		}
+		return tokenString, err
+	} else {
+		return "", fmt.Errorf("Disabled")
+	}
+}
+
+// GenerateChallengeJWT issues the short-lived token returned by /login when a
+// second factor is still required. It only identifies the user to /login/2fa.
+func GenerateChallengeJWT(userid int64, keys *KeySet) (string, error) {
+	return keys.Sign(jwt.MapClaims{
+		"sub": userid,
+		"exp": time.Now().Add(5 * time.Minute).Unix(),
+		"typ": "2fa",
+	})
+}
+
+func ParseChallengeJWT(challenge string, keys *KeySet) (int64, error) {
+	token, err := keys.Parse(challenge)
+	if err != nil {
+		return 0, err
 	}
 
-	return "", err
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid || claims["typ"] != "2fa" {
+		return 0, fmt.Errorf("Invalid challenge")
+	}
+	sub, ok := claims["sub"].(float64)
+	if !ok {
+		return 0, fmt.Errorf("Invalid challenge")
+	}
+	return int64(sub), nil
 }
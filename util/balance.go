@@ -0,0 +1,35 @@
+package util
+
+import (
+	"context"
+
+	"github.com/uptrace/bun"
+
+	"gpu/model"
+)
+
+// Balance returns the funds available to an organization when orgID is set,
+// otherwise the personal balance of uid. Personal balances ignore anything
+// deposited into or spent on behalf of an organization.
+func Balance(ctx context.Context, db bun.IDB, uid, orgID int64) (float64, error) {
+	depositQuery := db.NewSelect().Model((*model.Deposit)(nil)).ColumnExpr("COALESCE(SUM(amount), 0) AS deposit_sum")
+	purchaseQuery := db.NewSelect().Model((*model.Purchase)(nil)).ColumnExpr("COALESCE(SUM(amount), 0) AS purchase_sum")
+	if orgID != 0 {
+		depositQuery = depositQuery.Where("organization_id = ?", orgID)
+		purchaseQuery = purchaseQuery.Where("organization_id = ?", orgID)
+	} else {
+		depositQuery = depositQuery.Where("user_id = ?", uid).Where("organization_id IS NULL")
+		purchaseQuery = purchaseQuery.Where("user_id = ?", uid).Where("organization_id IS NULL")
+	}
+
+	var depositSum float64
+	if err := depositQuery.Scan(ctx, &depositSum); err != nil {
+		return 0, err
+	}
+	var purchaseSum float64
+	if err := purchaseQuery.Scan(ctx, &purchaseSum); err != nil {
+		return 0, err
+	}
+
+	return depositSum - purchaseSum, nil
+}
@@ -0,0 +1,186 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+
+	compute "cloud.google.com/go/compute/apiv1"
+	computepb "cloud.google.com/go/compute/apiv1/computepb"
+	"google.golang.org/api/iterator"
+	"google.golang.org/protobuf/proto"
+)
+
+// MachineOffering is a machine type offered in a zone. GPUType and GPUCount
+// are set for machine types with GPUs built in.
+type MachineOffering struct {
+	Zone     string
+	Name     string
+	CPUs     int32
+	MemoryMB int32
+	GPUType  string
+	GPUCount int32
+}
+
+// AcceleratorOffering is a GPU that can be attached to n1 machines in a zone.
+type AcceleratorOffering struct {
+	Zone     string
+	Name     string
+	MaxCount int32
+}
+
+// inRegions reports whether a "zones/<zone>" key from an aggregated list is in
+// one of regions, and returns the zone.
+func inRegions(key string, regions []string) (string, bool) {
+	zone := strings.TrimPrefix(key, "zones/")
+	for _, region := range regions {
+		if strings.HasPrefix(zone, region+"-") {
+			return zone, true
+		}
+	}
+	return zone, false
+}
+
+// ListOfferings enumerates the GPU machine types, and the n1 machine types GPUs
+// can be attached to, along with the attachable GPUs in every zone of regions.
+func ListOfferings(projectID string, regions []string) ([]MachineOffering, []AcceleratorOffering, error) {
+	ctx := context.Background()
+
+	machineTypesClient, err := compute.NewMachineTypesRESTClient(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("NewMachineTypesRESTClient: %w", err)
+	}
+	defer machineTypesClient.Close()
+
+	machines := []MachineOffering{}
+	machineIt := machineTypesClient.AggregatedList(ctx, &computepb.AggregatedListMachineTypesRequest{
+		Project: projectID,
+		Filter:  proto.String(`name eq "(a2|a3|g2|n1-standard)-.*"`),
+	})
+	for {
+		pair, err := machineIt.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to list machine types: %w", err)
+		}
+		zone, ok := inRegions(pair.Key, regions)
+		if !ok {
+			continue
+		}
+
+		for _, machine := range pair.Value.GetMachineTypes() {
+			if machine.GetDeprecated() != nil {
+				continue
+			}
+			offering := MachineOffering{
+				Zone:     zone,
+				Name:     machine.GetName(),
+				CPUs:     machine.GetGuestCpus(),
+				MemoryMB: machine.GetMemoryMb(),
+			}
+			if accelerators := machine.GetAccelerators(); len(accelerators) > 0 {
+				offering.GPUType = accelerators[0].GetGuestAcceleratorType()
+				offering.GPUCount = accelerators[0].GetGuestAcceleratorCount()
+			}
+			machines = append(machines, offering)
+		}
+	}
+
+	acceleratorTypesClient, err := compute.NewAcceleratorTypesRESTClient(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("NewAcceleratorTypesRESTClient: %w", err)
+	}
+	defer acceleratorTypesClient.Close()
+
+	accelerators := []AcceleratorOffering{}
+	acceleratorIt := acceleratorTypesClient.AggregatedList(ctx, &computepb.AggregatedListAcceleratorTypesRequest{
+		Project: projectID,
+	})
+	for {
+		pair, err := acceleratorIt.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to list accelerator types: %w", err)
+		}
+		zone, ok := inRegions(pair.Key, regions)
+		if !ok {
+			continue
+		}
+
+		for _, accelerator := range pair.Value.GetAcceleratorTypes() {
+			if accelerator.GetDeprecated() != nil {
+				continue
+			}
+			accelerators = append(accelerators, AcceleratorOffering{
+				Zone:     zone,
+				Name:     accelerator.GetName(),
+				MaxCount: accelerator.GetMaximumCardsPerInstance(),
+			})
+		}
+	}
+
+	return machines, accelerators, nil
+}
+
+// Rough on-demand list prices in USD per hour. They only seed the price of
+// proposed configs, an admin reviews every one before it is offered.
+var gpuHourlyCost = map[string]float64{
+	"nvidia-tesla-t4":   0.35,
+	"nvidia-tesla-p4":   0.60,
+	"nvidia-tesla-p100": 1.46,
+	"nvidia-tesla-v100": 2.48,
+	"nvidia-l4":         0.56,
+	"nvidia-tesla-a100": 2.93,
+	"nvidia-a100-80gb":  3.93,
+	"nvidia-h100-80gb":  9.80,
+}
+
+// GB of memory on each GPU, which the provider's API doesn't report.
+var gpuMemory = map[string]int{
+	"nvidia-tesla-t4":   16,
+	"nvidia-tesla-p4":   8,
+	"nvidia-tesla-p100": 16,
+	"nvidia-tesla-v100": 16,
+	"nvidia-l4":         24,
+	"nvidia-tesla-a100": 40,
+	"nvidia-a100-80gb":  80,
+	"nvidia-h100-80gb":  80,
+}
+
+// GPUMemory is the GB of memory on one gpuType GPU, or 0 when unknown.
+func GPUMemory(gpuType string) int {
+	return gpuMemory[gpuType]
+}
+
+const (
+	cpuHourlyCost      = 0.0316
+	memoryGBHourlyCost = 0.0042
+	diskGBHourlyCost   = 0.04 / 730 // standard persistent disk, per GB-month
+	PriceMarkup        = 1.3
+)
+
+// SuggestPrice is the hourly price for a machine with gpuCount gpuType GPUs,
+// the provider's cost plus our markup. It returns false for GPUs we have no
+// cost for.
+func SuggestPrice(cpus, memoryMB int32, gpuType string, gpuCount int32) (float64, bool) {
+	cost := float64(cpus)*cpuHourlyCost + float64(memoryMB)/1024*memoryGBHourlyCost
+	if gpuCount > 0 {
+		gpuCost, ok := gpuHourlyCost[gpuType]
+		if !ok {
+			return 0, false
+		}
+		cost += float64(gpuCount) * gpuCost
+	}
+	return math.Ceil(cost*PriceMarkup*100) / 100, true
+}
+
+// StoragePrice is the hourly price of keeping storage GB of disk, what a
+// stopped server is charged.
+func StoragePrice(storage int) float64 {
+	return math.Ceil(float64(storage)*diskGBHourlyCost*PriceMarkup*100) / 100
+}
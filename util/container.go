@@ -0,0 +1,68 @@
+package util
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	// Container references like ghcr.io/org/model:v1, user/image or
+	// registry:5000/image@sha256:... Quotes and spaces are never allowed, so
+	// a valid reference is safe inside single quotes in a shell script.
+	containerRef    = regexp.MustCompile(`^[a-z0-9]+([._:-][a-z0-9]+)*(/[a-z0-9]+([._-][a-z0-9]+)*)+(:[A-Za-z0-9_][A-Za-z0-9._-]{0,127})?(@sha256:[a-f0-9]{64})?$`)
+	machineImageRef = regexp.MustCompile(`^projects/[a-z][a-z0-9-]{4,28}[a-z0-9]/global/machineImages/[a-z]([-a-z0-9]{0,61}[a-z0-9])?$`)
+)
+
+func ValidContainerRef(ref string) bool {
+	return len(ref) <= 255 && containerRef.MatchString(ref)
+}
+
+func ValidMachineImageRef(ref string) bool {
+	return machineImageRef.MatchString(ref)
+}
+
+// RegistryHost is the registry to log in to for an image, Docker Hub unless
+// the first path segment looks like a host.
+func RegistryHost(ref string) string {
+	first := strings.SplitN(ref, "/", 2)[0]
+	if strings.ContainsAny(first, ".:") || first == "localhost" {
+		return first
+	}
+	return "docker.io"
+}
+
+// ContainerStartupScript runs image with all GPUs on a base machine image that
+// has docker and the NVIDIA container toolkit. Registry credentials and param
+// values are read from instance metadata rather than written into the script.
+func ContainerStartupScript(image string, login bool, params []string) string {
+	var script strings.Builder
+	script.WriteString("#!/bin/bash\nset -e\n")
+	script.WriteString("meta() { curl -sf -H 'Metadata-Flavor: Google' \"http://metadata.google.internal/computeMetadata/v1/instance/attributes/$1\"; }\n")
+	if login {
+		fmt.Fprintf(&script, "meta registry-password | docker login '%s' -u \"$(meta registry-username)\" --password-stdin\n", RegistryHost(image))
+	}
+	fmt.Fprintf(&script, "docker pull '%s'\n", image)
+
+	script.WriteString("docker run -d --restart unless-stopped --gpus all --network host")
+	for _, name := range params {
+		// Names are checked against ^[A-Z][A-Z0-9_]*$ by ValidateParamSchema.
+		fmt.Fprintf(&script, " -e %s=\"$(meta %s)\"", name, name)
+	}
+	fmt.Fprintf(&script, " '%s'\n", image)
+
+	// Reports whether the GPUs are busy every 5 minutes, for idle shutdown.
+	// Instances launched without heartbeat metadata skip it.
+	script.WriteString(`(
+hb_url="$(meta heartbeat-url)" && hb_token="$(meta heartbeat-token)" || exit 0
+while true; do
+  busy=false
+  [ "$(nvidia-smi --query-gpu=utilization.gpu --format=csv,noheader,nounits | sort -n | tail -1)" -ge 10 ] 2>/dev/null && busy=true
+  curl -sf -X POST -H 'Content-Type: application/json' -d "{\"token\":\"$hb_token\",\"busy\":$busy}" "$hb_url" || true
+  sleep 300
+done
+) >/dev/null 2>&1 &
+`)
+
+	return script.String()
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
     "log"
+	"strings"
 
 	compute "cloud.google.com/go/compute/apiv1"
 	computepb "cloud.google.com/go/compute/apiv1/computepb"
@@ -61,7 +62,8 @@ func DeleteInstance(projectID, zone, instanceName string) error {
 	return nil
 }
 
-func CreateInstance(projectID, zone, instanceName, machineType, sourceImage, region, script, gpuType string, gpuCount int32, disk int64) error {
+// StopInstance shuts an instance down, its disks are kept.
+func StopInstance(projectID, zone, instanceName string) error {
 	ctx := context.Background()
 	instancesClient, err := compute.NewInstancesRESTClient(ctx)
 	if err != nil {
@@ -69,6 +71,74 @@ func CreateInstance(projectID, zone, instanceName, machineType, sourceImage, reg
 	}
 	defer instancesClient.Close()
 
+	req := &computepb.StopInstanceRequest{
+		Project:  projectID,
+		Zone:     zone,
+		Instance: instanceName,
+	}
+
+	op, err := instancesClient.Stop(ctx, req)
+	if err != nil {
+		return fmt.Errorf("unable to stop instance: %w", err)
+	}
+
+	if err = op.Wait(ctx); err != nil {
+		return fmt.Errorf("unable to wait for the operation: %w", err)
+	}
+
+	return nil
+}
+
+// StartInstance boots a stopped instance again on its kept disks.
+func StartInstance(projectID, zone, instanceName string) error {
+	ctx := context.Background()
+	instancesClient, err := compute.NewInstancesRESTClient(ctx)
+	if err != nil {
+		return fmt.Errorf("NewInstancesRESTClient: %w", err)
+	}
+	defer instancesClient.Close()
+
+	req := &computepb.StartInstanceRequest{
+		Project:  projectID,
+		Zone:     zone,
+		Instance: instanceName,
+	}
+
+	op, err := instancesClient.Start(ctx, req)
+	if err != nil {
+		return fmt.Errorf("unable to start instance: %w", err)
+	}
+
+	if err = op.Wait(ctx); err != nil {
+		return fmt.Errorf("unable to wait for the operation: %w", err)
+	}
+
+	return nil
+}
+
+// CreateInstance boots an instance from sourceImage. metadata is added next
+// to the startup script, this is how template params reach the instance.
+func CreateInstance(projectID, zone, instanceName, machineType, sourceImage, region, script, gpuType string, gpuCount int32, disk int64, metadata map[string]string) error {
+	ctx := context.Background()
+
+	items := []*computepb.Items{
+		{
+			Key:   proto.String("startup-script"),
+			Value: proto.String(script),
+		},
+	}
+	for key, value := range metadata {
+		items = append(items, &computepb.Items{
+			Key:   proto.String(key),
+			Value: proto.String(value),
+		})
+	}
+	instancesClient, err := compute.NewInstancesRESTClient(ctx)
+	if err != nil {
+		return fmt.Errorf("NewInstancesRESTClient: %w", err)
+	}
+	defer instancesClient.Close()
+
 	req := &computepb.InsertInstanceRequest{
 		Project: projectID,
 		Zone:    zone,
@@ -103,12 +173,7 @@ func CreateInstance(projectID, zone, instanceName, machineType, sourceImage, reg
 				},
 			},
 			Metadata: &computepb.Metadata{
-				Items: []*computepb.Items{
-					{
-						Key:   proto.String("startup-script"),
-						Value: proto.String(script),
-					},
-				},
+				Items: items,
 			},
 			GuestAccelerators: []*computepb.AcceleratorConfig{
 				{
@@ -133,3 +198,109 @@ func CreateInstance(projectID, zone, instanceName, machineType, sourceImage, reg
 
 	return nil
 }
+
+// ValidateServerConfig checks with the provider that zone is in region, and
+// that the machine type and GPUs are offered there. Machine types with GPUs
+// built in (a2, g2) must be configured with exactly those GPUs.
+func ValidateServerConfig(projectID, region, zone, machineType, gpuType string, gpuCount int32) error {
+	ctx := context.Background()
+
+	zonesClient, err := compute.NewZonesRESTClient(ctx)
+	if err != nil {
+		return fmt.Errorf("NewZonesRESTClient: %w", err)
+	}
+	defer zonesClient.Close()
+
+	z, err := zonesClient.Get(ctx, &computepb.GetZoneRequest{Project: projectID, Zone: zone})
+	if err != nil {
+		return fmt.Errorf("unknown zone %s: %w", zone, err)
+	}
+	if !strings.HasSuffix(z.GetRegion(), "/regions/"+region) {
+		return fmt.Errorf("zone %s is not in region %s", zone, region)
+	}
+
+	machineTypesClient, err := compute.NewMachineTypesRESTClient(ctx)
+	if err != nil {
+		return fmt.Errorf("NewMachineTypesRESTClient: %w", err)
+	}
+	defer machineTypesClient.Close()
+
+	machine, err := machineTypesClient.Get(ctx, &computepb.GetMachineTypeRequest{Project: projectID, Zone: zone, MachineType: machineType})
+	if err != nil {
+		return fmt.Errorf("machine type %s not offered in %s: %w", machineType, zone, err)
+	}
+	if builtIn := machine.GetAccelerators(); len(builtIn) > 0 {
+		for _, accelerator := range builtIn {
+			if accelerator.GetGuestAcceleratorType() == gpuType && accelerator.GetGuestAcceleratorCount() == gpuCount {
+				return nil
+			}
+		}
+		return fmt.Errorf("machine type %s comes with %d %s", machineType, builtIn[0].GetGuestAcceleratorCount(), builtIn[0].GetGuestAcceleratorType())
+	}
+
+	if gpuCount == 0 {
+		return nil
+	}
+
+	acceleratorTypesClient, err := compute.NewAcceleratorTypesRESTClient(ctx)
+	if err != nil {
+		return fmt.Errorf("NewAcceleratorTypesRESTClient: %w", err)
+	}
+	defer acceleratorTypesClient.Close()
+
+	accelerator, err := acceleratorTypesClient.Get(ctx, &computepb.GetAcceleratorTypeRequest{Project: projectID, Zone: zone, AcceleratorType: gpuType})
+	if err != nil {
+		return fmt.Errorf("GPU %s not offered in %s: %w", gpuType, zone, err)
+	}
+	if gpuCount > accelerator.GetMaximumCardsPerInstance() {
+		return fmt.Errorf("at most %d %s per instance", accelerator.GetMaximumCardsPerInstance(), gpuType)
+	}
+
+	return nil
+}
+
+// GPUQuotaMetric is the regional quota metric that limits gpuType, e.g.
+// nvidia-tesla-a100 is counted against NVIDIA_A100_GPUS.
+func GPUQuotaMetric(gpuType string) string {
+	metric := strings.ToUpper(strings.Replace(gpuType, "tesla-", "", 1))
+	return strings.ReplaceAll(metric, "-", "_") + "_GPUS"
+}
+
+// GPUHeadroom returns how many more gpuType GPUs the region's quota allows,
+// and false when the accelerator is being retired from zone.
+func GPUHeadroom(projectID, region, zone, gpuType string) (float64, bool, error) {
+	ctx := context.Background()
+
+	acceleratorTypesClient, err := compute.NewAcceleratorTypesRESTClient(ctx)
+	if err != nil {
+		return 0, false, fmt.Errorf("NewAcceleratorTypesRESTClient: %w", err)
+	}
+	defer acceleratorTypesClient.Close()
+
+	accelerator, err := acceleratorTypesClient.Get(ctx, &computepb.GetAcceleratorTypeRequest{Project: projectID, Zone: zone, AcceleratorType: gpuType})
+	if err != nil {
+		return 0, false, fmt.Errorf("unable to get accelerator type: %w", err)
+	}
+	if state := accelerator.GetDeprecated().GetState(); state == "DELETED" || state == "OBSOLETE" {
+		return 0, false, nil
+	}
+
+	regionsClient, err := compute.NewRegionsRESTClient(ctx)
+	if err != nil {
+		return 0, false, fmt.Errorf("NewRegionsRESTClient: %w", err)
+	}
+	defer regionsClient.Close()
+
+	r, err := regionsClient.Get(ctx, &computepb.GetRegionRequest{Project: projectID, Region: region})
+	if err != nil {
+		return 0, false, fmt.Errorf("unable to get region: %w", err)
+	}
+	metric := GPUQuotaMetric(gpuType)
+	for _, quota := range r.GetQuotas() {
+		if quota.GetMetric() == metric {
+			return quota.GetLimit() - quota.GetUsage(), true, nil
+		}
+	}
+
+	return 0, false, fmt.Errorf("no quota %s in %s", metric, region)
+}
@@ -0,0 +1,43 @@
+package util
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.1, 192.168.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	TrustedProxies = proxies
+	defer func() { TrustedProxies = nil }()
+
+	tests := []struct {
+		remote    string
+		forwarded string
+		want      string
+	}{
+		{"203.0.113.9:1234", "", "203.0.113.9"},
+		// Without a proxy in front the header is the client's own.
+		{"203.0.113.9:1234", "198.51.100.1", "203.0.113.9"},
+		{"10.0.0.1:1234", "198.51.100.1", "198.51.100.1"},
+		{"10.0.0.1:1234", "6.6.6.6, 198.51.100.1", "198.51.100.1"},
+		{"10.0.0.1:1234", "6.6.6.6, 198.51.100.1, 192.168.1.2", "198.51.100.1"},
+		{"10.0.0.1:1234", "", "10.0.0.1"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remote
+		if test.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		if got := ClientIP(r); got != test.want {
+			t.Errorf("ClientIP(%s, %q) = %s, want %s", test.remote, test.forwarded, got, test.want)
+		}
+	}
+
+	if _, err := ParseTrustedProxies("not-an-ip"); err == nil {
+		t.Error("parsed an invalid proxy")
+	}
+}
@@ -0,0 +1,358 @@
+package util
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/uptrace/bun"
+
+	"gpu/model"
+)
+
+// TokenLifetime is the longest any token we sign stays valid, so a retired key
+// must keep verifying for at least this long.
+const TokenLifetime = 96 * time.Hour
+
+// keyReloadInterval limits how often a token with an unknown kid reloads the
+// keys, so made up kids can't hammer the database.
+const keyReloadInterval = 10 * time.Second
+
+type SigningKey struct {
+	ID        string
+	Alg       string
+	Private   crypto.Signer
+	Public    crypto.PublicKey
+	CreatedAt time.Time
+	Retired   bool
+}
+
+// KeySet signs tokens with the newest key and verifies them with any key that
+// hasn't expired. Keys live in the database so every replica shares them.
+// Tokens without a kid were signed with the old shared HS256 secret and are
+// still accepted while it is configured, until legacyUntil. Private keys are
+// stored encrypted with EncryptionKey when one is configured.
+type KeySet struct {
+	DB            *bun.DB
+	Alg           string // RS256 or EdDSA
+	EncryptionKey []byte
+	legacy        []byte
+	legacyUntil   time.Time
+
+	mu   sync.RWMutex
+	keys map[string]*SigningKey
+	sign *SigningKey
+
+	reloadMu sync.Mutex
+	reloaded time.Time
+}
+
+// NewKeySet loads the keys, generating the first one if there is none.
+// Tokens signed with legacySecret are accepted until legacyUntil or, when that
+// is zero, until every token signed before the first key has expired.
+func NewKeySet(db *bun.DB, alg, legacySecret string, legacyUntil time.Time, encryptionKey []byte) (*KeySet, error) {
+	if alg == "" {
+		alg = "EdDSA"
+	}
+	if alg != "EdDSA" && alg != "RS256" {
+		return nil, fmt.Errorf("Unsupported JWT algorithm %s", alg)
+	}
+
+	ks := &KeySet{
+		DB:            db,
+		Alg:           alg,
+		EncryptionKey: encryptionKey,
+	}
+	if legacySecret != "" {
+		ks.legacy = []byte(legacySecret)
+		ks.legacyUntil = legacyUntil
+	}
+
+	ctx := context.Background()
+	err := ks.Load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if ks.signingKey() == nil {
+		err = ks.Rotate(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if ks.legacy != nil && ks.legacyUntil.IsZero() {
+		var first time.Time
+		err = db.NewSelect().Model((*model.JWTKey)(nil)).ColumnExpr("MIN(created_at)").Scan(ctx, &first)
+		if err != nil {
+			return nil, err
+		}
+		ks.legacyUntil = first.Add(TokenLifetime)
+	}
+	return ks, nil
+}
+
+// Load replaces the keys in memory with the current ones from the database.
+func (ks *KeySet) Load(ctx context.Context) error {
+	rows := []model.JWTKey{}
+	err := ks.DB.NewSelect().Model(&rows).Where("expires_at IS NULL OR expires_at > current_timestamp").OrderExpr("created_at ASC").Scan(ctx)
+	if err != nil {
+		return err
+	}
+
+	keys := map[string]*SigningKey{}
+	var sign *SigningKey
+	for _, row := range rows {
+		key, err := parseSigningKey(row, ks.EncryptionKey)
+		if err != nil {
+			return err
+		}
+		keys[key.ID] = key
+		if !key.Retired && key.Alg == ks.Alg {
+			sign = key
+		}
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.keys = keys
+	ks.sign = sign
+	return nil
+}
+
+// Rotate generates a new signing key and retires the current ones. Retired
+// keys verify until every token they signed has expired.
+func (ks *KeySet) Rotate(ctx context.Context) error {
+	row, err := generateKey(ks.Alg, ks.EncryptionKey)
+	if err != nil {
+		return err
+	}
+
+	err = ks.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		_, err := tx.NewUpdate().Model((*model.JWTKey)(nil)).
+			Set("retired_at = current_timestamp").Set("expires_at = ?", time.Now().Add(TokenLifetime)).
+			Where("retired_at IS NULL").Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.NewInsert().Model(row).Exec(ctx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return ks.Load(ctx)
+}
+
+// SigningKeyAge is how long the current signing key has been in use.
+func (ks *KeySet) SigningKeyAge() time.Duration {
+	key := ks.signingKey()
+	if key == nil {
+		return 0
+	}
+	return time.Since(key.CreatedAt)
+}
+
+func (ks *KeySet) signingKey() *SigningKey {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return ks.sign
+}
+
+func (ks *KeySet) Sign(claims jwt.MapClaims) (string, error) {
+	key := ks.signingKey()
+	if key == nil {
+		return "", fmt.Errorf("No signing key")
+	}
+
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(key.Alg), claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.Private)
+}
+
+func (ks *KeySet) Parse(tokenString string) (*jwt.Token, error) {
+	return jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		kid, ok := token.Header["kid"].(string)
+		if !ok {
+			legacy := ks.legacySecret()
+			if token.Method != jwt.SigningMethodHS256 || legacy == nil {
+				return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+			}
+			return legacy, nil
+		}
+
+		key, ok := ks.key(kid)
+		if !ok {
+			// Another replica may have just rotated.
+			ks.reloadUnknown()
+			key, ok = ks.key(kid)
+		}
+		if !ok {
+			return nil, fmt.Errorf("Unknown key %s", kid)
+		}
+		if token.Method.Alg() != key.Alg {
+			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+		}
+		return key.Public, nil
+	})
+}
+
+// legacySecret returns the old shared secret while tokens it signed may still
+// be valid, and forgets it after that.
+func (ks *KeySet) legacySecret() []byte {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if ks.legacy != nil && time.Now().After(ks.legacyUntil) {
+		ks.legacy = nil
+	}
+	return ks.legacy
+}
+
+func (ks *KeySet) key(kid string) (*SigningKey, bool) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	key, ok := ks.keys[kid]
+	return key, ok
+}
+
+// reloadUnknown reloads the keys for a token with a kid we don't know, at most
+// once every keyReloadInterval.
+func (ks *KeySet) reloadUnknown() {
+	ks.reloadMu.Lock()
+	defer ks.reloadMu.Unlock()
+
+	if time.Since(ks.reloaded) < keyReloadInterval {
+		return
+	}
+	ks.reloaded = time.Now()
+	err := ks.Load(context.Background())
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// JWKS returns the verification keys as a JSON Web Key Set.
+func (ks *KeySet) JWKS() map[string]interface{} {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	b64 := base64.RawURLEncoding.EncodeToString
+	keys := []map[string]string{}
+	for _, key := range ks.keys {
+		jwk := map[string]string{
+			"kid": key.ID,
+			"alg": key.Alg,
+			"use": "sig",
+		}
+		switch public := key.Public.(type) {
+		case *rsa.PublicKey:
+			jwk["kty"] = "RSA"
+			jwk["n"] = b64(public.N.Bytes())
+			jwk["e"] = b64(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk["kty"] = "OKP"
+			jwk["crv"] = "Ed25519"
+			jwk["x"] = b64(public)
+		}
+		keys = append(keys, jwk)
+	}
+
+	return map[string]interface{}{"keys": keys}
+}
+
+// generateKey returns a new key pair, its private key encrypted with
+// encryptionKey unless that is nil.
+func generateKey(alg string, encryptionKey []byte) (*model.JWTKey, error) {
+	var private crypto.Signer
+	var err error
+	switch alg {
+	case "RS256":
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "EdDSA":
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		err = fmt.Errorf("Unsupported JWT algorithm %s", alg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(private.Public())
+	if err != nil {
+		return nil, err
+	}
+	kid, err := randomHex(8)
+	if err != nil {
+		return nil, err
+	}
+
+	privatePEM := string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER}))
+	if encryptionKey != nil {
+		privatePEM, err = Encrypt(encryptionKey, privatePEM)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &model.JWTKey{
+		KID:        kid,
+		Alg:        alg,
+		PrivateKey: privatePEM,
+		PublicKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER})),
+	}, nil
+}
+
+// parseSigningKey reads a stored key pair. Keys stored before encryption was
+// configured are plain PEM and still read, until they expire.
+func parseSigningKey(row model.JWTKey, encryptionKey []byte) (*SigningKey, error) {
+	privatePEM := row.PrivateKey
+	if !strings.HasPrefix(privatePEM, "-----BEGIN") {
+		if encryptionKey == nil {
+			return nil, fmt.Errorf("Private key %s is encrypted but no ENCRYPTION_KEY is set", row.KID)
+		}
+		var err error
+		privatePEM, err = Decrypt(encryptionKey, privatePEM)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	block, _ := pem.Decode([]byte(privatePEM))
+	if block == nil {
+		return nil, fmt.Errorf("Invalid private key %s", row.KID)
+	}
+	private, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := private.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("Invalid private key %s", row.KID)
+	}
+
+	return &SigningKey{
+		ID:        row.KID,
+		Alg:       row.Alg,
+		Private:   signer,
+		Public:    signer.Public(),
+		CreatedAt: row.CreatedAt,
+		Retired:   !row.RetiredAt.IsZero(),
+	}, nil
+}
@@ -0,0 +1,78 @@
+package util
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+func TestSigningKeyEncryption(t *testing.T) {
+	encryptionKey := make([]byte, 32)
+
+	row, err := generateKey("EdDSA", encryptionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(row.PrivateKey, "PRIVATE KEY") {
+		t.Fatal("private key stored in the clear")
+	}
+	if _, err := parseSigningKey(*row, encryptionKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseSigningKey(*row, nil); err == nil {
+		t.Fatal("read an encrypted key without the encryption key")
+	}
+
+	// Keys stored before ENCRYPTION_KEY was set still verify until they expire.
+	plain, err := generateKey("EdDSA", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseSigningKey(*plain, encryptionKey); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLegacyTokens(t *testing.T) {
+	secret := []byte("legacy-secret")
+	legacyToken := func(method jwt.SigningMethod, claims jwt.MapClaims) string {
+		s, err := jwt.NewWithClaims(method, claims).SignedString(secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	exp := time.Now().Add(time.Hour).Unix()
+	access := legacyToken(jwt.SigningMethodHS256, jwt.MapClaims{"sub": 1, "exp": exp, "username": "alice"})
+	refresh := legacyToken(jwt.SigningMethodHS256, jwt.MapClaims{"sub": 1, "exp": exp})
+
+	ks := &KeySet{legacy: secret, legacyUntil: time.Now().Add(time.Hour)}
+	for name, s := range map[string]string{"access": access, "refresh": refresh} {
+		token, err := ks.Parse(s)
+		if err != nil || !token.Valid {
+			t.Errorf("legacy %s token refused before the cutoff: %v", name, err)
+		}
+	}
+	token, _ := ks.Parse(refresh)
+	if !isRefreshToken(token, token.Claims.(jwt.MapClaims)) {
+		t.Error("legacy refresh token not recognised")
+	}
+
+	for _, method := range []jwt.SigningMethod{jwt.SigningMethodHS384, jwt.SigningMethodHS512} {
+		if _, err := ks.Parse(legacyToken(method, jwt.MapClaims{"sub": 1, "exp": exp})); err == nil {
+			t.Errorf("legacy %s token accepted", method.Alg())
+		}
+	}
+
+	expired := &KeySet{legacy: secret, legacyUntil: time.Now().Add(-time.Second)}
+	for name, s := range map[string]string{"access": access, "refresh": refresh} {
+		if _, err := expired.Parse(s); err == nil {
+			t.Errorf("legacy %s token accepted after the cutoff", name)
+		}
+	}
+	if expired.legacy != nil {
+		t.Error("legacy secret kept after the cutoff")
+	}
+}
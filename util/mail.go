@@ -0,0 +1,83 @@
+package util
+
+import (
+	"fmt"
+	"log"
+	"net/smtp"
+	"strings"
+	"sync"
+)
+
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	msg := strings.Join([]string{
+		fmt.Sprintf("From: %s", m.From),
+		fmt.Sprintf("To: %s", to),
+		fmt.Sprintf("Subject: %s", subject),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=UTF-8",
+		"",
+		body,
+	}, "\r\n")
+
+	err := smtp.SendMail(m.Host+":"+m.Port, auth, m.From, []string{to}, []byte(msg))
+	if err != nil {
+		return fmt.Errorf("unable to send mail: %w", err)
+	}
+	return nil
+}
+
+type CapturedMail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// maxCapturedMail is how many messages CaptureMailer keeps, the oldest are
+// dropped first.
+const maxCapturedMail = 100
+
+// CaptureMailer keeps the latest mail in memory instead of sending it, for
+// local development and tests. Bodies hold tokens, so they are never logged.
+type CaptureMailer struct {
+	mu   sync.Mutex
+	Mail []CapturedMail
+}
+
+func (m *CaptureMailer) Send(to, subject, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	log.Printf("Captured mail to %s: %s\n", to, subject)
+	m.Mail = append(m.Mail, CapturedMail{To: to, Subject: subject, Body: body})
+	if len(m.Mail) > maxCapturedMail {
+		m.Mail = m.Mail[len(m.Mail)-maxCapturedMail:]
+	}
+	return nil
+}
+
+func (m *CaptureMailer) Last() (CapturedMail, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.Mail) == 0 {
+		return CapturedMail{}, false
+	}
+	return m.Mail[len(m.Mail)-1], true
+}
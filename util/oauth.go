@@ -0,0 +1,263 @@
+package util
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// OAuthProvider is an OAuth 2.0 authorization code provider. OpenID Connect
+// providers are configured from their issuer's discovery document, GitHub
+// (which isn't OIDC) from fixed endpoints.
+type OAuthProvider struct {
+	Name         string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	AuthURL      string
+	TokenURL     string
+	UserInfoURL  string
+	Scopes       []string
+	GitHub       bool
+	// TrustEmail lets a verified email from this provider sign in to the
+	// existing account with that address. Only for providers that control
+	// the addresses they vouch for, otherwise accounts are linked by hand.
+	TrustEmail bool
+}
+
+type OAuthIdentity struct {
+	Subject       string
+	Username      string
+	Email         string
+	EmailVerified bool
+}
+
+var oauthClient = &http.Client{Timeout: 10 * time.Second}
+
+// LoadOAuthProviders reads providers named in OAUTH_PROVIDERS, e.g.
+// "github,rit", each configured by OAUTH_<NAME>_CLIENT_ID, _CLIENT_SECRET,
+// _REDIRECT_URL and, for anything but GitHub, _ISSUER. _TRUST_EMAIL=true
+// opts in to matching accounts by verified email. Providers that fail to load
+// are logged and left out.
+func LoadOAuthProviders() map[string]*OAuthProvider {
+	providers := map[string]*OAuthProvider{}
+	for _, name := range strings.Split(os.Getenv("OAUTH_PROVIDERS"), ",") {
+		name = strings.TrimSpace(strings.ToLower(name))
+		if name == "" {
+			continue
+		}
+		env := func(key string) string {
+			return os.Getenv(fmt.Sprintf("OAUTH_%s_%s", strings.ToUpper(name), key))
+		}
+
+		provider := &OAuthProvider{
+			Name:         name,
+			ClientID:     env("CLIENT_ID"),
+			ClientSecret: env("CLIENT_SECRET"),
+			RedirectURL:  env("REDIRECT_URL"),
+			TrustEmail:   env("TRUST_EMAIL") == "true",
+		}
+		if name == "github" {
+			provider.AuthURL = "https://github.com/login/oauth/authorize"
+			provider.TokenURL = "https://github.com/login/oauth/access_token"
+			provider.UserInfoURL = "https://api.github.com/user"
+			provider.Scopes = []string{"read:user", "user:email"}
+			provider.GitHub = true
+		} else {
+			err := provider.discover(env("ISSUER"))
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			provider.Scopes = []string{"openid", "profile", "email"}
+		}
+
+		providers[name] = provider
+	}
+	return providers
+}
+
+func (p *OAuthProvider) discover(issuer string) error {
+	if issuer == "" {
+		return fmt.Errorf("OAuth provider %s has no issuer", p.Name)
+	}
+
+	var doc struct {
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		UserInfoEndpoint      string `json:"userinfo_endpoint"`
+	}
+	err := getJSON(context.Background(), strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", "", &doc)
+	if err != nil {
+		return fmt.Errorf("unable to discover %s: %w", p.Name, err)
+	}
+
+	p.AuthURL = doc.AuthorizationEndpoint
+	p.TokenURL = doc.TokenEndpoint
+	p.UserInfoURL = doc.UserInfoEndpoint
+	return nil
+}
+
+// GeneratePKCE returns a code verifier and its S256 challenge.
+func GeneratePKCE() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	verifier := base64.RawURLEncoding.EncodeToString(b)
+	sum := sha256.Sum256([]byte(verifier))
+	return verifier, base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+func (p *OAuthProvider) AuthCodeURL(state, challenge string) string {
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.ClientID)
+	v.Set("redirect_uri", p.RedirectURL)
+	v.Set("scope", strings.Join(p.Scopes, " "))
+	v.Set("state", state)
+	v.Set("code_challenge", challenge)
+	v.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(p.AuthURL, "?") {
+		sep = "&"
+	}
+	return p.AuthURL + sep + v.Encode()
+}
+
+// Exchange trades an authorization code for an access token.
+func (p *OAuthProvider) Exchange(ctx context.Context, code, verifier string) (string, error) {
+	v := url.Values{}
+	v.Set("grant_type", "authorization_code")
+	v.Set("code", code)
+	v.Set("redirect_uri", p.RedirectURL)
+	v.Set("client_id", p.ClientID)
+	v.Set("client_secret", p.ClientSecret)
+	v.Set("code_verifier", verifier)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.TokenURL, strings.NewReader(v.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := oauthClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("unable to exchange code: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		Error       string `json:"error"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&token)
+	if err != nil {
+		return "", fmt.Errorf("unable to decode token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || token.AccessToken == "" {
+		return "", fmt.Errorf("token exchange failed with %d: %s", resp.StatusCode, token.Error)
+	}
+	return token.AccessToken, nil
+}
+
+func (p *OAuthProvider) UserInfo(ctx context.Context, accessToken string) (*OAuthIdentity, error) {
+	if p.GitHub {
+		return p.githubUserInfo(ctx, accessToken)
+	}
+
+	var info struct {
+		Subject           string `json:"sub"`
+		PreferredUsername string `json:"preferred_username"`
+		Email             string `json:"email"`
+		EmailVerified     bool   `json:"email_verified"`
+	}
+	err := getJSON(ctx, p.UserInfoURL, accessToken, &info)
+	if err != nil {
+		return nil, err
+	}
+	if info.Subject == "" {
+		return nil, fmt.Errorf("userinfo from %s has no subject", p.Name)
+	}
+
+	username := info.PreferredUsername
+	if username == "" {
+		username = strings.Split(info.Email, "@")[0]
+	}
+	return &OAuthIdentity{
+		Subject:       info.Subject,
+		Username:      username,
+		Email:         info.Email,
+		EmailVerified: info.EmailVerified,
+	}, nil
+}
+
+func (p *OAuthProvider) githubUserInfo(ctx context.Context, accessToken string) (*OAuthIdentity, error) {
+	var user struct {
+		ID    int64  `json:"id"`
+		Login string `json:"login"`
+	}
+	err := getJSON(ctx, p.UserInfoURL, accessToken, &user)
+	if err != nil {
+		return nil, err
+	}
+
+	identity := &OAuthIdentity{
+		Subject:  fmt.Sprint(user.ID),
+		Username: user.Login,
+	}
+
+	// The profile email may be unset or unverified, the emails API says which is which.
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	err = getJSON(ctx, p.UserInfoURL+"/emails", accessToken, &emails)
+	if err != nil {
+		log.Println(err)
+	}
+	for _, e := range emails {
+		if e.Primary {
+			identity.Email = e.Email
+			identity.EmailVerified = e.Verified
+		}
+	}
+
+	return identity, nil
+}
+
+func getJSON(ctx context.Context, url, accessToken string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+
+	resp, err := oauthClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("GET %s failed with %d: %s", url, resp.StatusCode, body)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
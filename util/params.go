@@ -0,0 +1,144 @@
+package util
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"gpu/model"
+)
+
+// Param names double as metadata keys and env vars.
+var paramName = regexp.MustCompile(`^[A-Z][A-Z0-9_]{0,63}$`)
+
+// ValidateParamSchema checks a template's params are well formed, including
+// that every default passes its own rules.
+func ValidateParamSchema(params []model.TemplateParam) error {
+	seen := map[string]bool{}
+	for _, param := range params {
+		if !paramName.MatchString(param.Name) {
+			return fmt.Errorf("Invalid param name %q.", param.Name)
+		}
+		if seen[param.Name] {
+			return fmt.Errorf("Duplicate param %s.", param.Name)
+		}
+		seen[param.Name] = true
+
+		switch param.Type {
+		case "string", "secret", "int", "bool", "port":
+		case "enum":
+			if len(param.Options) == 0 {
+				return fmt.Errorf("Enum param %s needs options.", param.Name)
+			}
+		default:
+			return fmt.Errorf("Invalid type %q for param %s.", param.Type, param.Name)
+		}
+		if param.Pattern != "" {
+			if _, err := regexp.Compile(param.Pattern); err != nil {
+				return fmt.Errorf("Invalid pattern for param %s.", param.Name)
+			}
+		}
+		if param.Type == "secret" && param.Default != "" {
+			return fmt.Errorf("Secret param %s can't have a default.", param.Name)
+		}
+		if param.Default != "" {
+			if err := checkParam(param, param.Default); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func checkParam(param model.TemplateParam, value string) error {
+	switch param.Type {
+	case "int", "port":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%s must be a number.", param.Name)
+		}
+		if param.Type == "port" && (n < 1 || n > 65535) {
+			return fmt.Errorf("%s must be a port.", param.Name)
+		}
+		if param.Min != nil && n < *param.Min {
+			return fmt.Errorf("%s must be at least %d.", param.Name, *param.Min)
+		}
+		if param.Max != nil && n > *param.Max {
+			return fmt.Errorf("%s must be at most %d.", param.Name, *param.Max)
+		}
+	case "bool":
+		if _, err := strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("%s must be true or false.", param.Name)
+		}
+	case "enum":
+		for _, option := range param.Options {
+			if value == option {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s must be one of %v.", param.Name, param.Options)
+	default:
+		if len(value) > 4096 {
+			return fmt.Errorf("%s is too long.", param.Name)
+		}
+		if param.Pattern != "" && !regexp.MustCompile(param.Pattern).MatchString(value) {
+			return fmt.Errorf("%s is invalid.", param.Name)
+		}
+		if param.Min != nil && len(value) < *param.Min {
+			return fmt.Errorf("%s must be at least %d characters.", param.Name, *param.Min)
+		}
+		if param.Max != nil && len(value) > *param.Max {
+			return fmt.Errorf("%s must be at most %d characters.", param.Name, *param.Max)
+		}
+	}
+	return nil
+}
+
+// ResolveParams validates launch values against a template's params and fills
+// in defaults. It returns every value for the instance, and the ones safe to
+// store, which leave out secrets. The error message is meant for the user.
+func ResolveParams(params []model.TemplateParam, values map[string]interface{}) (map[string]string, map[string]string, error) {
+	declared := map[string]bool{}
+	for _, param := range params {
+		declared[param.Name] = true
+	}
+	for name := range values {
+		if !declared[name] {
+			return nil, nil, fmt.Errorf("Unknown param %s.", name)
+		}
+	}
+
+	all := map[string]string{}
+	public := map[string]string{}
+	for _, param := range params {
+		value := param.Default
+		if raw, ok := values[param.Name]; ok && raw != nil {
+			switch v := raw.(type) {
+			case string:
+				value = v
+			case float64:
+				value = strconv.FormatFloat(v, 'f', -1, 64)
+			case bool:
+				value = strconv.FormatBool(v)
+			default:
+				return nil, nil, fmt.Errorf("%s must be a string, number or boolean.", param.Name)
+			}
+		}
+
+		if value == "" {
+			if param.Required {
+				return nil, nil, fmt.Errorf("%s is required.", param.Name)
+			}
+			continue
+		}
+		if err := checkParam(param, value); err != nil {
+			return nil, nil, err
+		}
+
+		all[param.Name] = value
+		if param.Type != "secret" {
+			public[param.Name] = value
+		}
+	}
+	return all, public, nil
+}
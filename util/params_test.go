@@ -0,0 +1,127 @@
+package util
+
+import (
+	"reflect"
+	"testing"
+
+	"gpu/model"
+)
+
+func intp(n int) *int {
+	return &n
+}
+
+func TestValidateParamSchema(t *testing.T) {
+	tests := []struct {
+		name   string
+		params []model.TemplateParam
+		ok     bool
+	}{
+		{"empty", nil, true},
+		{"every type", []model.TemplateParam{
+			{Name: "MODEL", Type: "string", Pattern: "^[a-z0-9-]+$", Default: "llama"},
+			{Name: "TOKEN", Type: "secret"},
+			{Name: "BATCH_SIZE", Type: "int", Min: intp(1), Max: intp(64), Default: "8"},
+			{Name: "DEBUG", Type: "bool", Default: "false"},
+			{Name: "PORT", Type: "port", Default: "8080"},
+			{Name: "PRECISION", Type: "enum", Options: []string{"fp16", "bf16"}, Default: "bf16"},
+		}, true},
+		{"lowercase name", []model.TemplateParam{{Name: "model", Type: "string"}}, false},
+		{"leading digit", []model.TemplateParam{{Name: "1MODEL", Type: "string"}}, false},
+		{"dash in name", []model.TemplateParam{{Name: "MODEL-NAME", Type: "string"}}, false},
+		{"empty name", []model.TemplateParam{{Name: "", Type: "string"}}, false},
+		{"duplicate", []model.TemplateParam{{Name: "A", Type: "string"}, {Name: "A", Type: "int"}}, false},
+		{"unknown type", []model.TemplateParam{{Name: "A", Type: "float"}}, false},
+		{"enum without options", []model.TemplateParam{{Name: "A", Type: "enum"}}, false},
+		{"bad pattern", []model.TemplateParam{{Name: "A", Type: "string", Pattern: "("}}, false},
+		{"secret default", []model.TemplateParam{{Name: "A", Type: "secret", Default: "hunter2"}}, false},
+		{"default off pattern", []model.TemplateParam{{Name: "A", Type: "string", Pattern: "^[a-z]+$", Default: "ABC"}}, false},
+		{"default over max", []model.TemplateParam{{Name: "A", Type: "int", Max: intp(4), Default: "8"}}, false},
+		{"default not an option", []model.TemplateParam{{Name: "A", Type: "enum", Options: []string{"x"}, Default: "y"}}, false},
+		{"default port out of range", []model.TemplateParam{{Name: "A", Type: "port", Default: "70000"}}, false},
+	}
+	for _, tt := range tests {
+		err := ValidateParamSchema(tt.params)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: ValidateParamSchema = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestResolveParams(t *testing.T) {
+	params := []model.TemplateParam{
+		{Name: "MODEL", Type: "string", Required: true, Pattern: "^[a-z0-9-]+$", Max: intp(32)},
+		{Name: "TOKEN", Type: "secret"},
+		{Name: "BATCH_SIZE", Type: "int", Min: intp(1), Max: intp(64), Default: "8"},
+		{Name: "DEBUG", Type: "bool"},
+		{Name: "PORT", Type: "port", Default: "8080"},
+		{Name: "PRECISION", Type: "enum", Options: []string{"fp16", "bf16"}},
+	}
+
+	tests := []struct {
+		name   string
+		values map[string]interface{}
+		all    map[string]string
+		public map[string]string
+	}{
+		{
+			"defaults",
+			map[string]interface{}{"MODEL": "llama"},
+			map[string]string{"MODEL": "llama", "BATCH_SIZE": "8", "PORT": "8080"},
+			map[string]string{"MODEL": "llama", "BATCH_SIZE": "8", "PORT": "8080"},
+		},
+		{
+			"coerced from JSON",
+			map[string]interface{}{"MODEL": "llama", "BATCH_SIZE": float64(16), "DEBUG": true, "PORT": "9000", "PRECISION": "fp16"},
+			map[string]string{"MODEL": "llama", "BATCH_SIZE": "16", "DEBUG": "true", "PORT": "9000", "PRECISION": "fp16"},
+			map[string]string{"MODEL": "llama", "BATCH_SIZE": "16", "DEBUG": "true", "PORT": "9000", "PRECISION": "fp16"},
+		},
+		{
+			"null falls back to the default",
+			map[string]interface{}{"MODEL": "llama", "BATCH_SIZE": nil},
+			map[string]string{"MODEL": "llama", "BATCH_SIZE": "8", "PORT": "8080"},
+			map[string]string{"MODEL": "llama", "BATCH_SIZE": "8", "PORT": "8080"},
+		},
+		{
+			"secret left out of public",
+			map[string]interface{}{"MODEL": "llama", "TOKEN": "hf_secret"},
+			map[string]string{"MODEL": "llama", "TOKEN": "hf_secret", "BATCH_SIZE": "8", "PORT": "8080"},
+			map[string]string{"MODEL": "llama", "BATCH_SIZE": "8", "PORT": "8080"},
+		},
+	}
+	for _, tt := range tests {
+		all, public, err := ResolveParams(params, tt.values)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(all, tt.all) {
+			t.Errorf("%s: all = %v, want %v", tt.name, all, tt.all)
+		}
+		if !reflect.DeepEqual(public, tt.public) {
+			t.Errorf("%s: public = %v, want %v", tt.name, public, tt.public)
+		}
+	}
+
+	invalid := map[string]map[string]interface{}{
+		"missing required":  {},
+		"empty required":    {"MODEL": ""},
+		"unknown param":     {"MODEL": "llama", "OTHER": "x"},
+		"off pattern":       {"MODEL": "Llama 3"},
+		"too long":          {"MODEL": "a-very-long-model-name-over-the-limit"},
+		"not a number":      {"MODEL": "llama", "BATCH_SIZE": "lots"},
+		"fraction":          {"MODEL": "llama", "BATCH_SIZE": 1.5},
+		"under min":         {"MODEL": "llama", "BATCH_SIZE": float64(0)},
+		"over max":          {"MODEL": "llama", "BATCH_SIZE": float64(65)},
+		"not a bool":        {"MODEL": "llama", "DEBUG": "maybe"},
+		"port zero":         {"MODEL": "llama", "PORT": float64(0)},
+		"port too high":     {"MODEL": "llama", "PORT": float64(65536)},
+		"not an option":     {"MODEL": "llama", "PRECISION": "fp8"},
+		"unsupported value": {"MODEL": "llama", "BATCH_SIZE": []interface{}{1}},
+	}
+	for name, values := range invalid {
+		if _, _, err := ResolveParams(params, values); err == nil {
+			t.Errorf("%s: accepted %v", name, values)
+		}
+	}
+}
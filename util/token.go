@@ -0,0 +1,38 @@
+package util
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// GenerateToken returns a random single-use token and the hash to store for it.
+func GenerateToken() (string, string, error) {
+	token, err := randomHex(32)
+	if err != nil {
+		return "", "", err
+	}
+	return token, HashToken(token), nil
+}
+
+// HashToken hashes high-entropy secrets for storage. Unlike passwords they
+// don't need a slow hash, and a fast one lets them be looked up directly.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// GenerateInviteCode returns a short code that is easy to read out at an event.
+func GenerateInviteCode() (string, error) {
+	code, err := randomHex(5)
+	return strings.ToUpper(code), err
+}
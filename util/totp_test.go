@@ -0,0 +1,75 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 key of RFC 6238 appendix B, "12345678901234567890".
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	// The RFC lists 8 digit codes, these are their last 6 digits.
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		code, err := TOTPCode(rfc6238Secret, TOTPStep(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tt.code {
+			t.Errorf("TOTPCode at %d = %s, want %s", tt.unix, code, tt.code)
+		}
+	}
+
+	if _, err := TOTPCode("not base32!", 1); err == nil {
+		t.Error("invalid secret accepted")
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := TOTPStep(now)
+	code := func(step int64) string {
+		c, err := TOTPCode(rfc6238Secret, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name     string
+		code     string
+		lastStep int64
+		ok       bool
+		matched  int64
+	}{
+		{"current step", code(step), 0, true, step},
+		{"previous step", code(step - 1), 0, true, step - 1},
+		{"next step", code(step + 1), 0, true, step + 1},
+		{"two steps old", code(step - 2), 0, false, 0},
+		{"two steps ahead", code(step + 2), 0, false, 0},
+		{"surrounding spaces", " " + code(step) + " ", 0, true, step},
+		{"replayed", code(step), step, false, 0},
+		{"older than last use", code(step - 1), step - 1, false, 0},
+		{"newer than last use", code(step), step - 1, true, step},
+		{"too short", code(step)[:5], 0, false, 0},
+		{"too long", code(step) + "0", 0, false, 0},
+	}
+	for _, tt := range tests {
+		matched, ok := ValidateTOTP(rfc6238Secret, tt.code, now, tt.lastStep)
+		if ok != tt.ok || (ok && matched != tt.matched) {
+			t.Errorf("%s: ValidateTOTP = %d, %v, want %d, %v", tt.name, matched, ok, tt.matched, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package util
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPublicIP(t *testing.T) {
+	tests := map[string]bool{
+		"8.8.8.8":           true,
+		"2606:4700::1111":   true,
+		"127.0.0.1":         false,
+		"10.1.2.3":          false,
+		"172.16.0.1":        false,
+		"192.168.1.1":       false,
+		"169.254.169.254":   false,
+		"0.0.0.0":           false,
+		"::1":               false,
+		"fe80::1":           false,
+		"fd00::1":           false,
+		"::ffff:10.0.0.1":   false,
+		"224.0.0.1":         false,
+		"0.1.2.3":           false,
+		"100.64.0.1":        false,
+		"192.0.0.8":         false,
+		"192.0.2.1":         false,
+		"198.18.0.1":        false,
+		"198.51.100.1":      false,
+		"203.0.113.1":       false,
+		"240.0.0.1":         false,
+		"255.255.255.255":   false,
+		"::":                false,
+		"64:ff9b::a00:1":    false,
+		"2001:db8::1":       false,
+		"2002:a00:1::1":     false,
+		"::ffff:100.64.0.1": false,
+		"100.128.0.1":       true,
+		"198.20.0.1":        true,
+	}
+	for addr, want := range tests {
+		if got := publicIP(net.ParseIP(addr)); got != want {
+			t.Errorf("publicIP(%s) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestPostWebhookRefusesInternalAddresses(t *testing.T) {
+	hits := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+	}))
+	defer server.Close()
+
+	// The test server listens on loopback, reached by IP and by name.
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	for _, url := range []string{server.URL, "http://localhost:" + port} {
+		code, err := PostWebhook(url, "whsec_test", "server.ready", []byte(`{}`))
+		if err == nil || code != 0 {
+			t.Errorf("PostWebhook(%s) = %d, %v, want refused", url, code, err)
+		}
+	}
+	if hits != 0 {
+		t.Errorf("internal server was hit %d times", hits)
+	}
+}